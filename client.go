@@ -1,20 +1,46 @@
+//go:build ignore
+
 package main
 
 import (
+	"flag"
 	"log"
 
 	"github.com/petariliev/kvstore/client"
 )
 
 func main() {
-	kvClient, err := client.New()
+	script := flag.String("f", "", "run the commands in this file instead of starting an interactive session")
+	continueOnError := flag.Bool("continue-on-error", false, "keep running a script after a command fails")
+	addr := flag.String("addr", client.ServerAddress, "server to connect to, host:port or unix:///path/to/socket")
+	output := flag.String("output", string(client.FormatRaw), "response format: raw, json or table")
+	timeout := flag.Duration("timeout", 0, "how long to wait for each response before giving up, 0 waits forever")
+	flag.Parse()
+
+	format, err := client.ParseOutputFormat(*output)
+	if err != nil {
+		log.Fatalf("[FATAL] %v", err)
+	}
+
+	kvClient, err := client.Dial(*addr)
 	if err != nil {
 		log.Fatalf("[FATAL] Failed to create client: %v", err)
 	}
 	defer kvClient.Close()
+	kvClient.Format = format
+	kvClient.Timeout = *timeout
+	kvClient.ListenTimeout = *timeout
 
 	log.Println("[INFO] Connected to server")
 
+	if *script != "" {
+		kvClient.ContinueOnError = *continueOnError
+		if err := kvClient.RunScript(*script); err != nil {
+			log.Printf("[ERROR] Script failed: %v", err)
+		}
+		return
+	}
+
 	if err := kvClient.RunInteractive(); err != nil {
 		log.Printf("[ERROR] Error during interactive session: %v", err)
 	}
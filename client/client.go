@@ -7,24 +7,114 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/chzyer/readline"
+	"github.com/petariliev/kvstore/protocol"
 )
 
 const (
 	ServerAddress = ":8080"
 	QuitCommand   = "quit"
 	ExitCommand   = "exit"
+	Prompt        = "kv> "
+	HistoryFile   = ".kvstore_history"
 )
 
+// ErrServerDisconnected is returned once the server closes the connection
+var ErrServerDisconnected = errors.New("server disconnected")
+
+// ErrTimeout is returned when a response doesn't arrive in time. The
+// connection is closed, since a late response would otherwise be taken for
+// the next command's.
+var ErrTimeout = errors.New("timed out waiting for a response")
+
+// PartialResponseError is returned when the connection ends partway through
+// a response. Partial holds what arrived before it did, and Err why the
+// connection ended.
+type PartialResponseError struct {
+	Partial string
+	Err     error
+}
+
+func (e *PartialResponseError) Error() string {
+	return fmt.Sprintf("%v partway through a response", e.Err)
+}
+
+func (e *PartialResponseError) Unwrap() error {
+	return e.Err
+}
+
+// Message is a pub/sub message the server pushed to a subscribed client
+type Message struct {
+	Channel string
+	Payload string
+}
+
+// printPartial prints what arrived of a response cut short by err, if any
+func printPartial(w io.Writer, err error) {
+	var partial *PartialResponseError
+	if errors.As(err, &partial) {
+		fmt.Fprintf(w, "%s\n(response cut short)\n", partial.Partial)
+	}
+}
+
+// KVClient is a single connection to the server. It isn't safe for
+// concurrent use; goroutines that issue commands concurrently should each
+// take their own client from a Pool.
 type KVClient struct {
 	conn   net.Conn
 	reader *bufio.Reader
+
+	// When the client was last returned to a Pool
+	idleSince time.Time
+
+	// Channels the interactive session is subscribed to, in order. Only
+	// Listen touches it.
+	subscriptions []string
+
+	// Commands sent by the interactive session still waiting for a response
+	mu      sync.Mutex
+	pending []string
+
+	// ContinueOnError makes RunScript keep going after a failed command
+	ContinueOnError bool
+
+	// Format controls how responses are printed, raw by default
+	Format OutputFormat
+
+	// Timeout bounds how long Do and RunScript wait for each response, 0
+	// waits forever
+	Timeout time.Duration
+
+	// ListenTimeout bounds how long the interactive session waits for the
+	// response to a command it sent, 0 waits forever. It doesn't apply while
+	// no command is pending, such as when only pub/sub messages are expected.
+	ListenTimeout time.Duration
+
+	// OnMessage is called with each pub/sub message that arrives while the
+	// client waits for a reply. Messages are dropped if it's nil.
+	OnMessage func(Message)
 }
 
 func New() (*KVClient, error) {
-	conn, err := net.Dial("tcp", ServerAddress)
+	return Dial(ServerAddress)
+}
+
+// Dial connects a new client to the server at addr, a TCP "host:port" or a
+// Unix socket given as "unix:///path/to/socket"
+func Dial(addr string) (*KVClient, error) {
+	network := "tcp"
+	if path, isUnix := strings.CutPrefix(addr, "unix://"); isUnix {
+		network, addr = "unix", path
+	}
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to server: %v", err)
 	}
@@ -33,6 +123,7 @@ func New() (*KVClient, error) {
 	client := KVClient{
 		conn:   conn,
 		reader: reader,
+		Format: FormatRaw,
 	}
 	return &client, nil
 }
@@ -49,31 +140,109 @@ func (c *KVClient) SendCommand(command string) error {
 	return nil
 }
 
+// Do sends command and waits for its response, for up to Timeout if set
+func (c *KVClient) Do(command string) (string, error) {
+	return c.doWithin(command, c.Timeout)
+}
+
+// doWithin is Do with its own timeout, 0 for none
+func (c *KVClient) doWithin(command string, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if err := c.SendCommand(command); err != nil {
+		return "", err
+	}
+	response, err := c.readResponse()
+	if errors.Is(err, ErrTimeout) {
+		c.conn.Close()
+	}
+	return response, err
+}
+
+// Listen prints replies and pub/sub messages as they arrive until the
+// connection is gone. Messages go through OnMessage, which prints them too
+// unless it was set to something else.
 func (c *KVClient) Listen(rl *readline.Instance) error {
+	show := func(text string) {
+		rl.Write([]byte("\r\033[K" + text + "\n"))
+		rl.Refresh()
+	}
+	if c.OnMessage == nil {
+		c.OnMessage = func(m Message) {
+			show(formatResponse(c.Format, "", fmt.Sprintf("[MESSAGE %s] %s", m.Channel, m.Payload)))
+		}
+	}
+
 	for {
-		var response strings.Builder
-		for {
-			line, err := c.reader.ReadString('\n')
+		response, err := c.readResponse()
+		if err != nil {
+			printPartial(rl, err)
+			return err
+		}
+		command := c.popPending()
+		show(formatResponse(c.Format, command, response))
+		c.trackSubscription(command, response, rl)
+	}
+}
+
+// RunScript sends every command in the file at path, one per line, and
+// prints each response. Blank lines and lines starting with # are skipped.
+// It stops at the first command that fails unless ContinueOnError is set.
+func (c *KVClient) RunScript(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open script: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	failed := 0
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" || strings.HasPrefix(cmd, "#") {
+			continue
+		}
+
+		err := validateInput(cmd)
+		if err == nil {
+			var response string
+			response, err = c.Do(cmd)
 			if err != nil {
-				if err == io.EOF {
-					return fmt.Errorf("Server disconnected")
-				}
-				return fmt.Errorf("[ERROR] Reading response: %v", err)
+				printPartial(os.Stdout, err)
+				return err
 			}
-			if strings.TrimSpace(line) == "END" {
-				break
+			fmt.Println(formatResponse(c.Format, cmd, response))
+			if strings.HasPrefix(response, "ERROR") {
+				err = errors.New(response)
 			}
-			response.WriteString(line)
 		}
-		responseString := response.String()
-		responseString = strings.TrimSpace(responseString)
-		rl.Write([]byte("\r\033[K" + responseString + "\n"))
-		rl.Refresh()
+
+		if err != nil {
+			if !c.ContinueOnError {
+				return fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			log.Printf("[WARN] Line %d: %v", lineNumber, err)
+			failed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read script: %v", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d commands failed", failed)
 	}
+	return nil
 }
 
 func (c *KVClient) RunInteractive() error {
-	rl, err := readline.New("kv> ")
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       Prompt,
+		HistoryFile:  historyPath(),
+		AutoComplete: commandCompleter(),
+	})
 	if err != nil {
 		return fmt.Errorf("[ERROR] Failed to initialize readline: %v", err)
 	}
@@ -84,18 +253,33 @@ func (c *KVClient) RunInteractive() error {
 
 	// line.SetCtrlCAborts(true)
 
-	// Start listening for messages
-	go c.Listen(rl)
+	// Start listening for messages. Listen only returns once the connection
+	// is gone, closing rl then wakes up the prompt so the user isn't left
+	// typing into a dead connection.
+	lost := make(chan error, 1)
+	go func() {
+		lost <- c.Listen(rl)
+		rl.Close()
+	}()
 
 	for {
 		cmd, err := rl.Readline()
 		if err != nil {
+			select {
+			case err := <-lost:
+				fmt.Println("Connection lost:", err)
+				return fmt.Errorf("connection lost: %v", err)
+			default:
+			}
 			log.Printf("[ERROR] Error reading input: %v", err)
 			break
 		}
 
 		cmd = strings.TrimSpace(cmd)
 		if cmd == ExitCommand || cmd == QuitCommand {
+			if err := c.SendCommand("QUIT"); err != nil {
+				log.Printf("[ERROR] Failed to notify server: %v", err)
+			}
 			log.Println("[INFO] Client exited interactive session")
 			fmt.Println("Bye 👋")
 			break
@@ -106,17 +290,163 @@ func (c *KVClient) RunInteractive() error {
 			continue
 		}
 
+		c.pushPending(cmd)
 		err = c.SendCommand(cmd)
 		if err != nil {
 			log.Printf("[ERROR] Command failed: %v", err)
+			c.popPending()
 			continue
 		}
 	}
 	return nil
 }
 
+// trackSubscription follows SUBSCRIBE/UNSUBSCRIBE commands so the prompt
+// shows which channels messages may arrive from. Listen calls it with every
+// response, so commands the server rejected don't change the prompt.
+func (c *KVClient) trackSubscription(cmd string, response string, rl *readline.Instance) {
+	tokens := strings.Fields(cmd)
+	if len(tokens) < 2 || strings.HasPrefix(response, "ERROR") {
+		return
+	}
+	switch strings.ToUpper(tokens[0]) {
+	case "SUBSCRIBE":
+		if !slices.Contains(c.subscriptions, tokens[1]) {
+			c.subscriptions = append(c.subscriptions, tokens[1])
+		}
+	case "UNSUBSCRIBE":
+		c.subscriptions = slices.DeleteFunc(c.subscriptions, func(channel string) bool {
+			return channel == tokens[1]
+		})
+	default:
+		return
+	}
+
+	if len(c.subscriptions) == 0 {
+		rl.SetPrompt(Prompt)
+	} else {
+		rl.SetPrompt(fmt.Sprintf("kv(subscribed: %s)> ", strings.Join(c.subscriptions, ",")))
+	}
+	rl.Refresh()
+}
+
 // Helpers
 
+// historyPath returns the history file in the user's home directory, or an
+// empty path (no history) if the home directory is unknown
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("[WARN] Command history disabled: %v", err)
+		return ""
+	}
+	return filepath.Join(home, HistoryFile)
+}
+
+// commandCompleter completes the command names known to the server
+func commandCompleter() *readline.PrefixCompleter {
+	items := make([]readline.PrefixCompleterInterface, 0, len(protocol.Commands))
+	for _, cmd := range protocol.Commands {
+		items = append(items, readline.PcItem(cmd))
+	}
+	return readline.NewPrefixCompleter(items...)
+}
+
+// pushPending and popPending queue interactive commands so Listen knows
+// which command each response answers. With ListenTimeout set, they also
+// keep a read deadline on the connection for the oldest pending command.
+func (c *KVClient) pushPending(cmd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, cmd)
+	if len(c.pending) == 1 && c.ListenTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ListenTimeout))
+	}
+}
+
+func (c *KVClient) popPending() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return ""
+	}
+	cmd := c.pending[0]
+	c.pending = c.pending[1:]
+	if c.ListenTimeout > 0 {
+		if len(c.pending) == 0 {
+			c.conn.SetReadDeadline(time.Time{})
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(c.ListenTimeout))
+		}
+	}
+	return cmd
+}
+
+// readResponse reads the reply to a command. Pub/sub messages that arrive
+// first are handed to OnMessage.
+func (c *KVClient) readResponse() (string, error) {
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil || strings.TrimSuffix(line, "\n") != protocol.PushMarker {
+			return c.readFrame(line, err)
+		}
+
+		push, err := c.readFrame(c.reader.ReadString('\n'))
+		if err != nil {
+			return "", err
+		}
+		c.deliver(push)
+	}
+}
+
+// deliver parses the body of a push frame, "message <quoted channel>"
+// followed by the payload, and passes it to OnMessage
+func (c *KVClient) deliver(push string) {
+	header, payload, _ := strings.Cut(push, "\n")
+	quoted, ok := strings.CutPrefix(header, "message ")
+	if !ok {
+		return
+	}
+	channel, err := strconv.Unquote(quoted)
+	if err != nil || c.OnMessage == nil {
+		return
+	}
+	c.OnMessage(Message{Channel: channel, Payload: payload})
+}
+
+// readFrame reads a frame up to its END line, given its first line and the
+// error reading it, undoing the escaping of lines that would read as END or
+// PUSH. If the connection ends before END, whatever arrived, including a
+// last line without its newline, comes back along with a
+// *PartialResponseError.
+func (c *KVClient) readFrame(line string, err error) (string, error) {
+	var response strings.Builder
+	for {
+		content, end := protocol.ParseResponseLine(strings.TrimSuffix(line, "\n"))
+		if end {
+			break
+		}
+		response.WriteString(content)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrServerDisconnected
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = ErrTimeout
+			} else {
+				err = fmt.Errorf("[ERROR] Reading response: %v", err)
+			}
+			if response.Len() == 0 {
+				return "", err
+			}
+			partial := strings.TrimSpace(response.String())
+			return partial, &PartialResponseError{Partial: partial, Err: err}
+		}
+		response.WriteString("\n")
+		line, err = c.reader.ReadString('\n')
+	}
+	return strings.TrimSpace(response.String()), nil
+}
+
 func validateInput(input string) error {
 	tokens := strings.Fields(input)
 	if len(tokens) == 0 {
@@ -126,10 +456,22 @@ func validateInput(input string) error {
 
 	switch cmd {
 	case "SET":
-		if len(tokens) != 3 {
-			return errors.New("[ERROR] Invalid SET command. Format: SET <key> <value>")
+		if len(tokens) != 3 && (len(tokens) != 4 || strings.ToUpper(tokens[3]) != "KEEPTTL") {
+			return errors.New("[ERROR] Invalid SET command. Format: SET <key> <value> [KEEPTTL]")
+		}
+	case "SUBSCRIBE":
+		if len(tokens) != 2 && len(tokens) != 4 {
+			return errors.New("[ERROR] Invalid SUBSCRIBE command. Format: SUBSCRIBE <channel> [REPLAY <count>]")
+		}
+	case "UNSUBSCRIBE":
+		if len(tokens) != 2 {
+			return errors.New("[ERROR] Invalid UNSUBSCRIBE command. Format: UNSUBSCRIBE <channel>")
+		}
+	case "DEL", "DELETE":
+		if len(tokens) < 2 {
+			return fmt.Errorf("[ERROR] Invalid %s command. Format: %s <key> [<key> ...]", cmd, cmd)
 		}
-	case "GET", "DELETE":
+	case "GET":
 		if len(tokens) != 2 {
 			return fmt.Errorf("[ERROR] Invalid %s command. Format: %s <key>", cmd, cmd)
 		}
@@ -141,7 +483,11 @@ func validateInput(input string) error {
 		if len(tokens) != 3 {
 			return errors.New("[ERROR] Invalid DELETEEX command. Format: DELETEEX <key> <seconds>")
 		}
-	case "PING", "STATS", "KEYS":
+	case "PING":
+		if len(tokens) > 2 {
+			return errors.New("[ERROR] Invalid PING command. Format: PING [message]")
+		}
+	case "STATS", "KEYS":
 		if len(tokens) != 1 {
 			return fmt.Errorf("[ERROR] Invalid %s command. Format: %s", cmd, cmd)
 		}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// pipeClient returns a client whose server end answers the first command
+// with sent and then closes the connection
+func pipeClient(t *testing.T, sent string) *KVClient {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		if _, err := bufio.NewReader(serverConn).ReadString('\n'); err != nil {
+			return
+		}
+		io.WriteString(serverConn, sent)
+	}()
+	t.Cleanup(func() { clientConn.Close() })
+	return &KVClient{conn: clientConn, reader: bufio.NewReader(clientConn), Format: FormatRaw}
+}
+
+func TestPartialResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		sent        string
+		want        string
+		wantPartial bool
+	}{
+		{"complete frame", "first\nsecond\nEND\n", "first\nsecond", false},
+		{"cut off mid-line", "first\nsec", "first\nsec", true},
+		{"cut off after a line", "first\n", "first", true},
+		{"escaped terminator before the cut", "\\END\nfir", "END\nfir", true},
+		{"nothing sent", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := pipeClient(t, test.sent)
+			got, err := c.Do("GET k")
+			if got != test.want {
+				t.Fatalf("Do = %q, want %q", got, test.want)
+			}
+
+			var partial *PartialResponseError
+			switch {
+			case test.wantPartial:
+				if !errors.As(err, &partial) || partial.Partial != test.want {
+					t.Fatalf("error = %v, want a *PartialResponseError holding %q", err, test.want)
+				}
+				if !errors.Is(err, ErrServerDisconnected) {
+					t.Fatalf("error = %v, want it to wrap ErrServerDisconnected", err)
+				}
+			case test.sent == "":
+				if err != ErrServerDisconnected {
+					t.Fatalf("error = %v, want %v", err, ErrServerDisconnected)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
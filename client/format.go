@@ -0,0 +1,92 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// OutputFormat controls how responses are printed
+type OutputFormat string
+
+const (
+	FormatRaw   OutputFormat = "raw"
+	FormatJSON  OutputFormat = "json"
+	FormatTable OutputFormat = "table"
+)
+
+// ParseOutputFormat validates a format name given on the command line
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	switch format := OutputFormat(strings.ToLower(name)); format {
+	case FormatRaw, FormatJSON, FormatTable:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown output format '%s' (expected raw, json or table)", name)
+	}
+}
+
+// formatResponse renders the response to command in the given format.
+// command may be empty for messages the client didn't ask for, such as
+// pub/sub deliveries.
+func formatResponse(format OutputFormat, command string, response string) string {
+	switch format {
+	case FormatJSON:
+		return formatJSON(command, response)
+	case FormatTable:
+		return formatTable(command, response)
+	default:
+		return response
+	}
+}
+
+func formatJSON(command string, response string) string {
+	output := struct {
+		Command  string   `json:"command,omitempty"`
+		Response *string  `json:"response,omitempty"`
+		Lines    []string `json:"lines,omitempty"`
+		Error    bool     `json:"error,omitempty"`
+	}{
+		Command: command,
+		Error:   strings.HasPrefix(response, "ERROR"),
+	}
+
+	// Multi-value responses become arrays so scripts don't have to split them
+	if strings.Contains(response, "\n") {
+		output.Lines = strings.Split(response, "\n")
+	} else {
+		output.Response = &response
+	}
+
+	encoded, err := json.Marshal(output)
+	if err != nil {
+		return response
+	}
+	return string(encoded)
+}
+
+func formatTable(command string, response string) string {
+	lines := strings.Split(response, "\n")
+	tokens := strings.Fields(command)
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+
+	// MGET lines up with the keys that were asked for
+	if len(tokens) > 1 && strings.ToUpper(tokens[0]) == "MGET" && len(lines) == len(tokens)-1 {
+		fmt.Fprintln(w, "KEY\tVALUE")
+		for i, line := range lines {
+			fmt.Fprintf(w, "%s\t%s\n", tokens[i+1], line)
+		}
+	} else if len(lines) > 1 {
+		fmt.Fprintln(w, "#\tVALUE")
+		for i, line := range lines {
+			fmt.Fprintf(w, "%d\t%s\n", i+1, line)
+		}
+	} else {
+		return response
+	}
+
+	w.Flush()
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Get once the pool has been closed
+var ErrPoolClosed = errors.New("connection pool closed")
+
+const (
+	// DefaultHealthCheckAfter is how long a connection may sit idle in a
+	// pool before it's PINGed on checkout
+	DefaultHealthCheckAfter = 30 * time.Second
+
+	// How long the PING health check waits for PONG
+	healthCheckTimeout = 2 * time.Second
+)
+
+// Pool keeps up to size connections to one server for goroutines to check
+// out with Get and hand back with Put. Get blocks while all of them are in
+// use. A connection that was idle for longer than HealthCheckAfter is PINGed
+// before it's handed out, and dropped for a fresh one if it doesn't answer.
+type Pool struct {
+	addr string
+
+	// HealthCheckAfter is how long a connection may be idle before Get checks
+	// it with PING; 0 checks every time
+	HealthCheckAfter time.Duration
+
+	// Timeout is the Timeout of every connection the pool dials
+	Timeout time.Duration
+
+	// idle holds connections ready for use. slots holds one token per
+	// connection that's open, whether idle or checked out, so there are
+	// never more than size.
+	idle  chan *KVClient
+	slots chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewPool returns a pool of up to size connections to addr. Connections are
+// dialed as they're needed.
+func NewPool(addr string, size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		addr:             addr,
+		HealthCheckAfter: DefaultHealthCheckAfter,
+		idle:             make(chan *KVClient, size),
+		slots:            make(chan struct{}, size),
+	}
+}
+
+// Get checks out a connection, reusing an idle one if it's still alive and
+// dialing a new one otherwise. It blocks while size connections are in use.
+func (p *Pool) Get() (*KVClient, error) {
+	for {
+		if p.isClosed() {
+			return nil, ErrPoolClosed
+		}
+
+		// Idle connections first, so new ones are only dialed when needed
+		select {
+		case c := <-p.idle:
+			if p.healthy(c) {
+				return c, nil
+			}
+			p.discard(c)
+			continue
+		default:
+		}
+
+		select {
+		case c := <-p.idle:
+			if p.healthy(c) {
+				return c, nil
+			}
+			p.discard(c)
+		case p.slots <- struct{}{}:
+			c, err := Dial(p.addr)
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			if p.isClosed() {
+				p.discard(c)
+				return nil, ErrPoolClosed
+			}
+			c.Timeout = p.Timeout
+			return c, nil
+		}
+	}
+}
+
+// Put returns a connection taken with Get to the pool. It must not be used
+// afterwards.
+func (p *Pool) Put(c *KVClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.discard(c)
+		return
+	}
+
+	c.idleSince = time.Now()
+	p.idle <- c
+}
+
+// Discard closes a connection taken with Get instead of returning it, for
+// when it failed or was left in a state other users shouldn't inherit, such
+// as subscribed to a channel
+func (p *Pool) Discard(c *KVClient) {
+	p.discard(c)
+}
+
+// Do runs command on a pooled connection. A connection that fails is closed
+// rather than returned to the pool.
+func (p *Pool) Do(command string) (string, error) {
+	c, err := p.Get()
+	if err != nil {
+		return "", err
+	}
+
+	response, err := c.Do(command)
+	if err != nil {
+		p.discard(c)
+		return "", err
+	}
+	p.Put(c)
+	return response, nil
+}
+
+// Close closes the idle connections and makes later Gets fail. Connections
+// still checked out are closed when they're Put back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	for {
+		select {
+		case c := <-p.idle:
+			p.discard(c)
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// discard closes c and frees its slot
+func (p *Pool) discard(c *KVClient) {
+	c.Close()
+	<-p.slots
+}
+
+// healthy PINGs c if it has been idle for longer than HealthCheckAfter
+func (p *Pool) healthy(c *KVClient) bool {
+	if time.Since(c.idleSince) < p.HealthCheckAfter {
+		return true
+	}
+
+	response, err := c.doWithin("PING", healthCheckTimeout)
+	return err == nil && response == "PONG"
+}
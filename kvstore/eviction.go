@@ -0,0 +1,246 @@
+package kvstore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const OutOfMemory = "ERROR: OOM command not allowed when used memory > 'maxmemory'"
+const FrequencyNotTracked = "ERROR: An LFU maxmemory policy is not selected, access frequency not tracked"
+
+// Keys compared each time a victim is picked. Like Redis, eviction samples
+// a few keys rather than keeping every key ordered by age or frequency.
+const evictionSamples = 5
+
+// LFU counters start at lfuInitialCount so new keys aren't evicted before
+// they've had a chance to be read, and are halved every lfuDecayPeriod
+const (
+	lfuInitialCount = 5
+	lfuDecayPeriod  = time.Minute
+)
+
+// EvictionPolicy decides what happens once the store is over its memory limit
+type EvictionPolicy int
+
+const (
+	// NoEviction rejects writes until memory is freed
+	NoEviction EvictionPolicy = iota
+	// EvictLRU evicts the least recently used keys
+	EvictLRU
+	// EvictLFU evicts the least frequently used keys
+	EvictLFU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	default:
+		return "noeviction"
+	}
+}
+
+// ParseEvictionPolicy returns the EvictionPolicy named name
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	switch strings.ToLower(name) {
+	case "noeviction":
+		return NoEviction, true
+	case "lru":
+		return EvictLRU, true
+	case "lfu":
+		return EvictLFU, true
+	default:
+		return NoEviction, false
+	}
+}
+
+// frequency is a key's LFU access counter
+type frequency struct {
+	count   int
+	decayed time.Time
+}
+
+// decay halves the counter once for every lfuDecayPeriod since it was last
+// decayed, so keys that were hot long ago become eviction candidates
+func (f frequency) decay(now time.Time) frequency {
+	periods := int(now.Sub(f.decayed) / lfuDecayPeriod)
+	if periods > 0 {
+		f.count >>= min(periods, 63)
+		f.decayed = f.decayed.Add(time.Duration(periods) * lfuDecayPeriod)
+	}
+	return f
+}
+
+// access is a key's last access time and, under EvictLFU, its access
+// counter. Reads record accesses holding only the read lock, so the time is
+// atomic and the counter has a mutex of its own.
+type access struct {
+	at   atomic.Int64 // Unix nanoseconds
+	mu   sync.Mutex
+	freq frequency
+}
+
+func newAccess(now time.Time) *access {
+	a := &access{freq: frequency{count: lfuInitialCount, decayed: now}}
+	a.at.Store(now.UnixNano())
+	return a
+}
+
+func (a *access) lastAccess() time.Time {
+	return time.Unix(0, a.at.Load())
+}
+
+// record notes an access at now, counting it too if lfu is set
+func (a *access) record(now time.Time, lfu bool) {
+	a.at.Store(now.UnixNano())
+	if !lfu {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.freq = a.freq.decay(now)
+	a.freq.count++
+}
+
+// count returns the LFU counter as of now
+func (a *access) count(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.freq.decay(now).count
+}
+
+// SetMaxMemory limits the estimated memory use of the store to maxMemory
+// bytes, enforced by EnforceMemoryLimit according to policy. A maxMemory of
+// 0 removes the limit.
+func (s *KVStore) SetMaxMemory(maxMemory int, policy EvictionPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.maxMemory = maxMemory
+	s.evictionPolicy = policy
+	s.resetFrequencies()
+}
+
+// EnforceMemoryLimit evicts keys until the store's estimated memory use is
+// within the limit set by SetMaxMemory, and returns the keys it evicted.
+// Under NoEviction nothing is evicted and an OutOfMemory error is returned
+// instead. Estimating memory walks every key, so the limit is meant for
+// stores of modest size.
+func (s *KVStore) EnforceMemoryLimit() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.maxMemory <= 0 {
+		return nil, nil
+	}
+	used := 0
+	s.forEachKey(func(key string) {
+		used += s.entrySize(key)
+	})
+	if used <= s.maxMemory {
+		return nil, nil
+	}
+	if s.evictionPolicy == NoEviction {
+		return nil, errors.New(OutOfMemory)
+	}
+
+	var evicted []string
+	now := time.Now()
+	for used > s.maxMemory && s.keyCount() > 0 {
+		key := s.evictionCandidate(now)
+		used -= s.entrySize(key)
+		s.remove(key)
+		evicted = append(evicted, key)
+	}
+	return evicted, nil
+}
+
+// Frequency returns key's LFU access counter. It's only tracked under the
+// EvictLFU policy.
+func (s *KVStore) Frequency(key string) (int, error) {
+	key = s.foldKey(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.evictionPolicy != EvictLFU {
+		return 0, errors.New(FrequencyNotTracked)
+	}
+	if s.typeOf(key) == TypeNone || s.expired(key) {
+		return 0, errors.New(KeyNotFound)
+	}
+	if a := s.accessed[key]; a != nil {
+		return a.count(time.Now()), nil
+	}
+	return lfuInitialCount, nil
+}
+
+// evictionCandidate samples a few keys and returns the one the policy would
+// rather lose. Callers must hold the write lock and have checked the store
+// isn't empty.
+func (s *KVStore) evictionCandidate(now time.Time) string {
+	var victim string
+	sampled := 0
+	for key, a := range s.accessed {
+		if sampled == 0 || s.evictsBefore(a, s.accessed[victim], now) {
+			victim = key
+		}
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+	return victim
+}
+
+// evictsBefore reports whether the key accessed as a should be evicted
+// before the one accessed as other. Ties under LFU go to the least recently
+// used key.
+func (s *KVStore) evictsBefore(a, other *access, now time.Time) bool {
+	if s.evictionPolicy == EvictLFU {
+		count, otherCount := a.count(now), other.count(now)
+		if count != otherCount {
+			return count < otherCount
+		}
+	}
+	return a.at.Load() < other.at.Load()
+}
+
+// touch records an access to key for IDLETIME and the eviction policies.
+// Callers must hold the write lock.
+func (s *KVStore) touch(key string, now time.Time) {
+	a, exists := s.accessed[key]
+	if !exists {
+		s.accessed[key] = newAccess(now)
+		return
+	}
+	a.record(now, s.evictionPolicy == EvictLFU)
+}
+
+// touchShared is touch for readers holding only the read lock. It can't
+// add to the map, so keys the writers never touched aren't recorded.
+func (s *KVStore) touchShared(key string, now time.Time) {
+	if a, exists := s.accessed[key]; exists {
+		a.record(now, s.evictionPolicy == EvictLFU)
+	}
+}
+
+// resetFrequencies starts every key over at lfuInitialCount, for when the
+// keyspace was replaced wholesale. Callers must hold the write lock.
+func (s *KVStore) resetFrequencies() {
+	if s.evictionPolicy != EvictLFU {
+		return
+	}
+	now := time.Now()
+	s.forEachKey(func(key string) {
+		if a, exists := s.accessed[key]; exists {
+			a.freq = frequency{count: lfuInitialCount, decayed: now}
+		} else {
+			s.accessed[key] = newAccess(now)
+		}
+	})
+}
@@ -0,0 +1,33 @@
+package kvstore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// BenchmarkCleanUp measures one cleanup pass over a TTL-heavy keyspace where
+// half the keys have expired. It's the single-goroutine baseline to compare
+// cleanup workers against once the store is sharded.
+func BenchmarkCleanUp(b *testing.B) {
+	const keys = 100000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s := New()
+		past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+		for k := 0; k < keys; k++ {
+			key := "key:" + strconv.Itoa(k)
+			s.Set(key, "value")
+			if k%2 == 0 {
+				s.expirations[key] = past
+			} else {
+				s.expirations[key] = future
+			}
+		}
+		b.StartTimer()
+
+		if removed := s.cleanUp(); removed != keys/2 {
+			b.Fatalf("cleanUp removed %d keys, want %d", removed, keys/2)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const InvalidJSON = "ERROR: value is not valid JSON"
+const InvalidJSONPath = "ERROR: invalid JSON path, expected e.g. $.a.b[0]"
+const JSONPathNotFound = "ERROR: JSON path does not exist"
+const JSONNewKeyNotRoot = "ERROR: a new JSON key has to be set at the root path $"
+
+// jsonPathSegment is one step of a JSON path: an object member, or an array
+// index when isIndex is set. Negative indices count back from the end.
+type jsonPathSegment struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath splits a path such as $.a.b[0] or $["a b"][-1] into its
+// segments. The leading $ may be left out, and "$" or "." alone is the root.
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	rest := strings.TrimPrefix(path, "$")
+	if rest == "." {
+		return nil, nil
+	}
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		rest = "." + rest
+	}
+
+	var segments []jsonPathSegment
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			name := rest[1:end]
+			if name == "" {
+				return nil, errors.New(InvalidJSONPath)
+			}
+			segments = append(segments, jsonPathSegment{name: name})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New(InvalidJSONPath)
+			}
+			inner := rest[1:end]
+			if strings.HasPrefix(inner, `"`) {
+				name, err := strconv.Unquote(inner)
+				if err != nil {
+					return nil, errors.New(InvalidJSONPath)
+				}
+				segments = append(segments, jsonPathSegment{name: name})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, errors.New(InvalidJSONPath)
+				}
+				segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, errors.New(InvalidJSONPath)
+		}
+	}
+	return segments, nil
+}
+
+// resolveIndex turns a possibly negative index into a position in an array
+// of length n
+func resolveIndex(index int, n int) (int, bool) {
+	if index < 0 {
+		index += n
+	}
+	return index, index >= 0 && index < n
+}
+
+// decodeJSON parses a document, keeping numbers as written so large
+// integers don't lose precision
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return doc, nil
+}
+
+// encodeJSON formats a document compactly on one line
+func encodeJSON(doc interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// jsonDoc is a parsed JSON document. Objects are map[string]interface{},
+// arrays []interface{} and numbers json.Number.
+type jsonDoc struct {
+	root interface{}
+}
+
+func (d *jsonDoc) valueType() ValueType {
+	return TypeJSON
+}
+
+func (d *jsonDoc) encoding() string {
+	return "json"
+}
+
+func (d *jsonDoc) memoryUsage() int {
+	encoded, _ := encodeJSON(d.root)
+	return len(encoded)
+}
+
+// marshalValue stores the document itself in the snapshot
+func (d *jsonDoc) marshalValue() (json.RawMessage, error) {
+	encoded, err := encodeJSON(d.root)
+	return json.RawMessage(encoded), err
+}
+
+func unmarshalJSONDoc(raw json.RawMessage) (*jsonDoc, error) {
+	root, err := decodeJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonDoc{root: root}, nil
+}
+
+// getAt returns the value at path below node
+func getAt(node interface{}, path []jsonPathSegment) (interface{}, bool) {
+	for _, seg := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, exists := n[seg.name]
+			if seg.isIndex || !exists {
+				return nil, false
+			}
+			node = child
+		case []interface{}:
+			i, ok := resolveIndex(seg.index, len(n))
+			if !seg.isIndex || !ok {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// setAt puts value at path below node and returns the updated node. The
+// last segment may name a new object member, everything before it has to
+// exist already.
+func setAt(node interface{}, path []jsonPathSegment, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	seg := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if seg.isIndex {
+			return nil, errors.New(JSONPathNotFound)
+		}
+		child, exists := n[seg.name]
+		if !exists && len(path) > 1 {
+			return nil, errors.New(JSONPathNotFound)
+		}
+		updated, err := setAt(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[seg.name] = updated
+		return n, nil
+	case []interface{}:
+		i, ok := resolveIndex(seg.index, len(n))
+		if !seg.isIndex || !ok {
+			return nil, errors.New(JSONPathNotFound)
+		}
+		updated, err := setAt(n[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	default:
+		return nil, errors.New(JSONPathNotFound)
+	}
+}
+
+// deleteAt removes the value at path below node, which must not be empty,
+// and returns the updated node and whether anything was removed
+func deleteAt(node interface{}, path []jsonPathSegment) (interface{}, bool) {
+	seg := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[seg.name]
+		if seg.isIndex || !exists {
+			return n, false
+		}
+		if len(path) == 1 {
+			delete(n, seg.name)
+			return n, true
+		}
+		updated, deleted := deleteAt(child, path[1:])
+		n[seg.name] = updated
+		return n, deleted
+	case []interface{}:
+		i, ok := resolveIndex(seg.index, len(n))
+		if !seg.isIndex || !ok {
+			return n, false
+		}
+		if len(path) == 1 {
+			return append(n[:i], n[i+1:]...), true
+		}
+		updated, deleted := deleteAt(n[i], path[1:])
+		n[i] = updated
+		return n, deleted
+	default:
+		return n, false
+	}
+}
+
+// JSON Methods
+
+// JSONSet parses document and stores it at path in the JSON value at key.
+// A key that doesn't exist yet can only be set at the root.
+func (s *KVStore) JSONSet(key string, path string, document string) error {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+	value, err := decodeJSON([]byte(document))
+	if err != nil {
+		return errors.New(InvalidJSON)
+	}
+
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeJSON)
+	if err != nil {
+		return err
+	}
+	if err := s.checkEntry(key, document); err != nil {
+		return err
+	}
+	if c == nil {
+		if len(segments) > 0 {
+			return errors.New(JSONNewKeyNotRoot)
+		}
+		s.storeCollection(key, &jsonDoc{root: value})
+		return nil
+	}
+
+	d := c.(*jsonDoc)
+	root, err := setAt(d.root, segments, value)
+	if err != nil {
+		return err
+	}
+	d.root = root
+	s.bump(key)
+	return nil
+}
+
+// JSONGet returns the value at path in the JSON value at key, encoded on
+// one line. The boolean is false if the key doesn't exist.
+func (s *KVStore) JSONGet(key string, path string) (string, bool, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeJSON)
+	if c == nil || err != nil {
+		return "", false, err
+	}
+
+	value, found := getAt(c.(*jsonDoc).root, segments)
+	if !found {
+		return "", true, errors.New(JSONPathNotFound)
+	}
+	encoded, err := encodeJSON(value)
+	return encoded, true, err
+}
+
+// JSONDel removes the value at path in the JSON value at key and returns
+// how many values were removed, 0 or 1. Deleting the root deletes the key.
+func (s *KVStore) JSONDel(key string, path string) (int, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeJSON)
+	if c == nil || err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		s.remove(key)
+		return 1, nil
+	}
+
+	d := c.(*jsonDoc)
+	root, deleted := deleteAt(d.root, segments)
+	if !deleted {
+		return 0, nil
+	}
+	d.root = root
+	s.bump(key)
+	return 1, nil
+}
@@ -1,104 +1,549 @@
 package kvstore
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const KeyNotFound = "ERROR: Key not found"
+const WrongType = "ERROR: WRONGTYPE Operation against a key holding the wrong kind of value"
 const DataFile = "data.txt"
 const ExpirationsFile = "expirations.txt"
 
+// Snapshots saved to a file with this extension are gzip-compressed
+const CompressedExtension = ".gz"
+
+// Format of snapshots written by SaveToDisk. Version 2 stores expirations as
+// Unix milliseconds instead of RFC 3339 strings. Version 3 stores one typed
+// record per key, so collections are saved along with strings.
+const snapshotVersion = 3
+
+var csvHeader = []string{"key", "value", "ttl_seconds"}
+
+// ValueType identifies the kind of value stored under a key
+type ValueType int
+
+const (
+	TypeNone ValueType = iota
+	TypeString
+	TypeSortedSet
+	TypeStream
+	TypeJSON
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeSortedSet:
+		return "zset"
+	case TypeStream:
+		return "stream"
+	case TypeJSON:
+		return "json"
+	default:
+		return "none"
+	}
+}
+
+// ParseValueType returns the ValueType named name, as reported by TYPE
+func ParseValueType(name string) (ValueType, bool) {
+	switch strings.ToLower(name) {
+	case "string":
+		return TypeString, true
+	case "zset":
+		return TypeSortedSet, true
+	case "stream":
+		return TypeStream, true
+	case "json":
+		return TypeJSON, true
+	default:
+		return TypeNone, false
+	}
+}
+
+// collection is implemented by every value type other than plain strings.
+// marshalValue encodes the collection for a snapshot record, and
+// unmarshalCollection has to be able to decode it again.
+type collection interface {
+	valueType() ValueType
+	encoding() string
+	memoryUsage() int
+	marshalValue() (json.RawMessage, error)
+}
+
+// snapshotRecord is one key in a version 3 snapshot. Value is a JSON string
+// for strings, collections define their own encoding. ExpireAtMs is the
+// expiration in Unix milliseconds, 0 if the key has none.
+type snapshotRecord struct {
+	Key        string          `json:"key"`
+	Type       string          `json:"type"`
+	Value      json.RawMessage `json:"value"`
+	ExpireAtMs int64           `json:"expireAtMs,omitempty"`
+}
+
+// decodedSnapshot is the keyspace read from a snapshot of any version.
+// accessed and revisions are filled in by replaceWith.
+type decodedSnapshot struct {
+	data        map[string]string
+	collections map[string]collection
+	expirations map[string]time.Time
+	accessed    map[string]*access
+	revisions   map[string]int64
+}
+
+// Strings up to this length are reported with the embstr encoding
+const embstrSizeLimit = 44
+
+// Rough per-entry overheads used by the memory estimator: two string headers
+// plus map bucket bookkeeping for every key, and a time.Time plus bucket
+// bookkeeping for every expiration or access record
+const (
+	entryOverhead     = 48
+	timestampOverhead = 40
+)
+
 type KVStore struct {
 	mutex       sync.RWMutex
 	data        map[string]string
+	collections map[string]collection
 	expirations map[string]time.Time
+	accessed    map[string]*access
+
+	// TTL jitter applied by SetEx, see SetTTLJitter
+	jitterPercent int
+	jitterRand    *rand.Rand
+
+	// Optional trie of keys, see EnablePrefixIndex
+	index *prefixIndex
+
+	// Lower-case every key, see EnableCaseInsensitiveKeys
+	foldKeys bool
+
+	// Channels of WaitFor callers, closed once their key is set
+	waiters map[string][]chan struct{}
+
+	// Pauses the scheduled cleanup, see SetActiveExpire
+	activeExpireOff atomic.Bool
+
+	// Interval of the scheduled cleanup, see SetCleanupInterval
+	cleanupInterval atomic.Int64
+
+	// loadMu keeps LoadFromDisk calls from overlapping. loadRead and
+	// loadTotal are the progress of the one running, see LoadProgress.
+	loadMu    sync.Mutex
+	loadRead  atomic.Int64
+	loadTotal atomic.Int64
+
+	// Called for every key removed because it expired, see SetExpireHook
+	onExpire func()
+
+	// Memory limit and what to do when it's exceeded, see SetMaxMemory
+	maxMemory      int
+	evictionPolicy EvictionPolicy
+
+	// Per-key revisions for SetIfRevision. revision is the last one handed
+	// out, so revisions never repeat even across deletes.
+	revision  int64
+	revisions map[string]int64
+
+	// Size limits, see SetMaxSizes
+	maxKeyBytes   int
+	maxValueBytes int
 }
 
 func New() *KVStore {
 	return &KVStore{
 		data:        make(map[string]string),
+		collections: make(map[string]collection),
 		expirations: make(map[string]time.Time),
+		accessed:    make(map[string]*access),
+		waiters:     make(map[string][]chan struct{}),
+		revisions:   make(map[string]int64),
 	}
 }
 
-func (s *KVStore) Set(key, value string) {
+func (s *KVStore) Set(key, value string) error {
+	key = s.foldKey(key)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.data[key] = value
+	if err := s.checkEntry(key, value); err != nil {
+		return err
+	}
+	s.set(key, value)
+	return nil
+}
 
-	_, exists := s.expirations[key]
-	if exists {
-		delete(s.expirations, key)
+// SetKeepTTL stores value under key like Set, except that a key that
+// already has an expiration keeps it. A new key gets no expiration.
+func (s *KVStore) SetKeepTTL(key, value string) error {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkEntry(key, value); err != nil {
+		return err
+	}
+
+	if s.expired(key) {
+		s.removeExpired(key)
+	}
+	expiration, hasExpiration := s.expirations[key]
+	s.set(key, value)
+	if hasExpiration {
+		s.expirations[key] = expiration
+	}
+	return nil
+}
+
+// MSet sets every key in pairs under a single lock, so other clients see
+// either none or all of them, and returns the number of keys set. If any
+// pair is over the size limits none are set.
+func (s *KVStore) MSet(pairs map[string]string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, value := range pairs {
+		if err := s.checkEntry(s.foldKey(key), value); err != nil {
+			return 0, err
+		}
+	}
+	for key, value := range pairs {
+		s.set(s.foldKey(key), value)
+	}
+	return len(pairs), nil
+}
+
+// MGet looks up every key under a single read lock. The value at each index
+// is only meaningful if the matching found flag is set; keys that don't
+// exist, have expired or don't hold strings aren't found. Expired keys are
+// removed afterwards, like Get does.
+func (s *KVStore) MGet(keys ...string) ([]string, []bool) {
+	values := make([]string, len(keys))
+	found := make([]bool, len(keys))
+	var expired []string
+
+	s.mutex.RLock()
+	now := time.Now()
+	for i, key := range keys {
+		key = s.foldKey(key)
+		if s.expired(key) {
+			expired = append(expired, key)
+			continue
+		}
+		values[i], found[i] = s.data[key]
+		if found[i] {
+			s.touchShared(key, now)
+		}
+	}
+	s.mutex.RUnlock()
+
+	if len(expired) > 0 {
+		s.mutex.Lock()
+		s.removeIfExpired(expired...)
+		s.mutex.Unlock()
 	}
+	return values, found
 }
 
+// Get returns the string at key. It only holds the read lock unless the key
+// has expired, then it takes the write lock to remove it.
 func (s *KVStore) Get(key string) (string, error) {
+	key = s.foldKey(key)
 	s.mutex.RLock()
-	value, exists := s.data[key]
+	if !s.expired(key) {
+		defer s.mutex.RUnlock()
+		return s.peek(key)
+	}
 	s.mutex.RUnlock()
 
-	if !exists {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(key)
+}
+
+// peek is get for callers holding only the read lock. It leaves expired
+// keys in place.
+func (s *KVStore) peek(key string) (string, error) {
+	if s.typeOf(key) == TypeNone || s.expired(key) {
 		return "", errors.New(KeyNotFound)
 	}
+	value, exists := s.data[key]
+	if !exists {
+		return "", errors.New(WrongType)
+	}
+	s.touchShared(key, time.Now())
+	return value, nil
+}
 
-	if s.expired(key) {
+// WaitFor returns the string at key, waiting for the key to be set if it
+// doesn't exist yet. It returns ctx's error if ctx is done first.
+func (s *KVStore) WaitFor(ctx context.Context, key string) (string, error) {
+	key = s.foldKey(key)
+	for {
 		s.mutex.Lock()
-		delete(s.data, key)
-		delete(s.expirations, key)
+		value, err := s.get(key)
+		if err == nil || err.Error() != KeyNotFound {
+			s.mutex.Unlock()
+			return value, err
+		}
+		ch := make(chan struct{})
+		s.waiters[key] = append(s.waiters[key], ch)
 		s.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			s.mutex.Lock()
+			s.removeWaiter(key, ch)
+			s.mutex.Unlock()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// get is Get for callers that already hold the write lock
+func (s *KVStore) get(key string) (string, error) {
+	if s.typeOf(key) == TypeNone {
+		return "", errors.New(KeyNotFound)
+	}
+
+	if s.expired(key) {
+		s.removeExpired(key)
 		return "", errors.New(KeyNotFound)
 	}
+
+	value, exists := s.data[key]
+	if !exists {
+		return "", errors.New(WrongType)
+	}
+
+	s.touch(key, time.Now())
 	return value, nil
 }
 
+// Contains reports whether key exists. Expired keys that haven't been
+// removed yet don't count.
 func (s *KVStore) Contains(key string) bool {
+	key = s.foldKey(key)
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	_, exists := s.data[key]
-	return exists
+	return s.typeOf(key) != TypeNone && !s.expired(key)
+}
+
+func (s *KVStore) SetEx(key string, value string, ttl int) error {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.setExpiring(key, value, time.Now().Add(s.jitteredTTL(ttl)))
 }
 
-func (s *KVStore) SetEx(key string, value string, ttl int) {
+// SetExAt is SetEx with the expiration given as a point in time, which
+// isn't jittered
+func (s *KVStore) SetExAt(key string, value string, at time.Time) error {
+	key = s.foldKey(key)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	return s.setExpiring(key, value, at)
+}
+
+// setExpiring stores value under key to expire at at. Callers must hold the
+// write lock.
+func (s *KVStore) setExpiring(key string, value string, at time.Time) error {
+	if err := s.checkEntry(key, value); err != nil {
+		return err
+	}
+	delete(s.collections, key)
 	s.data[key] = value
-	s.expirations[key] = time.Now().Add(time.Duration(ttl) * time.Second)
+	s.expirations[key] = at
+	s.touch(key, time.Now())
+	s.indexKey(key)
+	s.bump(key)
+	s.wake(key)
+	return nil
 }
 
-func (s *KVStore) TTL(key string) int {
+// Append adds value to the end of the string at key, creating it if needed,
+// and returns the new length. The key keeps its TTL. The appended result has
+// to stay within the value size limit.
+func (s *KVStore) Append(key string, value string) (int, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.expired(key) {
+		s.removeExpired(key)
+	}
+	switch s.typeOf(key) {
+	case TypeNone:
+		if err := s.checkEntry(key, value); err != nil {
+			return 0, err
+		}
+		s.set(key, value)
+		return len(value), nil
+	case TypeString:
+	default:
+		return 0, errors.New(WrongType)
+	}
+
+	// Checked before building the result so an oversized append doesn't
+	// allocate it
+	if s.maxValueBytes > 0 && len(s.data[key])+len(value) > s.maxValueBytes {
+		return 0, errors.New(ValueTooLarge)
+	}
+	s.data[key] += value
+	s.touch(key, time.Now())
+	s.bump(key)
+	s.wake(key)
+	return len(s.data[key]), nil
+}
+
+// Type returns the type of the value stored at key, TypeNone if it doesn't
+// exist or has expired. An expired key is removed, which takes the write
+// lock.
+func (s *KVStore) Type(key string) ValueType {
+	key = s.foldKey(key)
 	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	if !s.expired(key) {
+		defer s.mutex.RUnlock()
+		return s.typeOf(key)
+	}
+	s.mutex.RUnlock()
 
-	_, exists := s.data[key]
-	if !exists {
-		return -2
+	// Remove the expired key, like TTL does
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.expired(key) {
+		s.removeExpired(key)
 	}
+	return s.typeOf(key)
+}
 
-	ttl, exists := s.expirations[key]
-	if !exists {
-		return -1
+// Expire sets a TTL on an existing key of any type without touching its
+// value. It returns 1 if the TTL was set and 0 if the key doesn't exist.
+func (s *KVStore) Expire(key string, ttl int) int {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.expireAt(key, time.Now().Add(s.jitteredTTL(ttl)))
+}
+
+// ExpireAt is Expire with the expiration given as a point in time, which
+// isn't jittered. A time in the past makes the key expire right away.
+func (s *KVStore) ExpireAt(key string, at time.Time) int {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.expireAt(key, at)
+}
+
+func (s *KVStore) expireAt(key string, at time.Time) int {
+	if s.typeOf(key) == TypeNone {
+		return 0
+	}
+	if s.expired(key) {
+		s.removeExpired(key)
+		return 0
+	}
+
+	s.expirations[key] = at
+	s.bump(key)
+	return 1
+}
+
+// Expiration returns when key expires. It reports false if the key doesn't
+// exist, has expired or has no TTL.
+func (s *KVStore) Expiration(key string) (time.Time, bool) {
+	key = s.foldKey(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	expiration, exists := s.expirations[key]
+	if !exists || s.expired(key) {
+		return time.Time{}, false
 	}
+	return expiration, true
+}
+
+// SetTTLJitter makes SetEx randomize each expiration within ±percent% of the
+// requested TTL, so keys written together don't all expire at once. Random
+// offsets are drawn from rng, which tests can seed for determinism. A
+// percent of 0 disables jitter.
+func (s *KVStore) SetTTLJitter(percent int, rng *rand.Rand) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.jitterPercent = percent
+	s.jitterRand = rng
+}
 
-	secondsRemaining := int(time.Until(ttl).Seconds())
-	if secondsRemaining < 0 {
+// TTL returns the seconds remaining before key expires, -1 if it has no
+// expiration and -2 if it doesn't exist. With TTL jitter enabled this is the
+// actual jittered time remaining, not the TTL originally requested. A key
+// found to have expired is removed, like Get does, which takes the write
+// lock.
+func (s *KVStore) TTL(key string) int {
+	key = s.foldKey(key)
+	s.mutex.RLock()
+	if s.typeOf(key) == TypeNone {
+		s.mutex.RUnlock()
 		return -2
 	}
+	if s.expired(key) {
+		s.mutex.RUnlock()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		// Check again, the key may have been set while no lock was held
+		if s.expired(key) {
+			s.removeExpired(key)
+		}
+		return s.ttl(key)
+	}
+	defer s.mutex.RUnlock()
+	return s.ttl(key)
+}
 
-	return secondsRemaining
+// ttl computes TTL for a key that hasn't expired. Callers must hold the
+// mutex.
+func (s *KVStore) ttl(key string) int {
+	if s.typeOf(key) == TypeNone {
+		return -2
+	}
+	expiration, exists := s.expirations[key]
+	if !exists {
+		return -1
+	}
+	return int(time.Until(expiration).Seconds())
 }
 
+// Persist removes key's expiration and returns 1, or 0 if the key doesn't
+// exist or has no expiration. A key that has already expired is removed
+// rather than kept.
 func (s *KVStore) Persist(key string) int {
+	key = s.foldKey(key)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	_, keyExists := s.data[key]
-	if !keyExists {
+	if s.expired(key) {
+		s.removeExpired(key)
+	}
+	if s.typeOf(key) == TypeNone {
 		return 0
 	}
 
@@ -108,63 +553,60 @@ func (s *KVStore) Persist(key string) int {
 	}
 
 	delete(s.expirations, key)
+	s.bump(key)
 	return 1
 }
 
-func (s *KVStore) Rename(oldKey string, newKey string) int {
+// Rename moves oldKey to newKey, overwriting anything already at newKey. The
+// destination takes the source's TTL, or has none if the source had none.
+func (s *KVStore) Rename(oldKey string, newKey string) (int, error) {
+	oldKey = s.foldKey(oldKey)
+	newKey = s.foldKey(newKey)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	value, exists := s.data[oldKey]
-	if !exists {
-		return 0
+	s.removeIfExpired(oldKey, newKey)
+	if s.typeOf(oldKey) == TypeNone {
+		return 0, nil
 	}
-
-	delete(s.data, oldKey)
-	s.data[newKey] = value
-
-	expiration, hasExpiration := s.expirations[oldKey]
-	if hasExpiration {
-		delete(s.expirations, oldKey)
-		s.expirations[newKey] = expiration
+	if err := s.checkKey(newKey); err != nil {
+		return 0, err
 	}
-	return 1
+
+	s.moveValue(oldKey, newKey)
+	return 1, nil
 }
 
-func (s *KVStore) RenameNX(oldKey string, newKey string) int {
+func (s *KVStore) RenameNX(oldKey string, newKey string) (int, error) {
+	oldKey = s.foldKey(oldKey)
+	newKey = s.foldKey(newKey)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	value, exists := s.data[oldKey]
-	if !exists {
-		return 0
+	s.removeIfExpired(oldKey, newKey)
+	if s.typeOf(oldKey) == TypeNone {
+		return 0, nil
 	}
 
-	_, newKeyExists := s.data[newKey]
-	if newKeyExists {
-		return 0
+	if s.typeOf(newKey) != TypeNone {
+		return 0, nil
 	}
-
-	delete(s.data, oldKey)
-	s.data[newKey] = value
-
-	expiration, hasExpiration := s.expirations[oldKey]
-	if hasExpiration {
-		delete(s.expirations, oldKey)
-		s.expirations[newKey] = expiration
+	if err := s.checkKey(newKey); err != nil {
+		return 0, err
 	}
-	return 1
+
+	s.moveValue(oldKey, newKey)
+	return 1, nil
 }
 
 func (s *KVStore) Delete(key string) error {
+	key = s.foldKey(key)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	_, exists := s.data[key]
-	if !exists {
+	if s.typeOf(key) == TypeNone {
 		return errors.New(KeyNotFound)
 	}
-	delete(s.data, key)
-	delete(s.expirations, key)
+	s.remove(key)
 	return nil
 }
 
@@ -172,123 +614,1214 @@ func (s *KVStore) Flush() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.data = make(map[string]string)
+	s.collections = make(map[string]collection)
+	s.expirations = make(map[string]time.Time)
+	s.accessed = make(map[string]*access)
+	s.resetIndex()
+	s.resetFrequencies()
+	s.resetRevisions()
+}
+
+// FlushAsync swaps in empty maps and releases the old ones in a background
+// goroutine, so clearing a large store doesn't hold the lock
+func (s *KVStore) FlushAsync() {
+	s.mutex.Lock()
+	oldData, oldCollections := s.data, s.collections
+	oldExpirations, oldAccessed := s.expirations, s.accessed
+	s.data = make(map[string]string)
+	s.collections = make(map[string]collection)
 	s.expirations = make(map[string]time.Time)
+	s.accessed = make(map[string]*access)
+	s.resetIndex()
+	s.resetFrequencies()
+	s.resetRevisions()
+	s.mutex.Unlock()
+
+	go func() {
+		clear(oldData)
+		clear(oldCollections)
+		clear(oldExpirations)
+		clear(oldAccessed)
+	}()
 }
 
+// Keys lists every live key. It only takes the read lock: expired keys are
+// skipped but left in place for the scheduled cleanup to reap.
 func (s *KVStore) Keys() []string {
-	s.cleanUp()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]string, 0, s.keyCount())
+	s.forEachKey(func(key string) {
+		if !s.expired(key) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// ForEachKeyBatch calls fn with successive batches of live keys, stopping at
+// the first error fn returns. The key set is captured up front and each batch
+// is re-checked under a brief read lock, so writers are only ever blocked for
+// one batch at a time. Keys added after the call starts are not visited.
+func (s *KVStore) ForEachKeyBatch(batchSize int, fn func(keys []string) error) error {
+	s.mutex.RLock()
+	all := make([]string, 0, s.keyCount())
+	s.forEachKey(func(key string) {
+		all = append(all, key)
+	})
+	s.mutex.RUnlock()
+
+	for start := 0; start < len(all); start += batchSize {
+		end := min(start+batchSize, len(all))
+
+		s.mutex.RLock()
+		batch := all[start:start]
+		for _, key := range all[start:end] {
+			if s.typeOf(key) != TypeNone && !s.expired(key) {
+				batch = append(batch, key)
+			}
+		}
+		s.mutex.RUnlock()
+
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// ExpiringCount returns the number of keys with an expiration without
+// listing them. It includes keys that have expired but haven't been removed
+// yet.
+func (s *KVStore) ExpiringCount() int {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
+	return len(s.expirations)
+}
 
-	keys := make([]string, 0, len(s.data))
-	for key := range s.data {
-		keys = append(keys, key)
+// NextExpiry returns how long until the next live key expires, or false if
+// no key has an expiration. It scans every expiration, so it's meant for
+// occasional reporting rather than hot paths.
+func (s *KVStore) NextExpiry() (time.Duration, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	var next time.Time
+	for _, expiration := range s.expirations {
+		if expiration.After(now) && (next.IsZero() || expiration.Before(next)) {
+			next = expiration
+		}
 	}
-	return keys
+	if next.IsZero() {
+		return 0, false
+	}
+	return next.Sub(now), true
 }
 
+// KeysWithTTL lists live keys that have an expiration. Like Keys it is
+// read-only and skips expired keys without deleting them.
 func (s *KVStore) KeysWithTTL() []string {
-	s.cleanUp()
-
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	keys := make([]string, 0, len(s.expirations))
 	for key := range s.expirations {
-		keys = append(keys, key)
+		if !s.expired(key) {
+			keys = append(keys, key)
+		}
 	}
 	return keys
 }
 
+// KeysNoTTL lists keys without an expiration. Such keys never expire, so no
+// filtering is needed.
 func (s *KVStore) KeysNoTTL() []string {
-	s.cleanUp()
-
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	var keys []string
-	for key := range s.data {
+	s.forEachKey(func(key string) {
 		_, hasExpiration := s.expirations[key]
 		if !hasExpiration {
 			keys = append(keys, key)
 		}
-	}
+	})
 	return keys
 }
 
-// Persistence Methods
-
-func (s *KVStore) SaveToDisk(fileName string) error {
+// EnableCaseInsensitiveKeys lower-cases every key passed to the store, so
+// "Foo" and "foo" name the same entry. Keys already in the store, and in any
+// snapshot loaded later, are lower-cased too; if two of them differ only in
+// case, one of them is kept arbitrarily. It must be called before the store
+// is shared between goroutines.
+func (s *KVStore) EnableCaseInsensitiveKeys() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Create file
-	file, err := os.Create(fileName)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	s.foldKeys = true
+	s.foldExistingKeys()
+}
 
-	// Encode data
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(struct {
-		Data        map[string]string
-		Expirations map[string]time.Time
-	}{
-		Data:        s.data,
-		Expirations: s.expirations,
-	})
+// FoldKey returns key the way the store files it, lower-cased once
+// EnableCaseInsensitiveKeys has been called
+func (s *KVStore) FoldKey(key string) string {
+	return s.foldKey(key)
 }
 
-func (s *KVStore) LoadFromDisk(fileName string) error {
+// Prefix queries
+
+// EnablePrefixIndex builds a trie of all keys and keeps it up to date on
+// every write so KeysWithPrefix doesn't have to scan the whole keyspace. The
+// index costs extra memory per key and slows down writes slightly, so it's
+// only worth enabling for large stores queried by prefix.
+func (s *KVStore) EnablePrefixIndex() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Open file
-	file, err := os.Open(fileName)
+	s.index = newPrefixIndex()
+	s.resetIndex()
+}
+
+// KeysWithPrefix lists every live key starting with prefix
+func (s *KVStore) KeysWithPrefix(prefix string) []string {
+	prefix = s.foldKey(prefix)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var candidates []string
+	if s.index != nil {
+		candidates = s.index.withPrefix(prefix)
+	} else {
+		s.forEachKey(func(key string) {
+			if strings.HasPrefix(key, prefix) {
+				candidates = append(candidates, key)
+			}
+		})
+	}
+
+	keys := candidates[:0]
+	for _, key := range candidates {
+		if !s.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Scan walks the count keys that sort right after the key after ("" to
+// start) and returns the live ones, along with the key to pass next time,
+// "" once iteration is complete. Resuming from a key rather than a position
+// means keys added or removed between calls don't make Scan skip or repeat
+// the others. Passing a valueType other than TypeNone only returns keys of
+// that type, but still walks past keys that were filtered out.
+func (s *KVStore) Scan(after string, count int, valueType ValueType) ([]string, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// Keep only the count smallest keys past after instead of sorting all
+	// of them
+	var page []string
+	more := false
+	s.forEachKey(func(key string) {
+		if key <= after {
+			return
+		}
+		if len(page) == count {
+			more = true
+			if key > page[count-1] {
+				return
+			}
+			page = page[:count-1]
+		}
+		i, _ := slices.BinarySearch(page, key)
+		page = slices.Insert(page, i, key)
+	})
+
+	var keys []string
+	for _, key := range page {
+		if s.expired(key) {
+			continue
+		}
+		if valueType != TypeNone && s.typeOf(key) != valueType {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if !more {
+		return keys, ""
+	}
+	return keys, page[len(page)-1]
+}
+
+// cursorPage returns the count items of a stably ordered slice starting at
+// cursor, along with the cursor for the next page, 0 once iteration is done
+func cursorPage[T any](items []T, cursor int, count int) ([]T, int) {
+	if cursor < 0 || cursor >= len(items) {
+		return nil, 0
+	}
+
+	end := min(cursor+count, len(items))
+	if end == len(items) {
+		return items[cursor:end], 0
+	}
+	return items[cursor:end], end
+}
+
+// Persistence Methods
+
+// SaveToDisk writes a snapshot of the store to fileName, gzip-compressed
+// when fileName ends in CompressedExtension. The store is only locked while
+// it's copied, encoding and writing the copy don't block other clients. The
+// snapshot is written to a temporary file that then replaces fileName, so a
+// failed or concurrent save never leaves a partial file.
+func (s *KVStore) SaveToDisk(fileName string) error {
+	s.mutex.RLock()
+	snapshot, err := s.copySnapshot()
+	s.mutex.RUnlock()
 	if err != nil {
 		return err
 	}
+
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
 	defer file.Close()
+	// CreateTemp makes the file private, keep the mode os.Create would give
+	if err := file.Chmod(0o644); err != nil {
+		return err
+	}
+
+	var writer io.Writer = file
+	var gzipWriter *gzip.Writer
+	if strings.HasSuffix(fileName, CompressedExtension) {
+		gzipWriter = gzip.NewWriter(file)
+		writer = gzipWriter
+	}
+	if err := snapshot.encode(writer); err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), fileName)
+}
+
+// LoadFromDisk replaces the contents of the store with the snapshot at
+// fileName. The snapshot is decoded one record at a time without locking
+// the store, which keeps serving the old contents until the new ones are
+// swapped in at the end. LoadProgress reports how far it has got.
+func (s *KVStore) LoadFromDisk(fileName string) error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil {
+		s.loadRead.Store(0)
+		s.loadTotal.Store(max(info.Size(), 1))
+		defer s.loadTotal.Store(0)
+	}
+	reader, err := snapshotReader(&countingReader{r: file, n: &s.loadRead})
+	if err != nil {
+		return err
+	}
+	snapshot, err := decodeSnapshot(reader)
+	if err != nil {
+		return err
+	}
+	s.replaceWith(snapshot)
+	return nil
+}
+
+// LoadProgress reports how many bytes of the snapshot file LoadFromDisk has
+// read so far and the file's size. loading is false if no load is running.
+func (s *KVStore) LoadProgress() (read int64, total int64, loading bool) {
+	total = s.loadTotal.Load()
+	return min(s.loadRead.Load(), total), total, total > 0
+}
+
+// countingReader adds the number of bytes read through it to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
 
-	// Decode data
-	var stored struct {
-		Data        map[string]string
-		Expirations map[string]time.Time
+func (c *countingReader) Read(p []byte) (int, error) {
+	read, err := c.r.Read(p)
+	c.n.Add(int64(read))
+	return read, err
+}
+
+// MergeFromDisk adds the keys in the snapshot at fileName to the store
+// instead of replacing its contents, and returns how many keys it set. Keys
+// that exist in both keep their in-memory value and TTL, unless replace is
+// set, in which case the snapshot's value and TTL win. Keys that have
+// already expired in the snapshot are skipped.
+func (s *KVStore) MergeFromDisk(fileName string, replace bool) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := snapshotReader(file)
+	if err != nil {
+		return 0, err
 	}
-	err = json.NewDecoder(file).Decode(&stored)
+	snapshot, err := decodeSnapshot(reader)
 	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	merged := 0
+	merge := func(key string, store func(stored string)) {
+		expiration, hasExpiration := snapshot.expirations[key]
+		if hasExpiration && now.After(expiration) {
+			return
+		}
+
+		stored := s.foldKey(key)
+		if !replace && s.typeOf(stored) != TypeNone && !s.expired(stored) {
+			return
+		}
+
+		s.remove(stored)
+		store(stored)
+		if hasExpiration {
+			s.expirations[stored] = expiration
+		}
+		merged++
+	}
+	for key, value := range snapshot.data {
+		merge(key, func(stored string) { s.set(stored, value) })
+	}
+	for key, c := range snapshot.collections {
+		merge(key, func(stored string) { s.storeCollection(stored, c) })
+	}
+	return merged, nil
+}
+
+// WriteSnapshot writes the same JSON snapshot as SaveToDisk to w, on a
+// single line. Like SaveToDisk, it only locks the store while copying it.
+func (s *KVStore) WriteSnapshot(w io.Writer) error {
+	s.mutex.RLock()
+	snapshot, err := s.copySnapshot()
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return snapshot.encode(w)
+}
+
+// ReadSnapshot replaces the contents of the store with a snapshot written by
+// WriteSnapshot
+func (s *KVStore) ReadSnapshot(r io.Reader) error {
+	snapshot, err := decodeSnapshot(r)
+	if err != nil {
+		return err
+	}
+	s.replaceWith(snapshot)
+	return nil
+}
+
+// snapshotEntry is one key copied out of the store for saving. Strings
+// can't change, so they're copied as they are and encoded later.
+type snapshotEntry struct {
+	record   snapshotRecord
+	value    string
+	isString bool
+}
+
+// snapshotCopy is the keyspace copied out of the store for saving
+type snapshotCopy []snapshotEntry
+
+// copySnapshot copies the keyspace for encode. Collections can change once
+// the lock is released, so they're encoded right away. Callers must hold the
+// mutex, at least for reading.
+func (s *KVStore) copySnapshot() (snapshotCopy, error) {
+	snapshot := make(snapshotCopy, 0, s.keyCount())
+	for key, value := range s.data {
+		entry := snapshotEntry{record: snapshotRecord{Key: key}, value: value, isString: true}
+		if expiration, exists := s.expirations[key]; exists {
+			entry.record.ExpireAtMs = expiration.UnixMilli()
+		}
+		snapshot = append(snapshot, entry)
+	}
+	for key, c := range s.collections {
+		raw, err := c.marshalValue()
+		if err != nil {
+			return nil, fmt.Errorf("encoding key %q: %w", key, err)
+		}
+		entry := snapshotEntry{record: snapshotRecord{Key: key, Type: c.valueType().String(), Value: raw}}
+		if expiration, exists := s.expirations[key]; exists {
+			entry.record.ExpireAtMs = expiration.UnixMilli()
+		}
+		snapshot = append(snapshot, entry)
+	}
+	return snapshot, nil
+}
+
+// encode writes the copied keyspace as a JSON snapshot
+func (c snapshotCopy) encode(w io.Writer) error {
+	// Records are written in key order, so saving the same data twice
+	// produces byte-identical snapshots
+	slices.SortFunc(c, func(a, b snapshotEntry) int {
+		return strings.Compare(a.record.Key, b.record.Key)
+	})
+
+	records := make([]snapshotRecord, len(c))
+	for i, entry := range c {
+		records[i] = entry.record
+		if !entry.isString {
+			continue
+		}
+		records[i].Type = TypeString.String()
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return fmt.Errorf("encoding key %q: %w", entry.record.Key, err)
+		}
+		records[i].Value = value
+	}
+
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(struct {
+		Version int
+		Records []snapshotRecord
+	}{
+		Version: snapshotVersion,
+		Records: records,
+	})
+}
+
+// replaceWith replaces the contents of the store with a decoded snapshot.
+// The work that's proportional to the number of keys is done before taking
+// the write lock, unless the LFU policy or the prefix index need rebuilding.
+func (s *KVStore) replaceWith(snapshot *decodedSnapshot) {
+	snapshot.prepare(time.Now())
+	snapshot.revisions = s.reserveRevisions(snapshot)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.installSnapshot(snapshot)
+}
+
+// prepare drops expired keys and sets access times, so as little as
+// possible is left to do under the store's lock
+func (d *decodedSnapshot) prepare(now time.Time) {
+	// An old snapshot may hold keys that expired since it was written, drop
+	// them now instead of serving them until the next cleanup
+	for key, expiration := range d.expirations {
+		_, isString := d.data[key]
+		_, isCollection := d.collections[key]
+		if (!isString && !isCollection) || now.After(expiration) {
+			delete(d.data, key)
+			delete(d.collections, key)
+			delete(d.expirations, key)
+		}
+	}
+
+	d.accessed = make(map[string]*access, len(d.data)+len(d.collections))
+	for key := range d.data {
+		d.accessed[key] = newAccess(now)
+	}
+	for key := range d.collections {
+		d.accessed[key] = newAccess(now)
+	}
+}
+
+// installSnapshot replaces the contents of the store with a snapshot
+// readied by replaceWith. Callers must hold the mutex.
+func (s *KVStore) installSnapshot(snapshot *decodedSnapshot) {
+	s.data = snapshot.data
+	s.collections = snapshot.collections
+	s.expirations = snapshot.expirations
+	s.accessed = snapshot.accessed
+	s.revisions = snapshot.revisions
+	if s.foldKeys {
+		s.foldExistingKeys()
+	}
+	s.resetIndex()
+	s.resetFrequencies()
+	s.wakeAll()
+}
+
+// ExportCSV writes every live string key as a key,value,ttl_seconds row,
+// leaving ttl_seconds blank for keys without an expiration. Collection types
+// have no flat representation and are left out.
+func (s *KVStore) ExportCSV(w io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for key, value := range s.data {
+		if s.expired(key) {
+			continue
+		}
+
+		ttl := ""
+		if expiration, exists := s.expirations[key]; exists {
+			// Round up so a key about to expire isn't exported with a zero TTL
+			ttl = strconv.Itoa(int(math.Ceil(time.Until(expiration).Seconds())))
+		}
+
+		if err := writer.Write([]string{key, value, ttl}); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// ImportCSV reads key,value,ttl_seconds rows into the store. Malformed rows
+// and rows over the size limits are logged and skipped instead of aborting
+// the whole import.
+func (s *KVStore) ImportCSV(r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	type row struct {
+		key   string
+		value string
+		ttl   int
+	}
+	var rows []row
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				log.Printf("[WARN] Skipping malformed CSV row %d: %v\n", line, err)
+				continue
+			}
+			return 0, err
+		}
+
+		if line == 1 && slices.Equal(record, csvHeader) {
+			continue
+		}
+		if len(record) != len(csvHeader) {
+			log.Printf("[WARN] Skipping CSV row %d: expected %d fields, got %d\n", line, len(csvHeader), len(record))
+			continue
+		}
+
+		ttl := 0
+		if record[2] != "" {
+			ttl, err = strconv.Atoi(record[2])
+			if err != nil || ttl <= 0 {
+				log.Printf("[WARN] Skipping CSV row %d: invalid TTL '%s'\n", line, record[2])
+				continue
+			}
+		}
+		key := s.foldKey(record[0])
+		s.mutex.RLock()
+		err = s.checkEntry(key, record[1])
+		s.mutex.RUnlock()
+		if err != nil {
+			log.Printf("[WARN] Skipping CSV row %d: %v\n", line, err)
+			continue
+		}
+		rows = append(rows, row{key: key, value: record[1], ttl: ttl})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for _, r := range rows {
+		delete(s.collections, r.key)
+		s.data[r.key] = r.value
+		s.touch(r.key, now)
+		s.indexKey(r.key)
+		s.bump(r.key)
+		if r.ttl > 0 {
+			s.expirations[r.key] = now.Add(time.Duration(r.ttl) * time.Second)
+		} else {
+			delete(s.expirations, r.key)
+		}
+		s.wake(r.key)
+	}
+	return len(rows), nil
+}
+
+// decodeSnapshot reads a snapshot written by SaveToDisk, or by an older
+// version of it
+func decodeSnapshot(r io.Reader) (*decodedSnapshot, error) {
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if token != json.Delim('{') {
+		return nil, errors.New("snapshot is not a JSON object")
+	}
+
+	snapshot := &decodedSnapshot{
+		data:        make(map[string]string),
+		collections: make(map[string]collection),
+		expirations: make(map[string]time.Time),
+	}
+	// Version 1 and 2 fields are decoded once the version is known
+	version := 0
+	var expirations json.RawMessage
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		field, _ := token.(string)
+
+		// Field names match case-insensitively, like json.Unmarshal does
+		switch strings.ToLower(field) {
+		case "version":
+			if err := decoder.Decode(&version); err != nil {
+				return nil, err
+			}
+			if version > snapshotVersion {
+				return nil, fmt.Errorf("unsupported snapshot version %d", version)
+			}
+		case "records":
+			if err := snapshot.decodeRecords(decoder); err != nil {
+				return nil, err
+			}
+		case "data":
+			if err := decoder.Decode(&snapshot.data); err != nil {
+				return nil, err
+			}
+			if snapshot.data == nil {
+				snapshot.data = make(map[string]string)
+			}
+		case "expirations":
+			if err := decoder.Decode(&expirations); err != nil {
+				return nil, err
+			}
+		default:
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	if version < 3 {
+		var err error
+		snapshot.expirations, err = decodeExpirations(version, expirations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// decodeRecords reads the array of version 3 records one at a time, so a
+// large snapshot is never held in memory twice
+func (d *decodedSnapshot) decodeRecords(decoder *json.Decoder) error {
+	token, err := decoder.Token()
+	if err != nil || token == nil {
 		return err
 	}
+	if token != json.Delim('[') {
+		return errors.New("snapshot records are not a JSON array")
+	}
+	for decoder.More() {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if err := d.add(record); err != nil {
+			return fmt.Errorf("decoding key %q: %w", record.Key, err)
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+// add decodes record into the snapshot. Records of a type this version
+// doesn't know are skipped with a warning so the rest can still be loaded.
+func (d *decodedSnapshot) add(record snapshotRecord) error {
+	valueType, known := ParseValueType(record.Type)
+	switch {
+	case !known:
+		log.Printf("[WARN] Skipping key %q of unknown type %q in snapshot\n", record.Key, record.Type)
+		return nil
+	case valueType == TypeString:
+		var value string
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return err
+		}
+		d.data[record.Key] = value
+	default:
+		c, err := unmarshalCollection(valueType, record.Value)
+		if err != nil {
+			return err
+		}
+		d.collections[record.Key] = c
+	}
 
-	// Update in-memory storage
-	s.data = stored.Data
-	s.expirations = stored.Expirations
+	if record.ExpireAtMs != 0 {
+		d.expirations[record.Key] = time.UnixMilli(record.ExpireAtMs)
+	}
 	return nil
 }
 
+// unmarshalCollection decodes a value written by a collection's marshalValue
+func unmarshalCollection(valueType ValueType, raw json.RawMessage) (collection, error) {
+	switch valueType {
+	case TypeSortedSet:
+		return unmarshalSortedSet(raw)
+	case TypeStream:
+		return unmarshalStream(raw)
+	case TypeJSON:
+		return unmarshalJSONDoc(raw)
+	default:
+		return nil, fmt.Errorf("no snapshot encoding for type %s", valueType)
+	}
+}
+
+// decodeExpirations reads the expirations of a snapshot. Version 1
+// snapshots, which had no version field, stored them as RFC 3339 times;
+// later ones store Unix milliseconds.
+func decodeExpirations(version int, raw json.RawMessage) (map[string]time.Time, error) {
+	expirations := make(map[string]time.Time)
+	if len(raw) == 0 || string(raw) == "null" {
+		return expirations, nil
+	}
+
+	if version < 2 {
+		err := json.Unmarshal(raw, &expirations)
+		return expirations, err
+	}
+
+	var millis map[string]int64
+	if err := json.Unmarshal(raw, &millis); err != nil {
+		return nil, err
+	}
+	for key, ms := range millis {
+		expirations[key] = time.UnixMilli(ms)
+	}
+	return expirations, nil
+}
+
+// snapshotReader transparently decompresses gzip snapshots, detected by
+// their magic bytes rather than the file extension
+func snapshotReader(file io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(file)
+	magic, err := buffered.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// Object introspection
+
+// Encoding reports the internal representation of the value under key:
+// "int" for integer-valued strings, "embstr" for short strings and "raw"
+// for everything else
+func (s *KVStore) Encoding(key string) (string, error) {
+	key = s.foldKey(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.typeOf(key) == TypeNone || s.expired(key) {
+		return "", errors.New(KeyNotFound)
+	}
+	if c, exists := s.collections[key]; exists {
+		return c.encoding(), nil
+	}
+
+	value := s.data[key]
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return "int", nil
+	}
+	if len(value) <= embstrSizeLimit {
+		return "embstr", nil
+	}
+	return "raw", nil
+}
+
+// IdleTime returns the number of seconds since key was last read or written
+func (s *KVStore) IdleTime(key string) (int, error) {
+	key = s.foldKey(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.typeOf(key) == TypeNone || s.expired(key) {
+		return 0, errors.New(KeyNotFound)
+	}
+	a, exists := s.accessed[key]
+	if !exists {
+		return 0, nil
+	}
+	return int(time.Since(a.lastAccess()).Seconds()), nil
+}
+
+// Memory estimation
+
+// MemoryUsage returns an estimate of the bytes used by key and its value
+func (s *KVStore) MemoryUsage(key string) (int, error) {
+	key = s.foldKey(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.typeOf(key) == TypeNone || s.expired(key) {
+		return 0, errors.New(KeyNotFound)
+	}
+	return s.entrySize(key), nil
+}
+
+// TotalMemoryUsage returns an estimate of the bytes used by every key in the store
+func (s *KVStore) TotalMemoryUsage() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	total := 0
+	s.forEachKey(func(key string) {
+		total += s.entrySize(key)
+	})
+	return total
+}
+
 // Helpers
+
+// entrySize estimates the footprint of a single key. Callers must hold the mutex.
+func (s *KVStore) entrySize(key string) int {
+	size := entryOverhead + len(key) + len(s.data[key])
+	if c, exists := s.collections[key]; exists {
+		size += c.memoryUsage()
+	}
+	if _, exists := s.expirations[key]; exists {
+		size += timestampOverhead + len(key)
+	}
+	if _, exists := s.accessed[key]; exists {
+		size += timestampOverhead + len(key)
+	}
+	return size
+}
+
+// jitteredTTL converts ttl seconds into a duration, shifted by a random
+// offset when jitter is enabled. Callers must hold the mutex.
+func (s *KVStore) jitteredTTL(ttl int) time.Duration {
+	duration := time.Duration(ttl) * time.Second
+	if s.jitterPercent <= 0 || s.jitterRand == nil {
+		return duration
+	}
+
+	maxOffset := int64(duration) * int64(s.jitterPercent) / 100
+	if maxOffset == 0 {
+		return duration
+	}
+	offset := s.jitterRand.Int63n(2*maxOffset+1) - maxOffset
+	return duration + time.Duration(offset)
+}
+
+// typeOf reports the type of the value stored under key. Callers must hold
+// the mutex. Type-specific methods use it to reject keys of another kind
+// with WrongType.
+func (s *KVStore) typeOf(key string) ValueType {
+	if _, exists := s.data[key]; exists {
+		return TypeString
+	}
+	if c, exists := s.collections[key]; exists {
+		return c.valueType()
+	}
+	return TypeNone
+}
+
+// lookupCollection returns the collection under key if it holds valueType,
+// nil if the key doesn't exist (lazily expiring it if needed) and a
+// WrongType error if it holds anything else. Callers must hold the write lock.
+func (s *KVStore) lookupCollection(key string, valueType ValueType) (collection, error) {
+	actual := s.typeOf(key)
+	if actual == TypeNone {
+		return nil, nil
+	}
+	if s.expired(key) {
+		s.removeExpired(key)
+		return nil, nil
+	}
+	if actual != valueType {
+		return nil, errors.New(WrongType)
+	}
+	s.touch(key, time.Now())
+	return s.collections[key], nil
+}
+
+// storeCollection adds a new collection under key. Callers must hold the
+// mutex and have checked the key is free.
+func (s *KVStore) storeCollection(key string, c collection) {
+	s.collections[key] = c
+	s.touch(key, time.Now())
+	s.indexKey(key)
+	s.bump(key)
+}
+
+// set stores a string under key, replacing any value and TTL it had.
+// Callers must hold the write lock.
+func (s *KVStore) set(key, value string) {
+	delete(s.collections, key)
+	s.data[key] = value
+	s.touch(key, time.Now())
+	s.indexKey(key)
+
+	_, exists := s.expirations[key]
+	if exists {
+		delete(s.expirations, key)
+	}
+	s.bump(key)
+	s.wake(key)
+}
+
+// wake releases every WaitFor caller waiting on key, they check the key again
+// once they get the lock. Callers must hold the write lock.
+func (s *KVStore) wake(key string) {
+	for _, ch := range s.waiters[key] {
+		close(ch)
+	}
+	delete(s.waiters, key)
+}
+
+// wakeAll releases every WaitFor caller, for changes that replace many keys
+// at once. Callers must hold the write lock.
+func (s *KVStore) wakeAll() {
+	for key := range s.waiters {
+		s.wake(key)
+	}
+}
+
+// removeWaiter forgets ch, a WaitFor caller that gave up. Callers must hold
+// the write lock.
+func (s *KVStore) removeWaiter(key string, ch chan struct{}) {
+	waiters := slices.DeleteFunc(s.waiters[key], func(c chan struct{}) bool { return c == ch })
+	if len(waiters) == 0 {
+		delete(s.waiters, key)
+	} else {
+		s.waiters[key] = waiters
+	}
+}
+
+// foldKey returns the form key is stored under
+func (s *KVStore) foldKey(key string) string {
+	if s.foldKeys {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// foldExistingKeys re-keys every entry under its folded form. Callers must
+// hold the write lock.
+func (s *KVStore) foldExistingKeys() {
+	data := make(map[string]string, len(s.data))
+	for key, value := range s.data {
+		data[s.foldKey(key)] = value
+	}
+	collections := make(map[string]collection, len(s.collections))
+	for key, c := range s.collections {
+		if _, exists := data[s.foldKey(key)]; !exists {
+			collections[s.foldKey(key)] = c
+		}
+	}
+	expirations := make(map[string]time.Time, len(s.expirations))
+	for key, t := range s.expirations {
+		expirations[s.foldKey(key)] = t
+	}
+	accessed := make(map[string]*access, len(s.accessed))
+	for key, a := range s.accessed {
+		accessed[s.foldKey(key)] = a
+	}
+
+	s.data, s.collections = data, collections
+	s.expirations, s.accessed = expirations, accessed
+	s.resetIndex()
+	s.resetFrequencies()
+	s.resetRevisions()
+}
+
+// keyCount and forEachKey cover every key regardless of type. Callers must
+// hold the mutex.
+func (s *KVStore) keyCount() int {
+	return len(s.data) + len(s.collections)
+}
+
+func (s *KVStore) forEachKey(fn func(key string)) {
+	for key := range s.data {
+		fn(key)
+	}
+	for key := range s.collections {
+		fn(key)
+	}
+}
+
+// removeIfExpired removes whichever of keys have expired, so a rename
+// neither moves an expired source nor treats an expired destination as
+// taken. Callers must hold the mutex.
+func (s *KVStore) removeIfExpired(keys ...string) {
+	for _, key := range keys {
+		if s.expired(key) {
+			s.removeExpired(key)
+		}
+	}
+}
+
+// moveValue moves the value under oldKey, of whatever type, to newKey along
+// with its expiration and access time. Whatever was at newKey is replaced
+// entirely, so newKey ends up with oldKey's TTL or none, never its own old
+// one. Callers must hold the mutex.
+func (s *KVStore) moveValue(oldKey string, newKey string) {
+	if oldKey == newKey {
+		return
+	}
+
+	if value, exists := s.data[oldKey]; exists {
+		delete(s.data, oldKey)
+		delete(s.collections, newKey)
+		s.data[newKey] = value
+	} else {
+		c := s.collections[oldKey]
+		delete(s.collections, oldKey)
+		delete(s.data, newKey)
+		s.collections[newKey] = c
+	}
+	s.unindexKey(oldKey)
+	s.indexKey(newKey)
+
+	expiration, hasExpiration := s.expirations[oldKey]
+	delete(s.expirations, oldKey)
+	if hasExpiration {
+		s.expirations[newKey] = expiration
+	} else {
+		delete(s.expirations, newKey)
+	}
+
+	if a, exists := s.accessed[oldKey]; exists {
+		s.accessed[newKey] = a
+		delete(s.accessed, oldKey)
+	} else {
+		delete(s.accessed, newKey)
+	}
+	delete(s.revisions, oldKey)
+	s.bump(newKey)
+	s.wake(newKey)
+}
+
+// indexKey, unindexKey and resetIndex keep the prefix index in sync when it
+// is enabled. Callers must hold the mutex.
+func (s *KVStore) indexKey(key string) {
+	if s.index != nil {
+		s.index.insert(key)
+	}
+}
+
+func (s *KVStore) unindexKey(key string) {
+	if s.index != nil {
+		s.index.remove(key)
+	}
+}
+
+func (s *KVStore) resetIndex() {
+	if s.index == nil {
+		return
+	}
+	s.index = newPrefixIndex()
+	s.forEachKey(s.index.insert)
+}
+
+// remove deletes key and all of its bookkeeping. Callers must hold the mutex.
+func (s *KVStore) remove(key string) {
+	delete(s.data, key)
+	delete(s.collections, key)
+	delete(s.expirations, key)
+	delete(s.accessed, key)
+	delete(s.revisions, key)
+	s.unindexKey(key)
+}
+
 func (s *KVStore) expired(key string) bool {
 	exipration, exists := s.expirations[key]
 	return exists && time.Now().After(exipration)
 }
 
-func (s *KVStore) cleanUp() {
+// removeExpired removes key, which has expired, and reports it to the
+// expire hook. Callers must hold the mutex.
+func (s *KVStore) removeExpired(key string) {
+	s.remove(key)
+	if s.onExpire != nil {
+		s.onExpire()
+	}
+}
+
+// SetExpireHook sets a function called for every key removed because it
+// expired, whether on access or by the cleanup. It's called with the store
+// locked, so it must not call back into the store.
+func (s *KVStore) SetExpireHook(hook func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onExpire = hook
+}
+
+// cleanUp removes every expired key and returns how many it removed
+func (s *KVStore) cleanUp() int {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Remove expired keys
-	for key, _ := range s.data {
+	removed := 0
+	for key := range s.expirations {
 		if s.expired(key) {
-			delete(s.data, key)
-			delete(s.expirations, key)
+			s.removeExpired(key)
+			removed++
 		}
 	}
+	return removed
+}
+
+// ExpireScan runs a cleanup pass now, even while the scheduled cleanup is
+// paused, and returns how many expired keys it removed
+func (s *KVStore) ExpireScan() int {
+	return s.cleanUp()
+}
+
+// SetActiveExpire pauses or resumes the cleanup started by ScheduleCleanup.
+// While paused, expired keys are only removed when they're accessed, which
+// makes TTL behaviour deterministic in tests.
+func (s *KVStore) SetActiveExpire(enabled bool) {
+	s.activeExpireOff.Store(!enabled)
+}
+
+// SetCleanupInterval changes how often the scheduled cleanup runs. The new
+// interval takes effect after the next run.
+func (s *KVStore) SetCleanupInterval(interval time.Duration) {
+	s.cleanupInterval.Store(int64(interval))
 }
 
 func (s *KVStore) ScheduleCleanup(interval time.Duration, done <-chan struct{}) {
-	log.Printf("[INFO] Scheduled cleanup every %v seconds\n", interval)
+	log.Printf("[INFO] Scheduled cleanup every %v\n", interval)
+	s.cleanupInterval.Store(int64(interval))
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -296,8 +1829,18 @@ func (s *KVStore) ScheduleCleanup(interval time.Duration, done <-chan struct{})
 		for {
 			select {
 			case <-ticker.C:
+				if next := time.Duration(s.cleanupInterval.Load()); next != interval {
+					interval = next
+					ticker.Reset(interval)
+					log.Printf("[INFO] Scheduled cleanup now runs every %v\n", interval)
+				}
+				if s.activeExpireOff.Load() {
+					continue
+				}
 				log.Println("[INFO] Running scheduled cleanup...")
-				s.cleanUp()
+				if removed := s.cleanUp(); removed > 0 {
+					log.Printf("[INFO] Cleanup removed %d expired keys\n", removed)
+				}
 			case <-done:
 				log.Println("[INFO] Stopping scheduled cleanup...")
 				return
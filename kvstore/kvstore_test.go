@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+// expireNow makes key's TTL run out without waiting for it
+func expireNow(s *KVStore, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expirations[key] = time.Now().Add(-time.Second)
+}
+
+func TestMGet(t *testing.T) {
+	s := New()
+	s.Set("present", "value")
+	s.Set("nil", "(nil)")
+	s.SetEx("expired", "stale", 100)
+	expireNow(s, "expired")
+	if _, err := s.ZAdd("zset", []ScoredMember{{Member: "m", Score: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, found := s.MGet("present", "absent", "expired", "nil", "zset")
+	wantValues := []string{"value", "", "", "(nil)", ""}
+	wantFound := []bool{true, false, false, true, false}
+	for i := range wantValues {
+		if values[i] != wantValues[i] || found[i] != wantFound[i] {
+			t.Errorf("MGet[%d] = %q, %v, want %q, %v", i, values[i], found[i], wantValues[i], wantFound[i])
+		}
+	}
+
+	s.mutex.RLock()
+	_, stillThere := s.data["expired"]
+	s.mutex.RUnlock()
+	if stillThere {
+		t.Fatal("MGet left the expired key in place")
+	}
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(s *KVStore)
+		wantTTL bool
+	}{
+		{"missing key", func(s *KVStore) {}, false},
+		{"key without TTL", func(s *KVStore) { s.Set("k", "old") }, false},
+		{"key with TTL", func(s *KVStore) { s.SetEx("k", "old", 100) }, true},
+		{"key whose TTL ran out", func(s *KVStore) {
+			s.SetEx("k", "old", 100)
+			expireNow(s, "k")
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			test.setup(s)
+			s.mutex.RLock()
+			before := s.expirations["k"]
+			s.mutex.RUnlock()
+
+			if err := s.SetKeepTTL("k", "new"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := s.Get("k"); err != nil || value != "new" {
+				t.Fatalf("Get = %q, %v, want %q", value, err, "new")
+			}
+
+			s.mutex.RLock()
+			after, hasTTL := s.expirations["k"]
+			s.mutex.RUnlock()
+			if hasTTL != test.wantTTL {
+				t.Fatalf("key has a TTL: %v, want %v", hasTTL, test.wantTTL)
+			}
+			if test.wantTTL && !after.Equal(before) {
+				t.Fatalf("expiration moved from %v to %v", before, after)
+			}
+		})
+	}
+}
+
+func TestTTLRemovesExpiredKey(t *testing.T) {
+	s := New()
+	s.SetEx("k", "v", 100)
+	expireNow(s, "k")
+
+	if ttl := s.TTL("k"); ttl != -2 {
+		t.Fatalf("TTL = %d, want -2", ttl)
+	}
+	s.mutex.RLock()
+	_, stored := s.data["k"]
+	_, hasExpiration := s.expirations["k"]
+	s.mutex.RUnlock()
+	if stored || hasExpiration {
+		t.Fatal("TTL left the expired key in place")
+	}
+}
@@ -0,0 +1,39 @@
+package kvstore
+
+import "errors"
+
+const KeyTooLarge = "ERROR: key exceeds maximum size"
+const ValueTooLarge = "ERROR: value exceeds maximum size"
+
+// SetMaxSizes limits keys to maxKeyBytes and values to maxValueBytes. For
+// collections the value limit applies to each member, field or document
+// stored in them. A limit of 0 disables it.
+func (s *KVStore) SetMaxSizes(maxKeyBytes int, maxValueBytes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxKeyBytes = maxKeyBytes
+	s.maxValueBytes = maxValueBytes
+}
+
+// checkKey and checkValue enforce SetMaxSizes. Callers must hold the mutex.
+func (s *KVStore) checkKey(key string) error {
+	if s.maxKeyBytes > 0 && len(key) > s.maxKeyBytes {
+		return errors.New(KeyTooLarge)
+	}
+	return nil
+}
+
+func (s *KVStore) checkValue(value string) error {
+	if s.maxValueBytes > 0 && len(value) > s.maxValueBytes {
+		return errors.New(ValueTooLarge)
+	}
+	return nil
+}
+
+// checkEntry checks a key together with the value written to it
+func (s *KVStore) checkEntry(key string, value string) error {
+	if err := s.checkKey(key); err != nil {
+		return err
+	}
+	return s.checkValue(value)
+}
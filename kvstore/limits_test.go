@@ -0,0 +1,79 @@
+package kvstore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSizeLimitBoundaries(t *testing.T) {
+	tests := []struct {
+		name    string
+		write   func(s *KVStore) error
+		wantErr string
+	}{
+		{"key at limit", func(s *KVStore) error { return s.Set("kkkk", "v") }, ""},
+		{"key over limit", func(s *KVStore) error { return s.Set("kkkkk", "v") }, KeyTooLarge},
+		{"value at limit", func(s *KVStore) error { return s.Set("k", "vvvvvvvv") }, ""},
+		{"value over limit", func(s *KVStore) error { return s.Set("k", "vvvvvvvvv") }, ValueTooLarge},
+		{"SetEx value over limit", func(s *KVStore) error { return s.SetEx("k", "vvvvvvvvv", 10) }, ValueTooLarge},
+		{"SetKeepTTL value over limit", func(s *KVStore) error { return s.SetKeepTTL("k", "vvvvvvvvv") }, ValueTooLarge},
+		{"append up to limit", func(s *KVStore) error {
+			s.Set("k", "vvvv")
+			_, err := s.Append("k", "vvvv")
+			return err
+		}, ""},
+		{"append past limit", func(s *KVStore) error {
+			s.Set("k", "vvvv")
+			_, err := s.Append("k", "vvvvv")
+			return err
+		}, ValueTooLarge},
+		{"sorted set member over limit", func(s *KVStore) error {
+			_, err := s.ZAdd("z", []ScoredMember{{Member: "mmmmmmmmm", Score: 1}})
+			return err
+		}, ValueTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			s.SetMaxSizes(4, 8)
+			err := test.write(s)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+				t.Fatalf("error = %v, want %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAppendPastLimitKeepsValue(t *testing.T) {
+	s := New()
+	s.SetMaxSizes(0, 8)
+	s.Set("k", "vvvv")
+
+	if _, err := s.Append("k", "vvvvv"); err == nil {
+		t.Fatal("Append past the limit succeeded")
+	}
+	if value, _ := s.Get("k"); value != "vvvv" {
+		t.Fatalf("Get = %q, want the value from before the Append", value)
+	}
+}
+
+func TestImportCSVSkipsOversizedRows(t *testing.T) {
+	s := New()
+	s.SetMaxSizes(4, 8)
+
+	csv := "key,value,ttl_seconds\nok,vvvvvvvv,\nkkkkk,v,\nbig,vvvvvvvvv,\n"
+	count, err := s.ImportCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("imported %d rows, want 1", count)
+	}
+	if !s.Contains("ok") || s.Contains("kkkkk") || s.Contains("big") {
+		t.Fatalf("keys after import = %v, want only ok", s.Keys())
+	}
+}
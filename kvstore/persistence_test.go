@@ -0,0 +1,226 @@
+package kvstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fill adds n keys with short values to s
+func fill(s *KVStore, n int) {
+	for i := 0; i < n; i++ {
+		s.Set("key:"+strconv.Itoa(i), "value:"+strconv.Itoa(i))
+	}
+}
+
+func TestCompressedSnapshotRoundTrip(t *testing.T) {
+	s := New()
+	fill(s, 1000)
+	s.SetEx("session", "abc", 100)
+	if _, err := s.ZAdd("scores", []ScoredMember{{Member: "alice", Score: 2.5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "data.txt"+CompressedExtension)
+	if err := s.SaveToDisk(fileName); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) {
+		t.Fatal("snapshot isn't gzip-compressed")
+	}
+
+	// Compression is detected from the contents, not the extension
+	renamed := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.Rename(fileName, renamed); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if err := loaded.LoadFromDisk(renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if value, err := loaded.Get(key); err != nil || value != "value:"+strconv.Itoa(i) {
+			t.Fatalf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+	if value, _ := loaded.Get("session"); value != "abc" {
+		t.Fatalf("Get(session) = %q, want %q", value, "abc")
+	}
+	if ttl := loaded.TTL("session"); ttl <= 0 || ttl > 100 {
+		t.Fatalf("TTL(session) = %d, want 1..100", ttl)
+	}
+	if score, ok, err := loaded.ZScore("scores", "alice"); err != nil || !ok || score != 2.5 {
+		t.Fatalf("ZScore = %v, %v, %v, want 2.5", score, ok, err)
+	}
+}
+
+func TestLoadDropsExpiredKeys(t *testing.T) {
+	s := New()
+	s.SetEx("short", "gone", 1)
+	s.SetEx("long", "kept", 100)
+	s.Set("plain", "kept")
+	fileName := filepath.Join(t.TempDir(), "data.txt")
+	if err := s.SaveToDisk(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Second)
+	loaded := New()
+	if err := loaded.LoadFromDisk(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded.mutex.RLock()
+	_, stored := loaded.data["short"]
+	_, hasExpiration := loaded.expirations["short"]
+	loaded.mutex.RUnlock()
+	if stored || hasExpiration {
+		t.Fatal("LoadFromDisk kept a key that expired after the save")
+	}
+	if ttl := loaded.TTL("short"); ttl != -2 {
+		t.Fatalf("TTL(short) = %d, want -2", ttl)
+	}
+	for _, key := range []string{"long", "plain"} {
+		if value, err := loaded.Get(key); err != nil || value != "kept" {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, "kept")
+		}
+	}
+}
+
+func TestSnapshotsAreReproducible(t *testing.T) {
+	s := New()
+	fill(s, 1000)
+	for i := 0; i < 100; i++ {
+		s.SetEx("session:"+strconv.Itoa(i), "abc", 100)
+	}
+	if _, err := s.ZAdd("scores", []ScoredMember{{Member: "alice", Score: 1}, {Member: "bob", Score: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var saved [][]byte
+	for _, name := range []string{"first.txt", "second.txt"} {
+		fileName := filepath.Join(dir, name)
+		if err := s.SaveToDisk(fileName); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, contents)
+	}
+	if !bytes.Equal(saved[0], saved[1]) {
+		t.Fatal("two saves of the same data differ")
+	}
+
+	// A store loaded from the snapshot saves the same bytes again
+	loaded := New()
+	if err := loaded.LoadFromDisk(filepath.Join(dir, "first.txt")); err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "third.txt")
+	if err := loaded.SaveToDisk(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(fileName); err != nil || !bytes.Equal(contents, saved[0]) {
+		t.Fatalf("saving the loaded store gave a different snapshot (%v)", err)
+	}
+}
+
+func TestMergeFromDisk(t *testing.T) {
+	seed := New()
+	seed.Set("shared", "from file")
+	seed.SetEx("shared-ttl", "from file", 100)
+	seed.Set("file-only", "from file")
+	seed.SetEx("stale", "from file", 100)
+	expireNow(seed, "stale")
+	fileName := filepath.Join(t.TempDir(), "seed.txt")
+	if err := seed.SaveToDisk(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		replace    bool
+		wantMerged int
+		wantShared string
+		wantTTL    bool
+	}{
+		{"memory wins", false, 1, "from memory", false},
+		{"file wins", true, 3, "from file", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			s.Set("shared", "from memory")
+			s.Set("shared-ttl", "from memory")
+			s.Set("memory-only", "from memory")
+
+			merged, err := s.MergeFromDisk(fileName, test.replace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merged != test.wantMerged {
+				t.Fatalf("merged %d keys, want %d", merged, test.wantMerged)
+			}
+
+			for key, want := range map[string]string{
+				"shared":      test.wantShared,
+				"shared-ttl":  test.wantShared,
+				"file-only":   "from file",
+				"memory-only": "from memory",
+			} {
+				if value, err := s.Get(key); err != nil || value != want {
+					t.Errorf("Get(%s) = %q, %v, want %q", key, value, err, want)
+				}
+			}
+			if hasTTL := s.TTL("shared-ttl") > 0; hasTTL != test.wantTTL {
+				t.Errorf("shared-ttl has a TTL: %v, want %v", hasTTL, test.wantTTL)
+			}
+			if s.Contains("stale") {
+				t.Error("merged a key that had expired in the file")
+			}
+		})
+	}
+}
+
+// BenchmarkGetDuringSave measures GET while SaveToDisk writes a large
+// snapshot in the background, which only holds the lock while copying.
+func BenchmarkGetDuringSave(b *testing.B) {
+	s := New()
+	fill(s, 200000)
+	fileName := filepath.Join(b.TempDir(), "data.txt")
+
+	var saving atomic.Bool
+	saving.Store(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for saving.Load() {
+			if err := s.SaveToDisk(fileName); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Get("key:" + strconv.Itoa(i%200000))
+	}
+	b.StopTimer()
+	saving.Store(false)
+	<-done
+}
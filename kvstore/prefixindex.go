@@ -0,0 +1,80 @@
+package kvstore
+
+// prefixIndex is a byte-wise trie over the keyspace. Maintaining it costs a
+// node per distinct key byte and some extra work on every write, but lets
+// KeysWithPrefix visit only the matching subtree instead of every key.
+type prefixIndex struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	terminal bool
+}
+
+func newPrefixIndex() *prefixIndex {
+	return &prefixIndex{root: &trieNode{}}
+}
+
+func (idx *prefixIndex) insert(key string) {
+	node := idx.root
+	for i := 0; i < len(key); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*trieNode)
+		}
+		child, exists := node.children[key[i]]
+		if !exists {
+			child = &trieNode{}
+			node.children[key[i]] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+func (idx *prefixIndex) remove(key string) {
+	removeFrom(idx.root, key, 0)
+}
+
+// removeFrom unmarks key below node and reports whether node became empty
+// so the caller can prune it
+func removeFrom(node *trieNode, key string, depth int) bool {
+	if depth == len(key) {
+		node.terminal = false
+		return len(node.children) == 0
+	}
+
+	child, exists := node.children[key[depth]]
+	if !exists {
+		return false
+	}
+	if removeFrom(child, key, depth+1) {
+		delete(node.children, key[depth])
+	}
+	return !node.terminal && len(node.children) == 0
+}
+
+// withPrefix returns every indexed key starting with prefix
+func (idx *prefixIndex) withPrefix(prefix string) []string {
+	node := idx.root
+	for i := 0; i < len(prefix); i++ {
+		child, exists := node.children[prefix[i]]
+		if !exists {
+			return nil
+		}
+		node = child
+	}
+
+	var keys []string
+	collect(node, []byte(prefix), &keys)
+	return keys
+}
+
+func collect(node *trieNode, path []byte, keys *[]string) {
+	if node.terminal {
+		*keys = append(*keys, string(path))
+	}
+	for b, child := range node.children {
+		collect(child, append(path, b), keys)
+	}
+}
@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"testing"
+)
+
+func TestRenameOntoKeyWithTTL(t *testing.T) {
+	s := New()
+	s.Set("source", "new")
+	s.SetEx("destination", "old", 100)
+
+	if renamed, err := s.Rename("source", "destination"); err != nil || renamed != 1 {
+		t.Fatalf("Rename = %d, %v, want 1", renamed, err)
+	}
+	if value, err := s.Get("destination"); err != nil || value != "new" {
+		t.Fatalf("Get(destination) = %q, %v, want %q", value, err, "new")
+	}
+	if ttl := s.TTL("destination"); ttl != -1 {
+		t.Fatalf("TTL(destination) = %d, want -1: it kept its old TTL", ttl)
+	}
+	if s.Contains("source") {
+		t.Fatal("source still exists after Rename")
+	}
+}
+
+func TestRenameMovesTTL(t *testing.T) {
+	tests := []struct {
+		name           string
+		sourceTTL      bool
+		destinationTTL bool
+	}{
+		{"neither has a TTL", false, false},
+		{"only the source has a TTL", true, false},
+		{"only the destination has a TTL", false, true},
+		{"both have a TTL", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			if test.sourceTTL {
+				s.SetEx("source", "new", 100)
+			} else {
+				s.Set("source", "new")
+			}
+			if test.destinationTTL {
+				s.SetEx("destination", "old", 500)
+			} else {
+				s.Set("destination", "old")
+			}
+			s.mutex.RLock()
+			sourceExpiration := s.expirations["source"]
+			s.mutex.RUnlock()
+
+			if renamed, err := s.Rename("source", "destination"); err != nil || renamed != 1 {
+				t.Fatalf("Rename = %d, %v, want 1", renamed, err)
+			}
+
+			s.mutex.RLock()
+			expiration, hasTTL := s.expirations["destination"]
+			_, sourceLeft := s.expirations["source"]
+			s.mutex.RUnlock()
+			if hasTTL != test.sourceTTL {
+				t.Fatalf("destination has a TTL: %v, want %v like the source", hasTTL, test.sourceTTL)
+			}
+			if hasTTL && !expiration.Equal(sourceExpiration) {
+				t.Fatalf("destination expires at %v, want the source's %v", expiration, sourceExpiration)
+			}
+			if sourceLeft {
+				t.Fatal("source's expiration was left behind")
+			}
+		})
+	}
+}
+
+func TestRenameNXOntoExpiredKey(t *testing.T) {
+	for _, sourceTTL := range []bool{false, true} {
+		s := New()
+		if sourceTTL {
+			s.SetEx("source", "new", 100)
+		} else {
+			s.Set("source", "new")
+		}
+		s.SetEx("destination", "old", 500)
+		expireNow(s, "destination")
+
+		if renamed, err := s.RenameNX("source", "destination"); err != nil || renamed != 1 {
+			t.Fatalf("RenameNX = %d, %v, want 1", renamed, err)
+		}
+		if hasTTL := s.TTL("destination") > 0; hasTTL != sourceTTL {
+			t.Fatalf("source TTL %v: destination has a TTL: %v", sourceTTL, hasTTL)
+		}
+	}
+}
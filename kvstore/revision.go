@@ -0,0 +1,76 @@
+package kvstore
+
+// Revisions give clients a cheap compare-and-set. Every write to a key,
+// including TTL changes and renames onto it, gives it a new revision that's
+// higher than any handed out before. Keys that don't exist have revision 0.
+
+// GetVersioned returns the string at key along with its revision
+func (s *KVStore) GetVersioned(key string) (string, int64, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, err := s.get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, s.revisions[key], nil
+}
+
+// SetIfRevision stores value under key, replacing any value and TTL, but only
+// if key's current revision is expected. An expected revision of 0 means the
+// key must not exist. It returns the key's new revision and whether the value
+// was set.
+func (s *KVStore) SetIfRevision(key string, value string, expected int64) (int64, bool, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.checkEntry(key, value); err != nil {
+		return 0, false, err
+	}
+	if s.expired(key) {
+		s.removeExpired(key)
+	}
+	if s.revisions[key] != expected {
+		return 0, false, nil
+	}
+
+	s.set(key, value)
+	return s.revisions[key], true, nil
+}
+
+// bump gives key a new revision. Callers must hold the write lock.
+func (s *KVStore) bump(key string) {
+	s.revision++
+	s.revisions[key] = s.revision
+}
+
+// resetRevisions gives every key a fresh revision, for when the keyspace was
+// replaced wholesale. Callers must hold the write lock.
+func (s *KVStore) resetRevisions() {
+	clear(s.revisions)
+	s.forEachKey(s.bump)
+}
+
+// reserveRevisions gives every key of a snapshot about to replace the
+// keyspace a fresh revision. The store is only locked while a block of
+// revisions is set aside, the keys are numbered after.
+func (s *KVStore) reserveRevisions(snapshot *decodedSnapshot) map[string]int64 {
+	count := int64(len(snapshot.data) + len(snapshot.collections))
+	s.mutex.Lock()
+	next := s.revision
+	s.revision += count
+	s.mutex.Unlock()
+
+	revisions := make(map[string]int64, count)
+	for key := range snapshot.data {
+		next++
+		revisions[key] = next
+	}
+	for key := range snapshot.collections {
+		next++
+		revisions[key] = next
+	}
+	return revisions
+}
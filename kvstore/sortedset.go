@@ -0,0 +1,328 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const ScoreNotANumber = "ERROR: resulting score is not a number (NaN)"
+
+// Memory estimates per sorted set member, on top of the member bytes: one
+// map entry plus one slice element holding the member and its score
+const zsetMemberOverhead = 64
+
+// ScoreBound is one end of a score range. Exclusive bounds don't match
+// members scored exactly Value.
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// ScoredMember is a sorted set member together with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// sortedSet keeps its members ordered by score, then lexicographically by
+// member, with a map for constant-time score lookups
+type sortedSet struct {
+	scores  map[string]float64
+	ordered []ScoredMember
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: make(map[string]float64)}
+}
+
+func (z *sortedSet) valueType() ValueType {
+	return TypeSortedSet
+}
+
+func (z *sortedSet) encoding() string {
+	return "skiplist"
+}
+
+func (z *sortedSet) memoryUsage() int {
+	size := 0
+	for _, m := range z.ordered {
+		size += zsetMemberOverhead + len(m.Member)
+	}
+	return size
+}
+
+// snapshotMember is how a sorted set member is stored in a snapshot. The
+// score is a string because JSON numbers can't hold ±Inf.
+type snapshotMember struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// marshalValue encodes the members in score order
+func (z *sortedSet) marshalValue() (json.RawMessage, error) {
+	members := make([]snapshotMember, len(z.ordered))
+	for i, m := range z.ordered {
+		members[i] = snapshotMember{Member: m.Member, Score: strconv.FormatFloat(m.Score, 'g', -1, 64)}
+	}
+	return json.Marshal(members)
+}
+
+func unmarshalSortedSet(raw json.RawMessage) (*sortedSet, error) {
+	var members []snapshotMember
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, err
+	}
+
+	z := newSortedSet()
+	for _, m := range members {
+		score, err := strconv.ParseFloat(m.Score, 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, fmt.Errorf("invalid score %q for member %q", m.Score, m.Member)
+		}
+		z.add(m.Member, score)
+	}
+	return z, nil
+}
+
+// search returns the position m has, or would have, in z.ordered
+func (z *sortedSet) search(m ScoredMember) int {
+	return sort.Search(len(z.ordered), func(i int) bool {
+		o := z.ordered[i]
+		return o.Score > m.Score || (o.Score == m.Score && o.Member >= m.Member)
+	})
+}
+
+// add sets member's score and reports whether the member is new
+func (z *sortedSet) add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.remove(member)
+	}
+
+	m := ScoredMember{Member: member, Score: score}
+	i := z.search(m)
+	z.ordered = append(z.ordered, ScoredMember{})
+	copy(z.ordered[i+1:], z.ordered[i:])
+	z.ordered[i] = m
+	z.scores[member] = score
+	return !exists
+}
+
+func (z *sortedSet) remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+
+	i := z.search(ScoredMember{Member: member, Score: score})
+	z.ordered = append(z.ordered[:i], z.ordered[i+1:]...)
+	delete(z.scores, member)
+	return true
+}
+
+func (z *sortedSet) rank(member string) (int, bool) {
+	score, exists := z.scores[member]
+	if !exists {
+		return 0, false
+	}
+	return z.search(ScoredMember{Member: member, Score: score}), true
+}
+
+// scoreIndex returns the position of the first member whose score is above
+// bound, or at or above it when inclusive is set
+func (z *sortedSet) scoreIndex(bound float64, inclusive bool) int {
+	return sort.Search(len(z.ordered), func(i int) bool {
+		if inclusive {
+			return z.ordered[i].Score >= bound
+		}
+		return z.ordered[i].Score > bound
+	})
+}
+
+// Sorted Set Methods
+
+// ZAdd sets the score of each member in the sorted set at key, creating it
+// if needed, and returns the number of members that were newly added
+func (s *KVStore) ZAdd(key string, members []ScoredMember) (int, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range members {
+		if err := s.checkEntry(key, m.Member); err != nil {
+			return 0, err
+		}
+	}
+	if c == nil {
+		c = newSortedSet()
+		s.storeCollection(key, c)
+	}
+
+	z := c.(*sortedSet)
+	added := 0
+	for _, m := range members {
+		if z.add(m.Member, m.Score) {
+			added++
+		}
+	}
+	s.bump(key)
+	return added, nil
+}
+
+// ZScore returns the score of member in the sorted set at key. The boolean
+// is false if either the key or the member doesn't exist.
+func (s *KVStore) ZScore(key string, member string) (float64, bool, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if c == nil || err != nil {
+		return 0, false, err
+	}
+
+	score, exists := c.(*sortedSet).scores[member]
+	return score, exists, nil
+}
+
+// ZRange returns the members ranked start through stop, inclusive, in
+// ascending score order. Negative indices count back from the highest rank,
+// so ZRange(key, 0, -1) returns the whole set.
+func (s *KVStore) ZRange(key string, start int, stop int) ([]ScoredMember, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if c == nil || err != nil {
+		return nil, err
+	}
+
+	z := c.(*sortedSet)
+	n := len(z.ordered)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	if start > stop {
+		return nil, nil
+	}
+	return append([]ScoredMember(nil), z.ordered[start:stop+1]...), nil
+}
+
+// ZRank returns the zero-based rank of member in ascending score order. The
+// boolean is false if either the key or the member doesn't exist.
+func (s *KVStore) ZRank(key string, member string) (int, bool, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if c == nil || err != nil {
+		return 0, false, err
+	}
+
+	rank, exists := c.(*sortedSet).rank(member)
+	return rank, exists, nil
+}
+
+// ZRangeByScore returns the members scored between lo and hi in ascending
+// order, skipping the first offset matches and returning at most count of
+// them. A negative count returns every remaining match.
+func (s *KVStore) ZRangeByScore(key string, lo ScoreBound, hi ScoreBound, offset int, count int) ([]ScoredMember, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if c == nil || err != nil {
+		return nil, err
+	}
+
+	z := c.(*sortedSet)
+	start := z.scoreIndex(lo.Value, !lo.Exclusive) + offset
+	end := z.scoreIndex(hi.Value, hi.Exclusive)
+	if count >= 0 {
+		end = min(end, start+count)
+	}
+	if start >= end {
+		return nil, nil
+	}
+	return append([]ScoredMember(nil), z.ordered[start:end]...), nil
+}
+
+// ZIncrBy adds delta to the score of member, treating a missing member or
+// key as scored 0, and returns the new score
+func (s *KVStore) ZIncrBy(key string, member string, delta float64) (float64, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.checkEntry(key, member); err != nil {
+		return 0, err
+	}
+
+	var z *sortedSet
+	if c == nil {
+		z = newSortedSet()
+	} else {
+		z = c.(*sortedSet)
+	}
+
+	score := z.scores[member] + delta
+	if math.IsNaN(score) {
+		return 0, errors.New(ScoreNotANumber)
+	}
+	if c == nil {
+		s.storeCollection(key, z)
+	}
+	z.add(member, score)
+	s.bump(key)
+	return score, nil
+}
+
+// ZScan returns up to count members of the sorted set at key in score order,
+// starting at cursor, along with the cursor for the next call, 0 once the
+// whole set has been visited. If pattern isn't empty only members matching
+// that glob are returned, so a page may hold fewer than count members.
+func (s *KVStore) ZScan(key string, cursor int, count int, pattern string) ([]ScoredMember, int, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeSortedSet)
+	if c == nil || err != nil {
+		return nil, 0, err
+	}
+
+	page, next := cursorPage(c.(*sortedSet).ordered, cursor, count)
+	var members []ScoredMember
+	for _, m := range page {
+		if pattern != "" {
+			if matched, _ := path.Match(pattern, m.Member); !matched {
+				continue
+			}
+		}
+		members = append(members, m)
+	}
+	return members, next, nil
+}
@@ -0,0 +1,295 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const InvalidStreamID = "ERROR: Invalid stream ID specified as stream command argument"
+const StreamIDTooSmall = "ERROR: The ID specified in XADD is equal or smaller than the target stream top item"
+const StreamIDZero = "ERROR: The ID specified in XADD must be greater than 0-0"
+
+// Memory estimate per stream entry on top of its field and value bytes: the
+// entry itself plus a string header per field and value
+const streamEntryOverhead = 48
+
+// StreamID identifies a stream entry: the Unix milliseconds it was added at
+// and a sequence number for entries added within the same millisecond
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less reports whether id comes before other in a stream
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// ParseStreamID parses "<ms>-<seq>", or a bare "<ms>" which takes
+// defaultSeq as its sequence number
+func ParseStreamID(s string, defaultSeq uint64) (StreamID, error) {
+	msStr, seqStr, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return StreamID{}, errors.New(InvalidStreamID)
+	}
+	if !hasSeq {
+		return StreamID{Ms: ms, Seq: defaultSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return StreamID{}, errors.New(InvalidStreamID)
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// ParseStreamRangeBound parses an XRANGE bound: "-" and "+" stand for the
+// smallest and largest IDs, and a bare "<ms>" covers every entry of that
+// millisecond
+func ParseStreamRangeBound(s string, isEnd bool) (StreamID, error) {
+	switch {
+	case s == "-":
+		return StreamID{}, nil
+	case s == "+":
+		return StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}, nil
+	case isEnd:
+		return ParseStreamID(s, math.MaxUint64)
+	default:
+		return ParseStreamID(s, 0)
+	}
+}
+
+// StreamField is one field of a stream entry and its value
+type StreamField struct {
+	Name  string
+	Value string
+}
+
+// StreamEntry is one entry of a stream, its fields in the order they were
+// given to XADD
+type StreamEntry struct {
+	ID     StreamID
+	Fields []StreamField
+}
+
+// stream is an append-only log of entries ordered by ID. lastID is the ID
+// of the newest entry, every new one has to be above it.
+type stream struct {
+	entries []StreamEntry
+	lastID  StreamID
+}
+
+func (x *stream) valueType() ValueType {
+	return TypeStream
+}
+
+func (x *stream) encoding() string {
+	return "stream"
+}
+
+func (x *stream) memoryUsage() int {
+	size := 0
+	for _, entry := range x.entries {
+		size += streamEntryOverhead
+		for _, field := range entry.Fields {
+			size += len(field.Name) + len(field.Value)
+		}
+	}
+	return size
+}
+
+// snapshotStream is how a stream is stored in a snapshot. Each entry's
+// fields are flattened to name, value pairs.
+type snapshotStream struct {
+	LastID  string                `json:"lastId"`
+	Entries []snapshotStreamEntry `json:"entries"`
+}
+
+type snapshotStreamEntry struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+func (x *stream) marshalValue() (json.RawMessage, error) {
+	stored := snapshotStream{LastID: x.lastID.String(), Entries: make([]snapshotStreamEntry, len(x.entries))}
+	for i, entry := range x.entries {
+		fields := make([]string, 0, 2*len(entry.Fields))
+		for _, field := range entry.Fields {
+			fields = append(fields, field.Name, field.Value)
+		}
+		stored.Entries[i] = snapshotStreamEntry{ID: entry.ID.String(), Fields: fields}
+	}
+	return json.Marshal(stored)
+}
+
+func unmarshalStream(raw json.RawMessage) (*stream, error) {
+	var stored snapshotStream
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, err
+	}
+
+	x := &stream{}
+	lastID, err := ParseStreamID(stored.LastID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last stream ID %q", stored.LastID)
+	}
+	for _, entry := range stored.Entries {
+		id, err := ParseStreamID(entry.ID, 0)
+		if err != nil || (len(x.entries) > 0 && !x.lastID.Less(id)) || len(entry.Fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid stream entry %q", entry.ID)
+		}
+		fields := make([]StreamField, 0, len(entry.Fields)/2)
+		for i := 0; i < len(entry.Fields); i += 2 {
+			fields = append(fields, StreamField{Name: entry.Fields[i], Value: entry.Fields[i+1]})
+		}
+		x.entries = append(x.entries, StreamEntry{ID: id, Fields: fields})
+		x.lastID = id
+	}
+	if x.lastID.Less(lastID) {
+		x.lastID = lastID
+	}
+	return x, nil
+}
+
+// nextID returns the ID for an entry added at now: the current millisecond,
+// or the one after lastID if the clock hasn't moved past it
+func (x *stream) nextID(now time.Time) StreamID {
+	ms := uint64(now.UnixMilli())
+	if ms > x.lastID.Ms {
+		return StreamID{Ms: ms}
+	}
+	return StreamID{Ms: x.lastID.Ms, Seq: x.lastID.Seq + 1}
+}
+
+// after returns the position of the first entry with an ID above id
+func (x *stream) after(id StreamID) int {
+	return sort.Search(len(x.entries), func(i int) bool {
+		return id.Less(x.entries[i].ID)
+	})
+}
+
+// Stream Methods
+
+// XAdd appends an entry with fields to the stream at key, creating it if
+// needed, and returns the entry's ID. If id is nil the ID is generated from
+// the current time; otherwise it has to be above every ID already in the
+// stream.
+func (s *KVStore) XAdd(key string, id *StreamID, fields []StreamField) (StreamID, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeStream)
+	if err != nil {
+		return StreamID{}, err
+	}
+	if err := s.checkKey(key); err != nil {
+		return StreamID{}, err
+	}
+	for _, field := range fields {
+		if err := s.checkValue(field.Value); err != nil {
+			return StreamID{}, err
+		}
+	}
+	var x *stream
+	if c == nil {
+		x = &stream{}
+	} else {
+		x = c.(*stream)
+	}
+
+	var entryID StreamID
+	if id == nil {
+		entryID = x.nextID(time.Now())
+	} else {
+		entryID = *id
+		if entryID == (StreamID{}) {
+			return StreamID{}, errors.New(StreamIDZero)
+		}
+		if !x.lastID.Less(entryID) {
+			return StreamID{}, errors.New(StreamIDTooSmall)
+		}
+	}
+
+	if c == nil {
+		s.storeCollection(key, x)
+	}
+	x.entries = append(x.entries, StreamEntry{ID: entryID, Fields: append([]StreamField(nil), fields...)})
+	x.lastID = entryID
+	s.bump(key)
+	return entryID, nil
+}
+
+// XLen returns the number of entries in the stream at key, 0 if it doesn't
+// exist
+func (s *KVStore) XLen(key string) (int, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeStream)
+	if c == nil || err != nil {
+		return 0, err
+	}
+	return len(c.(*stream).entries), nil
+}
+
+// XRange returns the entries with IDs from start through end, inclusive,
+// at most count of them unless count is negative
+func (s *KVStore) XRange(key string, start StreamID, end StreamID, count int) ([]StreamEntry, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeStream)
+	if c == nil || err != nil {
+		return nil, err
+	}
+
+	x := c.(*stream)
+	from := sort.Search(len(x.entries), func(i int) bool {
+		return !x.entries[i].ID.Less(start)
+	})
+	to := x.after(end)
+	if count >= 0 {
+		to = min(to, from+count)
+	}
+	if from >= to {
+		return nil, nil
+	}
+	return append([]StreamEntry(nil), x.entries[from:to]...), nil
+}
+
+// XRead returns the entries with IDs above after, at most count of them
+// unless count is negative
+func (s *KVStore) XRead(key string, after StreamID, count int) ([]StreamEntry, error) {
+	key = s.foldKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.lookupCollection(key, TypeStream)
+	if c == nil || err != nil {
+		return nil, err
+	}
+
+	x := c.(*stream)
+	from := x.after(after)
+	to := len(x.entries)
+	if count >= 0 {
+		to = min(to, from+count)
+	}
+	if from >= to {
+		return nil, nil
+	}
+	return append([]StreamEntry(nil), x.entries[from:to]...), nil
+}
@@ -0,0 +1,75 @@
+package kvstore
+
+import (
+	"testing"
+)
+
+// newTypedStore returns a store holding a string, a sorted set, a stream and
+// a JSON document under keys named after their type
+func newTypedStore(t *testing.T) *KVStore {
+	t.Helper()
+	s := New()
+	s.Set("string", "value")
+	if _, err := s.ZAdd("zset", []ScoredMember{{Member: "m", Score: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.XAdd("stream", nil, []StreamField{{Name: "f", Value: "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.JSONSet("json", "$", `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWrongType(t *testing.T) {
+	all := StreamID{Ms: ^uint64(0), Seq: ^uint64(0)}
+	tests := []struct {
+		name string
+		key  string
+		call func(s *KVStore, key string) error
+	}{
+		{"Get", "zset", func(s *KVStore, key string) error { _, err := s.Get(key); return err }},
+		{"GetVersioned", "stream", func(s *KVStore, key string) error { _, _, err := s.GetVersioned(key); return err }},
+		{"Append", "json", func(s *KVStore, key string) error { _, err := s.Append(key, "x"); return err }},
+		{"IncrExpire", "zset", func(s *KVStore, key string) error { _, err := s.IncrExpire(key, 10); return err }},
+		{"ZAdd", "string", func(s *KVStore, key string) error {
+			_, err := s.ZAdd(key, []ScoredMember{{Member: "m", Score: 1}})
+			return err
+		}},
+		{"ZScore", "stream", func(s *KVStore, key string) error { _, _, err := s.ZScore(key, "m"); return err }},
+		{"ZRange", "json", func(s *KVStore, key string) error { _, err := s.ZRange(key, 0, -1); return err }},
+		{"ZRank", "string", func(s *KVStore, key string) error { _, _, err := s.ZRank(key, "m"); return err }},
+		{"ZRangeByScore", "string", func(s *KVStore, key string) error {
+			_, err := s.ZRangeByScore(key, ScoreBound{Value: 0}, ScoreBound{Value: 10}, 0, -1)
+			return err
+		}},
+		{"ZIncrBy", "stream", func(s *KVStore, key string) error { _, err := s.ZIncrBy(key, "m", 1); return err }},
+		{"ZScan", "json", func(s *KVStore, key string) error { _, _, err := s.ZScan(key, 0, 10, ""); return err }},
+		{"XAdd", "string", func(s *KVStore, key string) error {
+			_, err := s.XAdd(key, nil, []StreamField{{Name: "f", Value: "v"}})
+			return err
+		}},
+		{"XLen", "zset", func(s *KVStore, key string) error { _, err := s.XLen(key); return err }},
+		{"XRange", "json", func(s *KVStore, key string) error { _, err := s.XRange(key, StreamID{}, all, 0); return err }},
+		{"XRead", "string", func(s *KVStore, key string) error { _, err := s.XRead(key, StreamID{}, 0); return err }},
+		{"JSONSet", "string", func(s *KVStore, key string) error { return s.JSONSet(key, "$", `{}`) }},
+		{"JSONGet", "zset", func(s *KVStore, key string) error { _, _, err := s.JSONGet(key, "$"); return err }},
+		{"JSONDel", "stream", func(s *KVStore, key string) error { _, err := s.JSONDel(key, "$.a"); return err }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTypedStore(t)
+			before := s.Type(test.key)
+
+			err := test.call(s, test.key)
+			if err == nil || err.Error() != WrongType {
+				t.Fatalf("%s on a %s key: error = %v, want %s", test.name, before, err, WrongType)
+			}
+			if after := s.Type(test.key); after != before {
+				t.Fatalf("%s changed the key from %s to %s", test.name, before, after)
+			}
+		})
+	}
+}
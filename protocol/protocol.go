@@ -0,0 +1,66 @@
+package protocol
+
+import "strings"
+
+// Every frame the server sends ends with a line reading exactly END. Most
+// frames are replies to a command, but pub/sub messages are pushed to
+// subscribers unprompted; their frames start with a line reading exactly
+// PUSH, followed by "message <quoted channel>" and the message itself:
+//
+//	PUSH
+//	message "news"
+//	hello
+//	END
+//
+// So that a value can't end a frame early or pass for a push, any line made
+// of zero or more backslashes followed by END or PUSH is sent with one more
+// backslash in front: a value of "END" goes out as "\END" and "\END" as
+// "\\END". Clients strip that backslash again with ParseResponseLine.
+
+// ResponseTerminator is the line that ends every frame
+const ResponseTerminator = "END"
+
+// PushMarker is the first line of a pushed pub/sub message
+const PushMarker = "PUSH"
+
+// Commands lists every command the server understands, so clients can offer
+// completion without importing the server
+var Commands = []string{
+	"GET", "MGET", "BGET", "KEYEXISTS", "TYPE", "SET", "APPEND", "MSET",
+	"SETEX", "INCREXP", "SETVER", "GETVER", "EXPIRE", "PEXPIREAT", "PERSIST",
+	"TTL",
+	"RENAME", "RENAME_NX", "STATS", "RESETSTATS", "DELETE", "DEL", "DELETEEX",
+	"FLUSH", "FLUSHDB", "FLUSHALL", "SAVE", "BGSAVE", "LOAD", "KEYS", "SCAN",
+	"PREFIX", "KEYS_WITH_TTL", "KEYS_NO_TTL", "INFO", "HELP", "PING", "AUTH",
+	"HEALTH", "SHUTDOWN", "SUBSCRIBE", "UNSUBSCRIBE", "PUBLISH", "OBJECT",
+	"CLIENT", "MEMORY", "QUIT", "EXPORTCSV", "IMPORTCSV", "ZADD", "ZSCORE",
+	"ZRANGE", "ZRANK", "ZRANGEBYSCORE", "XADD", "XLEN", "XRANGE", "XREAD",
+	"EVAL", "JSON.SET", "JSON.GET", "JSON.DEL", "ZINCRBY", "ZSCAN", "SYNC",
+	"REPLICAOF", "WAIT", "COMMAND", "DEBUG",
+}
+
+// ParseResponseLine interprets one line of a frame, without its line
+// ending. It reports whether the line is the terminator and otherwise
+// returns the line with its escaping undone. Check the first line of a frame
+// against PushMarker before calling it.
+func ParseResponseLine(line string) (string, bool) {
+	if line == ResponseTerminator {
+		return "", true
+	}
+	if isEscapedReserved(line) {
+		return line[1:], false
+	}
+	return line, false
+}
+
+// IsReservedLine reports whether line reads as END or PUSH
+func IsReservedLine(line string) bool {
+	return line == ResponseTerminator || line == PushMarker
+}
+
+// isEscapedReserved reports whether line is one or more backslashes
+// followed by END or PUSH
+func isEscapedReserved(line string) bool {
+	rest := strings.TrimLeft(line, `\`)
+	return IsReservedLine(rest) && len(rest) < len(line)
+}
@@ -1,9 +1,56 @@
+//go:build ignore
+
 package main
 
 import (
+	"flag"
+	"log"
+
 	"github.com/petariliev/kvstore/server"
 )
 
 func main() {
-	server.StartServer()
+	config := server.DefaultConfig()
+	flag.StringVar(&config.Addr, "addr", config.Addr, "address to listen on for the line protocol")
+	flag.StringVar(&config.UnixSocket, "unixsocket", config.UnixSocket, "also listen on this Unix domain socket, e.g. /tmp/kv.sock (with -addr \"\" it's the only listener)")
+	flag.StringVar(&config.HTTPAddr, "http-addr", config.HTTPAddr, "address for the HTTP gateway, e.g. :8081 (disabled if empty)")
+	flag.IntVar(&config.TTLJitter, "ttl-jitter", config.TTLJitter, "randomize expirations within ±N% of the requested TTL (0-99, TTL reports the jittered time)")
+	flag.IntVar(&config.MaxRequestBytes, "max-request-bytes", config.MaxRequestBytes, "maximum size of a single command line in bytes (0 for no limit)")
+	flag.BoolVar(&config.PrefixIndex, "prefix-index", config.PrefixIndex, "index keys in a trie so PREFIX doesn't scan every key (uses more memory, slows writes)")
+	flag.BoolVar(&config.CaseInsensitiveKeys, "case-insensitive-keys", config.CaseInsensitiveKeys, "lower-case every key so lookups ignore case (existing keys are lower-cased on load)")
+	flag.StringVar(&config.DataDir, "data-dir", config.DataDir, "directory that files named in SAVE, LOAD, EXPORTCSV and IMPORTCSV must stay inside (unrestricted if empty)")
+	flag.BoolVar(&config.ReadOnly, "readonly", config.ReadOnly, "reject write commands from clients")
+	flag.IntVar(&config.MaxMemory, "maxmemory", config.MaxMemory, "maximum estimated memory use in bytes before -maxmemory-policy applies (0 for no limit)")
+	flag.StringVar(&config.MaxMemoryPolicy, "maxmemory-policy", config.MaxMemoryPolicy, "what to do when -maxmemory is reached: noeviction (reject writes), lru or lfu (evict keys)")
+	flag.IntVar(&config.MaxKeyBytes, "max-key-bytes", config.MaxKeyBytes, "reject writes of keys longer than this many bytes (0 for no limit)")
+	flag.IntVar(&config.MaxValueBytes, "max-value-bytes", config.MaxValueBytes, "reject writes of values, collection members or fields longer than this many bytes, including APPEND results (0 for no limit)")
+	flag.StringVar(&config.Save, "save", config.Save, "auto-save rules as \"<seconds> <changes>\" pairs, e.g. \"900 1 300 100\" (disabled if empty)")
+	flag.IntVar(&config.PubSubHistory, "pubsub-history", config.PubSubHistory, "keep the last N messages of each channel for SUBSCRIBE <channel> REPLAY <n> (0 disables)")
+	flag.StringVar(&config.ReservedPrefix, "reserved-prefix", config.ReservedPrefix, "reject client writes that create keys starting with this prefix, e.g. __ (disabled if empty)")
+	flag.BoolVar(&config.AllowControlChars, "allow-control-chars", config.AllowControlChars, "accept control characters such as NUL in plain command lines (framed requests always accept any bytes)")
+	flag.BoolVar(&config.EnableDebug, "enable-debug", config.EnableDebug, "allow the DEBUG command (for testing, keep off in production)")
+	flag.DurationVar(&config.CommandTimeout, "command-timeout", config.CommandTimeout, "maximum time a single command may run before the client gets an error (0 disables)")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "how long a client may wait between commands before it's disconnected (0 disables, subscribers are exempt)")
+	flag.DurationVar(&config.CleanupInterval, "cleanup-interval", config.CleanupInterval, "how often expired keys are swept from the store")
+	flag.StringVar(&config.ConfigFile, "config", config.ConfigFile, "file of \"<name> <value>\" lines for idle-timeout, command-timeout and cleanup-interval, reloaded on SIGHUP (overrides the flags)")
+	flag.StringVar(&config.LogFile, "log-file", config.LogFile, "write the log to this file instead of stderr, reopened on SIGHUP")
+	logEvents := flag.Bool("log-events", false, "log client connect, AUTH and disconnect events for auditing")
+	flag.BoolVar(&config.CommandEvents, "command-events", config.CommandEvents, "with -log-events, also log the name of every command a client runs")
+	flag.Func("alias", "define a command alias as ALIAS=COMMAND, e.g. RM=DELETE (repeatable)", func(definition string) error {
+		config.Aliases = append(config.Aliases, definition)
+		return nil
+	})
+	flag.StringVar(&config.ACLFile, "aclfile", config.ACLFile, "file of \"<user> <password> <rules...>\" lines; clients must AUTH as one of them (open if empty)")
+	flag.StringVar(&config.MasterAuth, "masterauth", config.MasterAuth, "\"<user>:<password>\" a replica authenticates with when its master has an ACL")
+	flag.Parse()
+
+	if config.TTLJitter < 0 || config.TTLJitter >= 100 {
+		log.Fatalf("[FATAL] Invalid -ttl-jitter %d: must be between 0 and 99", config.TTLJitter)
+	}
+
+	if *logEvents {
+		config.OnEvent = server.LogEvent
+	}
+
+	server.StartServer(config)
 }
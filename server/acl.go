@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/petariliev/kvstore/protocol"
+)
+
+// The -aclfile lists one user per line as "<name> <password> <rules...>".
+// Rules are applied left to right: +CMD and -CMD allow or deny a single
+// command, +@<category> and -@<category> a whole category. Categories are
+// all, read (commands that don't change the store), write and admin
+// (commands that act on the server rather than the keys):
+//
+//	admin   s3cret  +@all
+//	reader  r3ad    +@read
+//	metrics m0n     +PING +INFO +STATS
+//
+// Once it's loaded, clients have to AUTH before running anything but AUTH
+// and HEALTH.
+
+// Commands that act on the server rather than on keys
+var adminCommands = map[string]bool{
+	ShutDownCommand:  true,
+	SaveCommand:      true,
+	BgSaveCommand:    true,
+	LoadCommand:      true,
+	ExportCSVCommand: true,
+	ImportCSVCommand: true,
+	FlushAllCommand:  true,
+	SyncCommand:      true,
+	ReplicaOfCommand: true,
+	DebugCommand:     true,
+}
+
+// Commands a client may run before authenticating
+var preAuthCommands = map[string]bool{
+	AuthCommand:   true,
+	HealthCommand: true,
+}
+
+// aclUser is a user from the -aclfile and the commands it may run
+type aclUser struct {
+	name     string
+	password string
+	commands map[string]bool
+}
+
+func (u *aclUser) allowed(cmd string) bool {
+	return u.commands[cmd]
+}
+
+// ACL holds the users clients can AUTH as
+type ACL struct {
+	users map[string]*aclUser
+}
+
+// acl is nil unless -aclfile is set, in which case every client has to
+// authenticate
+var acl *ACL
+
+func loadACL(fileName string) (*ACL, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := &ACL{users: make(map[string]*aclUser)}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected <name> <password> <rules...>", fileName, lineNo)
+		}
+		if _, exists := result.users[fields[0]]; exists {
+			return nil, fmt.Errorf("%s:%d: user %s is defined twice", fileName, lineNo, fields[0])
+		}
+		commands, err := parseACLRules(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, lineNo, err)
+		}
+		result.users[fields[0]] = &aclUser{name: fields[0], password: fields[1], commands: commands}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(result.users) == 0 {
+		return nil, fmt.Errorf("%s defines no users", fileName)
+	}
+	return result, nil
+}
+
+// parseACLRules turns rules into the set of commands they allow
+func parseACLRules(rules []string) (map[string]bool, error) {
+	commands := make(map[string]bool)
+	for _, rule := range rules {
+		if len(rule) < 2 || (rule[0] != '+' && rule[0] != '-') {
+			return nil, fmt.Errorf("invalid rule %q, expected +CMD, -CMD, +@category or -@category", rule)
+		}
+		allow := rule[0] == '+'
+
+		if category, isCategory := strings.CutPrefix(rule[1:], "@"); isCategory {
+			matches, ok := categoryMatcher(category)
+			if !ok {
+				return nil, fmt.Errorf("unknown category %q, expected all, read, write or admin", category)
+			}
+			for i := range commandTable {
+				if matches(&commandTable[i]) {
+					commands[commandTable[i].name] = allow
+				}
+			}
+			continue
+		}
+
+		spec, exists := registry[strings.ToUpper(rule[1:])]
+		if !exists {
+			return nil, fmt.Errorf("unknown command %q", rule[1:])
+		}
+		commands[spec.name] = allow
+	}
+	return commands, nil
+}
+
+func categoryMatcher(category string) (func(*commandSpec) bool, bool) {
+	switch strings.ToLower(category) {
+	case "all":
+		return func(*commandSpec) bool { return true }, true
+	case "read":
+		return func(spec *commandSpec) bool { return !spec.write && !adminCommands[spec.name] }, true
+	case "write":
+		return func(spec *commandSpec) bool { return spec.write && !adminCommands[spec.name] }, true
+	case "admin":
+		return func(spec *commandSpec) bool { return adminCommands[spec.name] }, true
+	}
+	return nil, false
+}
+
+// authenticate returns the user that name and password identify
+func (a *ACL) authenticate(name, password string) (*aclUser, bool) {
+	user, exists := a.users[name]
+	if !exists || subtle.ConstantTimeCompare([]byte(user.password), []byte(password)) != 1 {
+		return nil, false
+	}
+	return user, true
+}
+
+// checkPermission returns the error to reply with if conn may not run cmd,
+// or "" if it may. Writes from the replication stream have no conn and are
+// always allowed.
+func checkPermission(cmd string, conn net.Conn) string {
+	if acl == nil || conn == nil || preAuthCommands[cmd] {
+		return ""
+	}
+
+	var user *aclUser
+	if info := connections.Info(conn); info != nil {
+		user = info.authenticatedUser()
+	}
+	return userPermission(user, cmd)
+}
+
+// userPermission checks that user, nil if not authenticated, may run cmd.
+// It returns the error to reply with, or "" if the command may run.
+func userPermission(user *aclUser, cmd string) string {
+	if user == nil {
+		return NoAuth
+	}
+	if !user.allowed(cmd) {
+		log.Printf("[WARN] User %s may not run %s\n", user.name, cmd)
+		return fmt.Sprintf(NoPermission, strings.ToLower(cmd))
+	}
+	return ""
+}
+
+func handleAuth(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	if acl == nil {
+		metrics.Inc("ERROR")
+		return replyError(w, AuthNotConfigured)
+	}
+
+	name, password := tokens[1], tokens[2]
+	user, ok := acl.authenticate(name, password)
+	if !ok {
+		log.Printf("[WARN] Failed AUTH as %s from %s\n", name, getAddress(conn))
+		emitEvent(EventAuthFailed, connections.Info(conn), func(event *Event) { event.User = name })
+		metrics.Inc("ERROR")
+		return replyError(w, WrongPassword)
+	}
+
+	if info := connections.Info(conn); info != nil {
+		info.setUser(user)
+		emitEvent(EventAuth, info, func(event *Event) { event.User = name })
+	}
+	log.Printf("[INFO] AUTH %s from %s -> OK\n", name, getAddress(conn))
+	metrics.Inc("AUTH")
+	return reply(w, OK)
+}
+
+// authenticateToMaster sends AUTH with the -masterauth credentials before
+// a replica asks its master for SYNC
+func authenticateToMaster(conn net.Conn, reader *bufio.Reader) error {
+	name, password, _ := strings.Cut(config.MasterAuth, ":")
+	if _, err := io.WriteString(conn, formatRequest([]string{AuthCommand, name, password})); err != nil {
+		return err
+	}
+
+	var response []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line, end := protocol.ParseResponseLine(strings.TrimSuffix(line, "\n"))
+		if end {
+			break
+		}
+		response = append(response, line)
+	}
+	if result := strings.TrimSpace(strings.Join(response, "\n")); result != OK {
+		return fmt.Errorf("master rejected AUTH: %s", result)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// aliases maps each alias set with -alias to the command it runs
+var aliases = make(map[string]string)
+
+// registerAliases adds "ALIAS=COMMAND" definitions to the registry. An alias
+// may point at another alias, so each is followed to a real command; chains
+// that loop back on themselves and aliases that would shadow a command are
+// rejected.
+func registerAliases(definitions []string) error {
+	targets := make(map[string]string, len(definitions))
+	for _, definition := range definitions {
+		name, target, ok := strings.Cut(definition, "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		target = strings.ToUpper(strings.TrimSpace(target))
+		if !ok || name == "" || target == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("alias %q should look like NAME=COMMAND", definition)
+		}
+		if _, exists := registry[name]; exists {
+			return fmt.Errorf("alias %s would shadow the %s command", name, name)
+		}
+		targets[name] = target
+	}
+
+	for name := range targets {
+		target, err := resolveAlias(name, targets)
+		if err != nil {
+			return err
+		}
+		aliases[name] = target
+	}
+	for name, target := range aliases {
+		registry[name] = registry[target]
+		log.Printf("[INFO] Alias %s -> %s\n", name, target)
+	}
+	return nil
+}
+
+// resolveAlias follows name through targets until it reaches a command
+func resolveAlias(name string, targets map[string]string) (string, error) {
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for current := targets[name]; ; current = targets[current] {
+		chain = append(chain, current)
+		if seen[current] {
+			return "", fmt.Errorf("alias cycle: %s", strings.Join(chain, " -> "))
+		}
+		seen[current] = true
+
+		if _, isAlias := targets[current]; isAlias {
+			continue
+		}
+		if _, exists := registry[current]; !exists {
+			return "", fmt.Errorf("alias %s points to unknown command %s", name, current)
+		}
+		// handleConnection acts on these by name before dispatch
+		if current == QuitCommand || current == SyncCommand {
+			return "", fmt.Errorf("%s can't be aliased", current)
+		}
+		return current, nil
+	}
+}
+
+// commandName returns the upper-cased command name, with an alias replaced by
+// the command it runs
+func commandName(token string) string {
+	name := strings.ToUpper(token)
+	if target, isAlias := aliases[name]; isAlias {
+		return target
+	}
+	return name
+}
+
+// sortedAliases lists the aliases in name order for HELP and COMMAND DOCS
+func sortedAliases() []string {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
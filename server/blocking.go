@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Commands that wait for other clients. They bound their own wait, so they
+// skip the CommandTimeout watchdog and are cancelled if the client goes away.
+var blockingCommands = map[string]bool{
+	BGetCommand: true,
+}
+
+func isBlockingCommand(tokens []string) bool {
+	return len(tokens) > 0 && blockingCommands[commandName(tokens[0])]
+}
+
+// runBlockingCommand runs a blocking command while watching conn, so the
+// command is cancelled if the client disconnects or the server closes the
+// connection on shutdown. The watch only peeks at reader, a command pipelined
+// behind this one is read normally afterwards, though the client going away
+// after that is only noticed once the wait ends.
+func runBlockingCommand(connCtx context.Context, w io.Writer, tokens []string, conn net.Conn, reader *bufio.Reader) error {
+	ctx, cancel := context.WithCancel(connCtx)
+	defer cancel()
+
+	conn.SetReadDeadline(time.Time{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		_, err := reader.Peek(1)
+		netErr, ok := err.(net.Error)
+		if err != nil && !(ok && netErr.Timeout()) {
+			log.Printf("[INFO] Client %s went away during %s\n", getAddress(conn), tokens[0])
+			cancel()
+		}
+	}()
+	defer func() {
+		// Unblock the peek before handleConnection reads from reader again
+		conn.SetReadDeadline(time.Now())
+		<-watching
+	}()
+
+	return processCommand(ctx, w, tokens, conn)
+}
+
+// handleBGet waits up to timeout-ms for key to be set, 0 waits indefinitely.
+// It replies with the value, or NilReply if the timeout passes first.
+func handleBGet(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "BGET <key> <timeout-ms>"
+	key := tokens[1]
+	timeout, err := strconv.Atoi(tokens[2])
+	if err != nil || timeout < 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("BGET", format))
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	value, err := kv.WaitFor(ctx, key)
+	switch {
+	case err == nil:
+		log.Printf("[INFO] BGET %s -> %s\n", key, value)
+		metrics.Inc("BGET")
+		return reply(w, value)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("[INFO] BGET %s timed out after %dms\n", key, timeout)
+		metrics.Inc("BGET")
+		return reply(w, NilReply)
+	case errors.Is(err, context.Canceled):
+		return abortCommand(ctx, w, "BGET")
+	default:
+		log.Printf("[WARN] BGET %s -> %v\n", key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// commandHandler writes the response to tokens to w. conn is the client's
+// connection, or nil for writes applied from the replication stream.
+type commandHandler func(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error
+
+// commandSpec describes a command for dispatch and COMMAND introspection.
+// minArgs and maxArgs count the arguments after the command name, a maxArgs
+// of -1 means there is no upper limit. Write commands modify the store, so
+// they're rejected while read-only or shutting down and are replicated.
+type commandSpec struct {
+	name    string
+	minArgs int
+	maxArgs int
+	write   bool
+	usage   string
+	summary string
+	handler commandHandler
+}
+
+// commandTable lists every command in the order COMMAND DOCS reports them,
+// registry indexes it by name. Both are filled in by init because several
+// handlers refer back to them.
+var commandTable []commandSpec
+var registry = make(map[string]*commandSpec)
+
+func init() {
+	commandTable = []commandSpec{
+		{GetCommand, 1, 1, false, "GET <key>", "Retrieve a value", noConn(handleGet)},
+		{MGetCommand, 1, -1, false, "MGET <key1> <key2> ...", "Retrieve several values", noConn(handleMGet)},
+		{BGetCommand, 2, 2, false, "BGET <key> <timeout-ms>", "Wait for a key to be set and return its value", noConn(handleBGet)},
+		{KeyExistsCommand, 1, 1, false, "KEYEXISTS <key>", "Check if a key exists", noConn(handleKeyExists)},
+		{TypeCommand, 1, 1, false, "TYPE <key>", "Show the type of the value stored at a key", noConn(handleType)},
+		{SetCommand, 2, 4, true, "SET <key> <value> [KEEPTTL|PXAT <unix-time-ms>]", "Store a key-value pair", noConn(handleSet)},
+		{AppendCommand, 2, 2, true, "APPEND <key> <value>", "Add to the end of a string value", noConn(handleAppend)},
+		{MSetCommand, 2, -1, true, "MSET <key1> <val1> <key2> <val2> ...", "Store several key-value pairs at once", noConn(handleMSet)},
+		{SetexCommand, 3, 3, true, "SETEX <key> <value> <ttl_seconds>", "Store a key-value pair with expiration", noConn(handleSetEx)},
+		{IncrExpCommand, 2, 2, true, "INCREXP <key> <window_seconds>", "Increment a counter that expires a fixed window after creation", noConn(handleIncrExp)},
+		{SetVerCommand, 3, 3, true, "SETVER <key> <value> <expected-rev>", "Store a value if the key's revision matches", noConn(handleSetVer)},
+		{GetVerCommand, 1, 1, false, "GETVER <key>", "Retrieve a value and its revision", noConn(handleGetVer)},
+		{ExpireCommand, 2, 2, true, "EXPIRE <key> <ttl_seconds>", "Set a TTL on an existing key", noConn(handleExpire)},
+		{PExpireAtCommand, 2, 2, true, "PEXPIREAT <key> <unix-time-ms>", "Set an existing key to expire at a Unix time in milliseconds", noConn(handlePExpireAt)},
+		{PersistCommand, 1, 1, true, "PERSIST <key>", "Remove the TTL from a key", noConn(handlePersist)},
+		{TTLCommand, 1, 1, false, "TTL <key>", "Show the seconds left before a key expires", noConn(handleTTL)},
+		{RenameCommand, 2, 2, true, "RENAME <oldKey> <newKey>", "Rename a key", noConn(handleRename)},
+		{RenameNXCommand, 2, 2, true, "RENAME_NX <oldKey> <newKey>", "Rename a key unless the new name is taken", noConn(handleRenameNX)},
+		{StatsCommand, 0, 0, false, "STATS", "Show usage metrics", noConn(handleStats)},
+		{ResetStatsCommand, 0, 0, false, "RESETSTATS", "Zero the command counters", noConn(handleResetStats)},
+		{DeleteCommand, 1, -1, true, "DELETE <key1> <key2> ...", "Same as DEL, kept for compatibility", noConn(handleDel)},
+		{DelCommand, 1, -1, true, "DEL <key1> <key2> ...", "Remove keys, returning how many existed", noConn(handleDel)},
+		{DeleteexCommand, 2, 2, true, "DELETEEX <key> <ttl_seconds>", "Remove a key after a delay", noConn(handleDeleteEx)},
+		{FlushCommand, 0, 1, true, "FLUSH [ASYNC]", "Alias for FLUSHDB", noConn(handleFlushDB)},
+		{FlushDBCommand, 0, 1, true, "FLUSHDB [ASYNC]", "Clear the current database", noConn(handleFlushDB)},
+		{FlushAllCommand, 0, 1, true, "FLUSHALL [ASYNC]", "Clear every database", noConn(handleFlushAll)},
+		{SaveCommand, 0, 1, false, "SAVE [path]", "Save store to disk", noConn(handleSave)},
+		{BgSaveCommand, 0, 0, false, "BGSAVE", "Save store to disk in the background", noConn(handleBgSave)},
+		{LoadCommand, 0, 3, true, "LOAD [path] [MERGE [REPLACE]]", "Load store from disk, or merge it into the current keys", noConn(handleLoad)},
+		{KeysCommand, 0, 0, false, "KEYS", "List all keys", noConn(handleKeys)},
+		{ScanCommand, 1, -1, false, "SCAN <cursor> [COUNT <count>] [TYPE <type>]", "Iterate keys in batches", noConn(handleScan)},
+		{PrefixCommand, 1, 1, false, "PREFIX <prefix>", "List keys starting with prefix", noConn(handlePrefix)},
+		{KeysWithTTLCommand, 0, 0, false, "KEYS_WITH_TTL", "List keys that have a TTL", noConn(handleKeysWithTTL)},
+		{KeysNoTTLCommand, 0, 0, false, "KEYS_NO_TTL", "List keys without a TTL", noConn(handleKeysNoTTL)},
+		{InfoCommand, 0, 0, false, "INFO", "Show server config", noConn(handleInfo)},
+		{HelpCommand, 0, 0, false, "HELP", "Show the help message", noConn(handleHelp)},
+		{PingCommand, 0, 1, false, "PING [message]", "Check if server is alive", noConn(handlePing)},
+		{AuthCommand, 2, 2, false, "AUTH <user> <password>", "Authenticate as a user from -aclfile", handleAuth},
+		{HealthCommand, 0, 0, false, "HEALTH", "Report whether the server is ready", noConn(handleHealth)},
+		{ShutDownCommand, 0, 0, false, "SHUTDOWN", "Gracefully stop the server", noConn(handleShutDown)},
+		{SubscribeCommand, 1, 3, false, "SUBSCRIBE <channel> [REPLAY <count>]", "Receive messages published to a channel", handleSubscribe},
+		{UnsubscribeCommand, 1, 1, false, "UNSUBSCRIBE <channel>", "Stop receiving messages from a channel", handleUnsubscribe},
+		{PublishCommand, 2, -1, false, "PUBLISH <channel> <message>", "Send a message to a channel's subscribers", noConn(handlePublish)},
+		{ObjectCommand, 2, 2, false, "OBJECT <ENCODING|IDLETIME|REFCOUNT|FREQ> <key>", "Inspect how a key is stored", noConn(handleObject)},
+		{ClientCommand, 1, 1, false, "CLIENT INFO", "Show details about this connection", handleClient},
+		{MemoryCommand, 1, 2, false, "MEMORY <USAGE <key>|STATS|DOCTOR>", "Estimate memory usage", noConn(handleMemory)},
+		{QuitCommand, 0, 0, false, "QUIT", "Close the connection", noConn(handleQuit)},
+		{ExportCSVCommand, 1, 1, false, "EXPORTCSV <file>", "Export keys as key,value,ttl_seconds rows", noConn(handleExportCSV)},
+		{ImportCSVCommand, 1, 1, true, "IMPORTCSV <file>", "Import keys from a CSV file", noConn(handleImportCSV)},
+		{ZAddCommand, 3, -1, true, "ZADD <key> <score> <member> [<score> <member> ...]", "Add members to a sorted set", noConn(handleZAdd)},
+		{ZScoreCommand, 2, 2, false, "ZSCORE <key> <member>", "Get the score of a sorted set member", noConn(handleZScore)},
+		{ZRangeCommand, 3, 4, false, "ZRANGE <key> <start> <stop> [WITHSCORES]", "List sorted set members by rank", noConn(handleZRange)},
+		{ZRankCommand, 2, 2, false, "ZRANK <key> <member>", "Get the rank of a sorted set member", noConn(handleZRank)},
+		{ZRangeByScoreCommand, 3, -1, false, "ZRANGEBYSCORE <key> <min> <max> [WITHSCORES] [LIMIT <offset> <count>]", "List sorted set members by score", noConn(handleZRangeByScore)},
+		{XAddCommand, 4, -1, true, "XADD <key> <id|*> <field> <value> [<field> <value> ...]", "Append an entry to a stream", noConn(handleXAdd)},
+		{XLenCommand, 1, 1, false, "XLEN <key>", "Count the entries of a stream", noConn(handleXLen)},
+		{XRangeCommand, 3, 5, false, "XRANGE <key> <start> <end> [COUNT <count>]", "List stream entries in an ID range", noConn(handleXRange)},
+		{XReadCommand, 3, -1, false, "XREAD [COUNT <count>] STREAMS <key> [<key> ...] <id> [<id> ...]", "List stream entries after the given IDs", noConn(handleXRead)},
+		{EvalCommand, 2, -1, true, "EVAL <script> <numkeys> [<key> ...] [<arg> ...]", "Run a list of commands atomically", handleEval},
+		{JSONSetCommand, 3, -1, true, "JSON.SET <key> <path> <json>", "Store a JSON value at a path", noConn(handleJSONSet)},
+		{JSONGetCommand, 1, 2, false, "JSON.GET <key> [<path>]", "Get the JSON value at a path", noConn(handleJSONGet)},
+		{JSONDelCommand, 2, 2, true, "JSON.DEL <key> <path>", "Delete the JSON value at a path", noConn(handleJSONDel)},
+		{ZIncrByCommand, 3, 3, true, "ZINCRBY <key> <delta> <member>", "Add to a member's score", noConn(handleZIncrBy)},
+		{ZScanCommand, 2, -1, false, "ZSCAN <key> <cursor> [MATCH <pattern>] [COUNT <count>]", "Iterate sorted set members in batches", noConn(handleZScan)},
+		{SyncCommand, 0, 0, false, "SYNC", "Start replicating from this server", handleSyncCommand},
+		{ReplicaOfCommand, 2, 2, false, "REPLICAOF <host> <port> | REPLICAOF NO ONE", "Replicate another server", noConn(handleReplicaOf)},
+		{WaitCommand, 2, 2, false, "WAIT <numreplicas> <timeout-ms>", "Report the number of connected replicas", noConn(handleWait)},
+		{CommandCommand, 1, -1, false, "COMMAND <COUNT|DOCS [name ...]>", "Describe the supported commands", noConn(handleCommand)},
+		{DebugCommand, 1, 2, false, "DEBUG <SLEEP <seconds>|SET-ACTIVE-EXPIRE <0|1>|EXPIRE-SCAN>", "Testing hooks, needs -enable-debug", noConn(handleDebug)},
+	}
+
+	for i := range commandTable {
+		spec := &commandTable[i]
+		registry[spec.name] = spec
+	}
+}
+
+// lookupCommand finds the spec for tokens and checks its argument count. If
+// either fails it returns nil and the response to send instead.
+func lookupCommand(tokens []string) (*commandSpec, string) {
+	cmd := strings.ToUpper(tokens[0])
+	spec, exists := registry[cmd]
+	if !exists {
+		log.Printf("[WARN] Invalid command: %s\n", cmd)
+		return nil, formatUnknownCommand(tokens[0])
+	}
+
+	args := len(tokens) - 1
+	if args < spec.minArgs || (spec.maxArgs >= 0 && args > spec.maxArgs) {
+		log.Printf("[WARN] Invalid %s command format\n", spec.name)
+		return nil, formatInvalidCommand(spec.name, spec.usage)
+	}
+	return spec, ""
+}
+
+// formatUnknownCommand echoes an unknown command name back, suggesting the
+// closest known one if it's only a typo away
+func formatUnknownCommand(name string) string {
+	message := fmt.Sprintf("ERROR: unknown command '%s'", name)
+	if suggestion, ok := closestCommand(strings.ToUpper(name)); ok {
+		message += fmt.Sprintf(", did you mean '%s'?", suggestion)
+	}
+	return message
+}
+
+// closestCommand finds the command or alias with the smallest edit distance
+// to name, as long as it's at most 2 and shorter than name itself. Ties go
+// to the name that sorts first, so suggestions are stable.
+func closestCommand(name string) (string, bool) {
+	best, bestDistance := "", 3
+	for candidate := range registry {
+		distance := editDistance(name, candidate)
+		if distance < bestDistance || (distance == bestDistance && candidate < best) {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" || bestDistance >= len(name) {
+		return "", false
+	}
+	return best, true
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps of
+// adjacent characters that turn a into b, so "GTE" is 1 away from "GET"
+func editDistance(a, b string) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(a)][len(b)]
+}
+
+// noConn adapts a handler that doesn't need the client's connection
+func noConn(handler func(ctx context.Context, w io.Writer, tokens []string) error) commandHandler {
+	return func(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+		return handler(ctx, w, tokens)
+	}
+}
+
+// A bare SYNC is handled by handleConnection before dispatch, so this only
+// sees it in contexts where it can't start replication
+func handleSyncCommand(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	metrics.Inc("ERROR")
+	return replyError(w, formatInvalidCommand("SYNC", "SYNC"))
+}
+
+func handleCommand(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "COMMAND <COUNT|DOCS [name ...]>"
+	subcommand := strings.ToUpper(tokens[1])
+
+	switch {
+	case subcommand == "COUNT" && len(tokens) == 2:
+		metrics.Inc("COMMAND")
+		return reply(w, strconv.Itoa(len(commandTable)))
+	case subcommand == "DOCS":
+		metrics.Inc("COMMAND")
+		log.Printf("[INFO] COMMAND DOCS %v\n", tokens[2:])
+		return reply(w, commandDocs(tokens[2:]))
+	default:
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("COMMAND", format))
+	}
+}
+
+// commandDocs describes the named commands, or all of them and then every
+// alias if names is empty, one per line. Unknown names are skipped.
+func commandDocs(names []string) string {
+	if len(names) == 0 {
+		for i := range commandTable {
+			names = append(names, commandTable[i].name)
+		}
+		names = append(names, sortedAliases()...)
+	}
+
+	var lines []string
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		spec, exists := registry[name]
+		if !exists {
+			continue
+		}
+		if target, isAlias := aliases[name]; isAlias {
+			lines = append(lines, fmt.Sprintf("%s (alias of %s)", name, target))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s (args: %s) - %s. Usage: %s", spec.name, formatArity(spec.minArgs, spec.maxArgs), spec.summary, spec.usage))
+	}
+	if len(lines) == 0 {
+		return "EMPTY"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatArity describes an argument count range, e.g. "1", "0-1" or "2+"
+func formatArity(minArgs, maxArgs int) string {
+	switch maxArgs {
+	case minArgs:
+		return strconv.Itoa(minArgs)
+	case -1:
+		return fmt.Sprintf("%d+", minArgs)
+	default:
+		return fmt.Sprintf("%d-%d", minArgs, maxArgs)
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/petariliev/kvstore/protocol"
+)
+
+func TestProtocolCommandsMatchTable(t *testing.T) {
+	listed := map[string]bool{}
+	for _, name := range protocol.Commands {
+		listed[name] = true
+	}
+	for name := range registry {
+		if !listed[name] {
+			t.Errorf("%s is missing from protocol.Commands", name)
+		}
+		delete(listed, name)
+	}
+	for name := range listed {
+		t.Errorf("protocol.Commands lists unknown command %s", name)
+	}
+}
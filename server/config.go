@@ -0,0 +1,124 @@
+package server
+
+import "time"
+
+// Config holds the server settings that can be changed from the command line
+type Config struct {
+	// Addr is the address the line protocol listens on
+	Addr string
+
+	// UnixSocket, if set, is the path of a Unix domain socket the line
+	// protocol listens on too. With Addr empty it's the only listener.
+	UnixSocket string
+
+	// HTTPAddr is the address of the HTTP gateway; empty disables it
+	HTTPAddr string
+
+	// TTLJitter randomizes expirations within ±TTLJitter% of the requested TTL
+	TTLJitter int
+
+	// MaxRequestBytes caps the length of a single command line
+	MaxRequestBytes int
+
+	// PrefixIndex maintains a trie of keys to speed up PREFIX queries
+	PrefixIndex bool
+
+	// CaseInsensitiveKeys lower-cases every key, including those already
+	// on disk, so lookups ignore case
+	CaseInsensitiveKeys bool
+
+	// DataDir, if set, confines the files named in SAVE, LOAD, EXPORTCSV and
+	// IMPORTCSV to that directory; relative names are resolved inside it
+	DataDir string
+
+	// ReadOnly rejects write commands from clients. Replicas are always
+	// read-only while they follow a master.
+	ReadOnly bool
+
+	// MaxMemory caps the estimated memory use of the store in bytes, 0 means
+	// no limit. MaxMemoryPolicy decides what happens once it's reached:
+	// noeviction, lru or lfu.
+	MaxMemory       int
+	MaxMemoryPolicy string
+
+	// MaxKeyBytes and MaxValueBytes cap the size of keys and values a write
+	// may store, 0 means no limit. For collections the value limit applies
+	// to each member, field or document.
+	MaxKeyBytes   int
+	MaxValueBytes int
+
+	// Save holds the auto-save rules, "<seconds> <changes>" pairs such as
+	// "900 1 300 100"; empty disables auto-save
+	Save string
+
+	// PubSubHistory is how many recent messages each channel keeps for
+	// SUBSCRIBE ... REPLAY; 0 keeps none
+	PubSubHistory int
+
+	// ReservedPrefix, if set, stops clients from creating keys that start
+	// with it, e.g. "__" to keep them clear of the keyspace event channels
+	ReservedPrefix string
+
+	// AllowControlChars accepts plain command lines holding control
+	// characters such as NUL, which are otherwise rejected so they don't end
+	// up in keys, logs and snapshots by accident. Framed requests may always
+	// hold any bytes.
+	AllowControlChars bool
+
+	// EnableDebug allows the DEBUG command, which can stall connections and
+	// pause expiry, so it's off unless asked for
+	EnableDebug bool
+
+	// CommandTimeout bounds how long a single command may run; 0 disables
+	// the watchdog
+	CommandTimeout time.Duration
+
+	// IdleTimeout is how long a client may go without sending a command
+	// before it's disconnected; 0 keeps idle clients forever. Subscribers
+	// and replicas are never considered idle.
+	IdleTimeout time.Duration
+
+	// CleanupInterval is how often expired keys are swept from the store
+	CleanupInterval time.Duration
+
+	// ConfigFile holds "<name> <value>" lines for the settings that can
+	// change at runtime; it's read at startup and again on SIGHUP
+	ConfigFile string
+
+	// Aliases holds "ALIAS=COMMAND" definitions, so scripts written against
+	// an old command name keep working
+	Aliases []string
+
+	// ACLFile lists the users clients can AUTH as and the commands each may
+	// run; empty leaves the server open to everyone
+	ACLFile string
+
+	// MasterAuth is the "<user>:<password>" a replica authenticates with
+	// before syncing from a master that has an ACL
+	MasterAuth string
+
+	// LogFile, if set, receives the log instead of stderr and is reopened
+	// on SIGHUP so it can be rotated
+	LogFile string
+
+	// OnEvent, if set, is called when a client connects, authenticates or
+	// disconnects, so embedders can keep an audit trail. LogEvent logs them.
+	OnEvent func(Event)
+
+	// CommandEvents also sends OnEvent an event for every command
+	CommandEvents bool
+}
+
+// DefaultConfig returns the settings used when no flags are given
+func DefaultConfig() Config {
+	return Config{
+		Addr:            Port,
+		MaxRequestBytes: 1 << 20,
+		MaxMemoryPolicy: "noeviction",
+		CommandTimeout:  10 * time.Second,
+		IdleTimeout:     Timeout * time.Second,
+		CleanupInterval: 10 * time.Second,
+	}
+}
+
+var config = DefaultConfig()
@@ -3,23 +3,97 @@ package server
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ConnInfo tracks per-connection activity for CLIENT INFO and INFO
+type ConnInfo struct {
+	mu           sync.RWMutex
+	ID           int64
+	Addr         string
+	ConnectedAt  time.Time
+	LastActive   time.Time
+	LastCommand  string
+	BytesRead    int
+	BytesWritten int
+
+	// user is who the client authenticated as, nil until it does
+	user *aclUser
+
+	// writeMu is held while a reply or a pub/sub push is written, so the two
+	// never interleave
+	writeMu sync.Mutex
+}
+
+// RecordCommand notes a command read from the client
+func (c *ConnInfo) RecordCommand(command string, bytesRead int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.LastCommand = command
+	c.LastActive = time.Now()
+	c.BytesRead += bytesRead
+}
+
+// RecordWrite notes a response sent to the client
+func (c *ConnInfo) RecordWrite(bytesWritten int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.BytesWritten += bytesWritten
+}
+
+func (c *ConnInfo) setUser(user *aclUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user = user
+}
+
+func (c *ConnInfo) authenticatedUser() *aclUser {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.user
+}
+
+// Snapshot returns a copy of the connection's current info
+func (c *ConnInfo) Snapshot() ConnInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return ConnInfo{
+		ID:           c.ID,
+		Addr:         c.Addr,
+		ConnectedAt:  c.ConnectedAt,
+		LastActive:   c.LastActive,
+		LastCommand:  c.LastCommand,
+		BytesRead:    c.BytesRead,
+		BytesWritten: c.BytesWritten,
+	}
+}
+
 type Connections struct {
-	mu    sync.RWMutex
-	conns map[net.Conn]struct{}
+	mu     sync.RWMutex
+	conns  map[net.Conn]*ConnInfo
+	nextID atomic.Int64
 }
 
 func NewConnections() *Connections {
 	return &Connections{
-		conns: make(map[net.Conn]struct{}),
+		conns: make(map[net.Conn]*ConnInfo),
 	}
 }
 
-func (p *Connections) Add(conn net.Conn) {
+func (p *Connections) Add(conn net.Conn) *ConnInfo {
+	now := time.Now()
+	info := &ConnInfo{
+		ID:          p.nextID.Add(1),
+		Addr:        getAddress(conn),
+		ConnectedAt: now,
+		LastActive:  now,
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.conns[conn] = struct{}{}
+	p.conns[conn] = info
+	return info
 }
 
 func (p *Connections) Remove(conn net.Conn) {
@@ -28,6 +102,34 @@ func (p *Connections) Remove(conn net.Conn) {
 	delete(p.conns, conn)
 }
 
+// Info returns the tracked info for conn, or nil if it isn't tracked
+func (p *Connections) Info(conn net.Conn) *ConnInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.conns[conn]
+}
+
+// IdleBuckets counts connections by idle time. Bucket i holds connections
+// idle for less than bounds[i]; the extra last bucket holds the rest.
+func (p *Connections) IdleBuckets(bounds []time.Duration) []int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	counts := make([]int, len(bounds)+1)
+	for _, info := range p.conns {
+		idle := time.Since(info.Snapshot().LastActive)
+		bucket := len(bounds)
+		for i, bound := range bounds {
+			if idle < bound {
+				bucket = i
+				break
+			}
+		}
+		counts[bucket]++
+	}
+	return counts
+}
+
 func (p *Connections) CloseAll() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleDebug provides hooks for testing clients and TTL behaviour. It's
+// only available when the server was started with -enable-debug.
+func handleDebug(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "DEBUG <SLEEP <seconds>|SET-ACTIVE-EXPIRE <0|1>|EXPIRE-SCAN>"
+	if !config.EnableDebug {
+		log.Println("[WARN] Rejected DEBUG, the server wasn't started with -enable-debug")
+		metrics.Inc("ERROR")
+		return replyError(w, DebugDisabled)
+	}
+
+	subcommand := strings.ToUpper(tokens[1])
+	if subcommand == "EXPIRE-SCAN" {
+		if len(tokens) != 2 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("DEBUG", format))
+		}
+
+		removed := kv.ExpireScan()
+		log.Printf("[INFO] DEBUG EXPIRE-SCAN -> %d\n", removed)
+		metrics.Inc("DEBUG")
+		return reply(w, strconv.Itoa(removed))
+	}
+	if len(tokens) != 3 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("DEBUG", format))
+	}
+
+	switch subcommand {
+	case "SLEEP":
+		seconds, err := strconv.ParseFloat(tokens[2], 64)
+		if err != nil || seconds < 0 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("DEBUG", format))
+		}
+
+		log.Printf("[INFO] DEBUG SLEEP %v seconds\n", seconds)
+		timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return abortCommand(ctx, w, "DEBUG SLEEP")
+		}
+		metrics.Inc("DEBUG")
+		return reply(w, OK)
+	case "SET-ACTIVE-EXPIRE":
+		if tokens[2] != "0" && tokens[2] != "1" {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("DEBUG", format))
+		}
+
+		enabled := tokens[2] == "1"
+		kv.SetActiveExpire(enabled)
+		log.Printf("[INFO] DEBUG SET-ACTIVE-EXPIRE -> %t\n", enabled)
+		metrics.Inc("DEBUG")
+		return reply(w, OK)
+	default:
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("DEBUG", format))
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Commands that only make sense on a client's own connection, so Execute
+// rejects them
+var embedDenied = map[string]bool{
+	SubscribeCommand:   true,
+	UnsubscribeCommand: true,
+	AuthCommand:        true,
+	ClientCommand:      true,
+	QuitCommand:        true,
+	SyncCommand:        true,
+	ShutDownCommand:    true,
+}
+
+// Embed sets up the store with cfg for use through Execute, without
+// listening for clients. The snapshot in data.txt is loaded before it
+// returns and the -save rules apply. Listener, HTTP gateway, log file, ACL
+// and config file settings are ignored, and there are no signal handlers:
+// run SAVE before exiting to keep the data. Call it once, and not alongside
+// StartServer.
+func Embed(cfg Config) error {
+	config = cfg
+	savePoints, err := configureStore()
+	if err != nil {
+		return err
+	}
+	loadSnapshot(savePoints)
+	return nil
+}
+
+// Execute runs the command in line, plain or framed like a request on the
+// wire, through the same checks and handlers as a client's and returns the
+// response without its END terminator
+func Execute(line string) string {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	tokens, _, err := readRequest(bufio.NewReader(strings.NewReader(line)), config.MaxRequestBytes)
+	if err != nil {
+		metrics.Inc("ERROR")
+		if protoErr, ok := err.(protocolError); ok {
+			return protoErr.Error()
+		}
+		switch err {
+		case errRequestTooLarge:
+			return RequestTooLarge
+		case errInvalidCharacters:
+			return InvalidCharacters
+		}
+		return newProtocolError("incomplete request").Error()
+	}
+
+	if len(tokens) > 0 && embedDenied[commandName(tokens[0])] {
+		log.Printf("[WARN] Rejected embedded %s\n", strings.ToUpper(tokens[0]))
+		metrics.Inc("ERROR")
+		return fmt.Sprintf(NeedsConnection, commandName(tokens[0]))
+	}
+
+	var response bytes.Buffer
+	ctx := context.Background()
+	if isBlockingCommand(tokens) {
+		// Blocking commands bound their own wait and skip the watchdog
+		err = processCommand(ctx, &response, tokens, nil)
+	} else {
+		err = runCommand(ctx, &response, tokens, nil)
+	}
+	if err != nil && err != errRejected {
+		log.Printf("[ERROR] Embedded %v failed: %v\n", tokens, err)
+	}
+	return response.String()
+}
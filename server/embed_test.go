@@ -0,0 +1,26 @@
+package server
+
+import "testing"
+
+func TestExecute(t *testing.T) {
+	resetServer(t)
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"SETEX k v 100", OK},
+		{"TTL k", "99"},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3\r\na b\r\n", OK},
+		{"GET k", "a b"},
+		{"SETVER n v 0", "3"},
+		{"SETVER n w 0", NilReply},
+		{"SUBSCRIBE ch", "ERROR: SUBSCRIBE needs a client connection"},
+		{"*2\r\n$3\r\nGET", "ERROR: Protocol error: incomplete request"},
+	}
+	for _, test := range tests {
+		if got := Execute(test.line); got != test.want {
+			t.Errorf("Execute(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A script for EVAL is a list of the store's own commands, separated by ';'
+// or newlines, run one after another with nothing else running in between.
+// Words within a command are separated by whitespace or commas, so a script
+// fits in a single argument on a plain command line:
+//
+//	EVAL SETVER,KEYS[1],ARGV[1],0;GET,KEYS[1] 1 greeting hello
+//
+// A word reading KEYS[i] or ARGV[i] is replaced by the i-th key or argument
+// given to EVAL, counting from 1; nothing else is substituted, so values with
+// spaces or commas have to be passed that way. There are no conditionals or
+// loops. The reply is the last command's reply. The script stops at the
+// first command that replies with an error and EVAL replies with that error;
+// writes made before it are kept.
+
+// scriptLock makes scripts atomic: every command dispatched through
+// callHandler, whether it came from a client, the HTTP gateway or a master,
+// holds it shared while it runs, and so does memory eviction. EVAL holds it
+// exclusively. Blocking and streaming commands don't take it, they could
+// hold up every script for as long as they run.
+var scriptLock sync.RWMutex
+
+// Commands a script can't run, besides the admin, blocking and streaming ones
+var scriptDenied = map[string]bool{
+	EvalCommand:        true,
+	SubscribeCommand:   true,
+	UnsubscribeCommand: true,
+	QuitCommand:        true,
+	AuthCommand:        true,
+	ClientCommand:      true,
+	HealthCommand:      true,
+}
+
+// callHandler runs spec's handler holding scriptLock shared
+func callHandler(ctx context.Context, spec *commandSpec, w io.Writer, tokens []string, conn net.Conn) error {
+	if spec.name != EvalCommand && !blockingCommands[spec.name] && !streamingCommands[spec.name] {
+		scriptLock.RLock()
+		defer scriptLock.RUnlock()
+	}
+	return spec.handler(ctx, w, tokens, conn)
+}
+
+// scriptCommand is one command of a parsed script
+type scriptCommand struct {
+	spec   *commandSpec
+	tokens []string
+}
+
+// parseScript splits script into commands and substitutes KEYS[i] and
+// ARGV[i]. It returns the error to reply with if the script is invalid.
+func parseScript(script string, keys []string, args []string, conn net.Conn) ([]scriptCommand, string) {
+	var commands []scriptCommand
+	lines := strings.FieldsFunc(script, func(r rune) bool { return r == ';' || r == '\n' })
+	for _, line := range lines {
+		words := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\r' })
+		if len(words) == 0 {
+			continue
+		}
+
+		for i, word := range words {
+			value, ok, problem := substitute(word, keys, args)
+			if problem != "" {
+				return nil, problem
+			}
+			if ok {
+				words[i] = value
+			}
+		}
+
+		spec, problem := lookupCommand(words)
+		if spec == nil {
+			return nil, problem
+		}
+		if scriptDenied[spec.name] || adminCommands[spec.name] || blockingCommands[spec.name] || streamingCommands[spec.name] {
+			return nil, fmt.Sprintf("ERROR: %s can't be used in a script", spec.name)
+		}
+		if problem := checkPermission(spec.name, conn); problem != "" {
+			return nil, problem
+		}
+		if !strings.EqualFold(words[0], spec.name) {
+			words[0] = spec.name
+		}
+		commands = append(commands, scriptCommand{spec: spec, tokens: words})
+	}
+
+	if len(commands) == 0 {
+		return nil, "ERROR: script has no commands"
+	}
+	return commands, ""
+}
+
+// substitute returns the key or argument word refers to, if it's KEYS[i] or
+// ARGV[i]
+func substitute(word string, keys []string, args []string) (string, bool, string) {
+	for name, values := range map[string][]string{"KEYS": keys, "ARGV": args} {
+		inner, ok := strings.CutPrefix(word, name+"[")
+		if !ok {
+			continue
+		}
+		inner, ok = strings.CutSuffix(inner, "]")
+		if !ok {
+			continue
+		}
+		i, err := strconv.Atoi(inner)
+		if err != nil || i < 1 || i > len(values) {
+			return "", false, fmt.Sprintf("ERROR: script refers to %s, out of range for the %d given", word, len(values))
+		}
+		return values[i-1], true, ""
+	}
+	return "", false, ""
+}
+
+// handleEval runs a script atomically. It takes the replication lock itself
+// and forwards the writes the script made, rather than the script, so
+// replicas end up with the same data even where rerunning it wouldn't.
+func handleEval(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	const format = "EVAL <script> <numkeys> [<key> ...] [<arg> ...]"
+	if len(tokens) < 3 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("EVAL", format))
+	}
+	numKeys, err := strconv.Atoi(tokens[2])
+	if err != nil || numKeys < 0 || numKeys > len(tokens)-3 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("EVAL", format))
+	}
+	keys, args := tokens[3:3+numKeys], tokens[3+numKeys:]
+
+	commands, problem := parseScript(tokens[1], keys, args, conn)
+	if problem != "" {
+		metrics.Inc("ERROR")
+		return replyError(w, problem)
+	}
+	for _, command := range commands {
+		if key, reserved := reservedKey(command.spec.name, command.tokens); reserved {
+			rejectReservedKey(command.spec.name, key)
+			return replyError(w, ReservedKeyPrefix)
+		}
+	}
+
+	var result bytes.Buffer
+	err = replication.WriteScript(func() ([][]string, error) {
+		scriptLock.Lock()
+		defer scriptLock.Unlock()
+
+		var writes [][]string
+		for i, command := range commands {
+			result.Reset()
+			err := command.spec.handler(ctx, &result, command.tokens, conn)
+			if partial, ok := err.(*partialWrite); ok {
+				writes = append(writes, partial.tokens)
+				err = errRejected
+			}
+			if err == errRejected {
+				log.Printf("[WARN] EVAL stopped at command %d (%s): %s\n", i+1, command.spec.name, result.String())
+				break
+			}
+			if err != nil && err != errNotApplied {
+				return writes, err
+			}
+			if command.spec.write && err == nil {
+				writes = append(writes, replicatedCommand(command.spec.name, command.tokens))
+			}
+		}
+		return writes, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] EVAL ran %d commands\n", len(commands))
+	metrics.Inc("EVAL")
+	return reply(w, result.String())
+}
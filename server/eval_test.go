@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+func TestEvalReturnsLastReply(t *testing.T) {
+	resetServer(t)
+
+	got := run(t, "EVAL", "SET,KEYS[1],ARGV[1];GET,KEYS[1]", "1", "greeting", "hello")
+	if got != "hello" {
+		t.Fatalf("EVAL = %q, want %q", got, "hello")
+	}
+}
+
+func TestEvalStopsAtRejectedWrite(t *testing.T) {
+	resetServer(t)
+	kv.SetMaxSizes(0, 3)
+
+	got := run(t, "EVAL", "SET a toolong;SET b ok", "0")
+	if got != kvstore.ValueTooLarge {
+		t.Fatalf("EVAL = %q, want %q", got, kvstore.ValueTooLarge)
+	}
+	if kv.Contains("b") {
+		t.Fatal("the command after the rejected write ran")
+	}
+}
+
+func TestHTTPWriteWaitsForScript(t *testing.T) {
+	resetServer(t)
+
+	// Hold the lock the way a running script does
+	scriptLock.Lock()
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		handleHTTPKey(rec, httptest.NewRequest(http.MethodPut, "/keys/k", strings.NewReader("v")))
+		done <- rec.Code
+	}()
+
+	select {
+	case <-done:
+		scriptLock.Unlock()
+		t.Fatal("HTTP PUT ran while a script was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	scriptLock.Unlock()
+
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("HTTP PUT status = %d, want %d", code, http.StatusOK)
+	}
+	if got := run(t, "GET", "k"); got != "v" {
+		t.Fatalf("GET k = %q, want %q", got, "v")
+	}
+}
+
+func TestEvalReplicatesOnlyAppliedWrites(t *testing.T) {
+	resetServer(t)
+	kv.SetMaxSizes(0, 3)
+	replica := addTestReplica(t)
+
+	lines := make(chan []string, 1)
+	go func() {
+		var received []string
+		for {
+			line, err := replica.ReadString('\n')
+			if err != nil {
+				lines <- received
+				return
+			}
+			received = append(received, line)
+		}
+	}()
+	run(t, "EVAL", "SET a ok;SET b toolong;SET c ok", "0")
+	replication.mu.Lock()
+	for conn := range replication.replicas {
+		conn.Close()
+	}
+	replication.mu.Unlock()
+
+	if got := <-lines; len(got) != 1 || got[0] != "SET a ok\n" {
+		t.Fatalf("replica got %q, want only the first SET", got)
+	}
+}
+
+func TestEvalContinuesPastErrorLikeValue(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "k", "ERROR:stored")
+
+	if got := run(t, "EVAL", "GET k;SET b ok;GET b", "0"); got != "ok" {
+		t.Fatalf("EVAL = %q, want %q", got, "ok")
+	}
+	if got := run(t, "EVAL", "GET missing;SET c ok", "0"); got != kvstore.KeyNotFound {
+		t.Fatalf("EVAL = %q, want %q", got, kvstore.KeyNotFound)
+	}
+	if kv.Contains("c") {
+		t.Fatal("the script went on after GET failed")
+	}
+}
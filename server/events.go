@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// EventType says what happened to a client connection
+type EventType string
+
+const (
+	EventConnect    EventType = "connect"
+	EventDisconnect EventType = "disconnect"
+	EventAuth       EventType = "auth"
+	EventAuthFailed EventType = "auth-failed"
+	// EventCommand is only sent when Config.CommandEvents is set
+	EventCommand EventType = "command"
+)
+
+// Event describes something that happened to a client connection, for
+// Config.OnEvent
+type Event struct {
+	Type     EventType
+	ClientID int64
+	Addr     string
+	Time     time.Time
+
+	// User is the name given to AUTH, for auth events
+	User string
+
+	// Command is the name of the command run, for command events. Arguments
+	// are left out so passwords and values don't end up in audit trails.
+	Command string
+}
+
+// LogEvent is an OnEvent handler that writes each event to the log
+func LogEvent(event Event) {
+	line := "[INFO] Event " + string(event.Type)
+	if event.User != "" {
+		line += " user=" + event.User
+	}
+	if event.Command != "" {
+		line += " command=" + event.Command
+	}
+	log.Printf("%s client=%d addr=%s\n", line, event.ClientID, event.Addr)
+}
+
+// emitEvent passes an event about the connection info to Config.OnEvent,
+// if one is set. It runs on the connection's goroutine, so a slow handler
+// slows that client down.
+func emitEvent(eventType EventType, info *ConnInfo, fill func(*Event)) {
+	if config.OnEvent == nil || info == nil {
+		return
+	}
+	event := Event{
+		Type:     eventType,
+		ClientID: info.ID,
+		Addr:     info.Addr,
+		Time:     time.Now(),
+	}
+	if fill != nil {
+		fill(&event)
+	}
+	config.OnEvent(event)
+}
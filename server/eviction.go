@@ -0,0 +1,46 @@
+package server
+
+import "log"
+
+// Channel that gets a message with the key name whenever a key is evicted
+const EvictedChannel = "__keyevent__:evicted"
+
+// Write commands that only free memory, so they still run when the store is
+// over -maxmemory
+var memoryFreeingCommands = map[string]bool{
+	DeleteCommand:   true,
+	DelCommand:      true,
+	FlushCommand:    true,
+	FlushDBCommand:  true,
+	FlushAllCommand: true,
+}
+
+// enforceMemoryLimit makes room before the write command cmd runs, evicting
+// keys according to -maxmemory-policy. It returns an error if the write has
+// to be rejected instead. Evicted keys are deleted on replicas too, counted
+// in metrics and published to EvictedChannel.
+func enforceMemoryLimit(cmd string) error {
+	if config.MaxMemory <= 0 || memoryFreeingCommands[cmd] {
+		return nil
+	}
+
+	var evicted []string
+	err := replication.Evict(func() ([]string, error) {
+		// Scripts mustn't lose keys partway through
+		scriptLock.RLock()
+		defer scriptLock.RUnlock()
+		var err error
+		evicted, err = kv.EnforceMemoryLimit()
+		return evicted, err
+	})
+	if len(evicted) == 0 {
+		return err
+	}
+
+	log.Printf("[INFO] Evicted %d keys to stay under %d bytes\n", len(evicted), config.MaxMemory)
+	metrics.AddEvictedKeys(len(evicted))
+	for _, key := range evicted {
+		pubsub.Publish(EvictedChannel, key)
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/petariliev/kvstore/protocol"
+)
+
+// Frames are escaped as described in the protocol package, which clients
+// share to read them.
+
+// needsEscape reports whether line would read as END or PUSH, or as an
+// escaped one
+func needsEscape(line []byte) bool {
+	return protocol.IsReservedLine(string(bytes.TrimLeft(line, `\`)))
+}
+
+// couldNeedEscape reports whether a line starting with prefix might still
+// turn out to need escaping
+func couldNeedEscape(prefix []byte) bool {
+	rest := string(bytes.TrimLeft(prefix, `\`))
+	return strings.HasPrefix(protocol.ResponseTerminator, rest) || strings.HasPrefix(protocol.PushMarker, rest)
+}
+
+// formatPush builds the frame that delivers message from channel
+func formatPush(channel string, message string) string {
+	return protocol.PushMarker + "\nmessage " + strconv.Quote(channel) + "\n" + escapeTerminators(message) + "\n" + protocol.ResponseTerminator + "\n"
+}
+
+// terminatorEscaper escapes the response lines written through it that
+// would otherwise read as END or PUSH. Lines can arrive split across
+// writes, so the start of each line is held back until it's clear whether
+// it needs escaping; finish writes out whatever is held back at the end of
+// the response.
+type terminatorEscaper struct {
+	w io.Writer
+
+	// Start of the current line, held back while it could still need
+	// escaping. passing is set once it can't, for the rest of the line.
+	pending []byte
+	passing bool
+}
+
+func (e *terminatorEscaper) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); {
+		if e.passing {
+			end := bytes.IndexByte(p[i:], '\n')
+			if end < 0 {
+				if _, err := e.w.Write(p[i:]); err != nil {
+					return i, err
+				}
+				return len(p), nil
+			}
+			if _, err := e.w.Write(p[i : i+end+1]); err != nil {
+				return i, err
+			}
+			i += end + 1
+			e.passing = false
+			continue
+		}
+
+		if p[i] == '\n' {
+			if err := e.finish(); err != nil {
+				return i, err
+			}
+			if _, err := e.w.Write(p[i : i+1]); err != nil {
+				return i, err
+			}
+			i++
+			continue
+		}
+
+		e.pending = append(e.pending, p[i])
+		i++
+		if !couldNeedEscape(e.pending) {
+			if _, err := e.w.Write(e.pending); err != nil {
+				return i, err
+			}
+			e.pending = e.pending[:0]
+			e.passing = true
+		}
+	}
+	return len(p), nil
+}
+
+// finish ends the current line, writing out any part of it still held back
+func (e *terminatorEscaper) finish() error {
+	e.passing = false
+	if len(e.pending) == 0 {
+		return nil
+	}
+	if needsEscape(e.pending) {
+		if _, err := io.WriteString(e.w, `\`); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write(e.pending)
+	e.pending = e.pending[:0]
+	return err
+}
+
+// replyLock holds a connection's write lock from the first byte of a reply
+// until release, so a pub/sub push can't land in the middle of it. The lock
+// is only taken once there's something to write, so a command that blocks
+// before replying doesn't hold up deliveries.
+type replyLock struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	locked bool
+}
+
+func (l *replyLock) Write(p []byte) (int, error) {
+	if !l.locked {
+		l.mu.Lock()
+		l.locked = true
+	}
+	return l.w.Write(p)
+}
+
+func (l *replyLock) release() {
+	if l.locked {
+		l.mu.Unlock()
+		l.locked = false
+	}
+}
+
+// escapeTerminators escapes the lines of s that would read as END or PUSH
+func escapeTerminators(s string) string {
+	var sb strings.Builder
+	escaper := &terminatorEscaper{w: &sb}
+	io.WriteString(escaper, s)
+	escaper.finish()
+	return sb.String()
+}
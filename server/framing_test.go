@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/petariliev/kvstore/protocol"
+)
+
+// connect serves a connection over a pipe and returns the client's end
+func connect(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(serverConn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		<-done
+	})
+	return clientConn, bufio.NewReader(clientConn)
+}
+
+// roundTrip sends line and reads back one frame, decoded the way clients do
+func roundTrip(t *testing.T, conn net.Conn, reader *bufio.Reader, line string) string {
+	t.Helper()
+	if _, err := io.WriteString(conn, line); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		content, end := protocol.ParseResponseLine(strings.TrimSuffix(line, "\n"))
+		if end {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, content)
+	}
+}
+
+func TestTerminatorAsValue(t *testing.T) {
+	resetServer(t)
+	conn, reader := connect(t)
+
+	for _, value := range []string{"END", `\END`, "PUSH", `\\PUSH`, "ENDING"} {
+		if got := roundTrip(t, conn, reader, "SET k "+value+"\n"); got != OK {
+			t.Fatalf("SET %s = %q, want %q", value, got, OK)
+		}
+		if got := roundTrip(t, conn, reader, "GET k\n"); got != value {
+			t.Fatalf("GET = %q, want %q", got, value)
+		}
+	}
+
+	// A line reading END inside a multi-line value doesn't end the frame
+	value := "first\nEND\nlast"
+	if got := roundTrip(t, conn, reader, formatRequest([]string{"SET", "k", value})); got != OK {
+		t.Fatalf("framed SET = %q, want %q", got, OK)
+	}
+	if got := roundTrip(t, conn, reader, "GET k\n"); got != value {
+		t.Fatalf("GET = %q, want %q", got, value)
+	}
+
+	roundTrip(t, conn, reader, "SET a END\n")
+	roundTrip(t, conn, reader, "SET b after\n")
+	if got, want := roundTrip(t, conn, reader, "MGET a b\n"), `"END"`+"\n"+`"after"`; got != want {
+		t.Fatalf("MGET = %q, want %q", got, want)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	resetServer(t)
+	conn, reader := connect(t)
+
+	if got := roundTrip(t, conn, reader, "SET k \"\"\n"); got != OK {
+		t.Fatalf(`SET k "" = %q, want %q`, got, OK)
+	}
+
+	// An empty value is an empty line before END, unlike a missing key
+	if _, err := io.WriteString(conn, "GET k\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\n", "END\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != want {
+			t.Fatalf("GET k sent %q, %v, want %q", line, err, want)
+		}
+	}
+	if got := roundTrip(t, conn, reader, "GET missing\n"); got == "" {
+		t.Fatal("GET of a missing key looks like an empty value")
+	}
+
+	if got := roundTrip(t, conn, reader, "MGET k missing\n"); got != `""`+"\n"+NilReply {
+		t.Fatalf("MGET = %q, want %q", got, `""`+"\n"+NilReply)
+	}
+	if got := roundTrip(t, conn, reader, "*3\r\n$3\r\nSET\r\n$1\r\nf\r\n$0\r\n\r\n"); got != OK {
+		t.Fatalf("framed SET = %q, want %q", got, OK)
+	}
+	if got := roundTrip(t, conn, reader, "KEYEXISTS f\n"); got != "1" {
+		t.Fatalf("KEYEXISTS f = %q, want %q", got, "1")
+	}
+}
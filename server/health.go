@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+const healthPath = "/healthz"
+
+// serverState is where the server is in its lifecycle. It starts out
+// loading the snapshot, is ready once that's done and drains once shutdown
+// starts.
+type serverState int32
+
+const (
+	stateLoading serverState = iota
+	stateReady
+	stateDraining
+)
+
+func (s serverState) String() string {
+	switch s {
+	case stateLoading:
+		return "LOADING"
+	case stateReady:
+		return "OK"
+	default:
+		return "DRAINING"
+	}
+}
+
+var state atomic.Int32
+
+func currentState() serverState {
+	return serverState(state.Load())
+}
+
+// markReady moves the server out of stateLoading, unless shutdown already
+// started
+func markReady() {
+	state.CompareAndSwap(int32(stateLoading), int32(stateReady))
+}
+
+// startDraining moves the server to stateDraining and returns the state it
+// was in
+func startDraining() serverState {
+	return serverState(state.Swap(int32(stateDraining)))
+}
+
+// Commands that still run while the snapshot is loading. Everything else
+// would see a partial keyspace.
+var loadingCommands = map[string]bool{
+	HealthCommand: true,
+	PingCommand:   true,
+	InfoCommand:   true,
+}
+
+func handleHealth(ctx context.Context, w io.Writer, tokens []string) error {
+	metrics.Inc("HEALTH")
+	return reply(w, currentState().String())
+}
+
+// handleHTTPHealth answers 200 once the server is ready and 503 while it's
+// loading or draining, so load balancers only route to a ready server
+func handleHTTPHealth(w http.ResponseWriter, r *http.Request) {
+	current := currentState()
+	status := http.StatusOK
+	if current != stateReady {
+		status = http.StatusServiceUnavailable
+	}
+
+	metrics.Inc("HEALTH")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	if _, err := io.WriteString(w, current.String()+"\n"); err != nil {
+		log.Printf("[ERROR] Failed to write HTTP response: %v\n", err)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+const keysPath = "/keys/"
+
+var httpServer *http.Server
+
+type httpResponse struct {
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	TTL   int    `json:"ttl,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// startHTTPGateway serves the REST API on addr in the background
+func startHTTPGateway(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(keysPath, handleHTTPKey)
+	mux.HandleFunc(healthPath, handleHTTPHealth)
+	httpServer = &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		log.Printf("[INFO] HTTP gateway is listening on %s...\n", addr)
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] HTTP gateway stopped: %v\n", err)
+		}
+	}()
+}
+
+func stopHTTPGateway() {
+	if httpServer == nil {
+		return
+	}
+	log.Println("[INFO] Stopping HTTP gateway...")
+	httpServer.Close()
+}
+
+func handleHTTPKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPath)
+	if key == "" || strings.Contains(key, "/") {
+		metrics.Inc("ERROR")
+		writeJSON(w, http.StatusBadRequest, httpResponse{Error: "invalid key"})
+		return
+	}
+
+	var tokens []string
+	switch r.Method {
+	case http.MethodGet:
+		tokens = []string{GetCommand, key}
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			metrics.Inc("ERROR")
+			writeJSON(w, http.StatusBadRequest, httpResponse{Error: err.Error()})
+			return
+		}
+		tokens = []string{SetCommand, key, string(body)}
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			tokens = []string{SetexCommand, key, string(body), ttl}
+		}
+	case http.MethodDelete:
+		tokens = []string{DeleteCommand, key}
+	default:
+		metrics.Inc("ERROR")
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, httpResponse{Error: "method not allowed"})
+		return
+	}
+
+	if status, problem := checkHTTPPermission(r, tokens[0]); problem != "" {
+		metrics.Inc("ERROR")
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kvstore"`)
+		}
+		writeJSON(w, status, httpResponse{Key: key, Error: problem})
+		return
+	}
+
+	// The same dispatch as the line protocol, so every check a client's
+	// command goes through applies here too
+	var response strings.Builder
+	err := runCommand(r.Context(), &response, tokens, nil)
+	if err != nil && err != errRejected {
+		log.Printf("[ERROR] HTTP %s %s failed: %v\n", r.Method, key, err)
+		writeJSON(w, http.StatusInternalServerError, httpResponse{Key: key, Error: err.Error()})
+		return
+	}
+	result := response.String()
+
+	// Only a rejected command's reply is an error, a stored value may look
+	// like one
+	if err == errRejected {
+		writeJSON(w, httpErrorStatus(result), httpResponse{Key: key, Error: result})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, httpResponse{Key: key, Value: result})
+	case http.MethodPut:
+		ttl := 0
+		if len(tokens) > 3 {
+			ttl, _ = strconv.Atoi(tokens[3])
+		}
+		writeJSON(w, http.StatusOK, httpResponse{Key: key, Value: tokens[2], TTL: ttl})
+	case http.MethodDelete:
+		if result == "0" {
+			writeJSON(w, http.StatusNotFound, httpResponse{Key: key, Error: kvstore.KeyNotFound})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// httpErrorStatus maps the reply of a command the dispatch rejected to an
+// HTTP status
+func httpErrorStatus(result string) int {
+	switch result {
+	case kvstore.KeyNotFound:
+		return http.StatusNotFound
+	case kvstore.WrongType:
+		return http.StatusConflict
+	case LoadingDataset, ShuttingDown:
+		return http.StatusServiceUnavailable
+	case ReadOnlyReplica, ReservedKeyPrefix:
+		return http.StatusForbidden
+	case kvstore.OutOfMemory:
+		return http.StatusInsufficientStorage
+	case kvstore.KeyTooLarge, kvstore.ValueTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case CommandTimedOut:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadRequest
+}
+
+// checkHTTPPermission authenticates r with basic auth against the ACL and
+// checks its user may run cmd. It returns the status and error to respond
+// with, or "" if the request may go ahead.
+func checkHTTPPermission(r *http.Request, cmd string) (int, string) {
+	if acl == nil {
+		return 0, ""
+	}
+
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return http.StatusUnauthorized, NoAuth
+	}
+	user, ok := acl.authenticate(name, password)
+	if !ok {
+		log.Printf("[WARN] Failed HTTP auth as %s from %s\n", name, r.RemoteAddr)
+		return http.StatusUnauthorized, WrongPassword
+	}
+	if problem := userPermission(user, cmd); problem != "" {
+		return http.StatusForbidden, problem
+	}
+	return 0, ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, response httpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("[ERROR] Failed to write HTTP response: %v\n", err)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+func TestHTTPGetStatus(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "error-like", "ERROR: stored value")
+	run(t, "SET", "not-found-like", kvstore.KeyNotFound)
+	run(t, "ZADD", "zset", "1", "member")
+
+	tests := []struct {
+		key        string
+		wantStatus int
+		wantValue  string
+	}{
+		{"error-like", http.StatusOK, "ERROR: stored value"},
+		{"not-found-like", http.StatusOK, kvstore.KeyNotFound},
+		{"missing", http.StatusNotFound, ""},
+		{"zset", http.StatusConflict, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handleHTTPKey(recorder, httptest.NewRequest(http.MethodGet, keysPath+test.key, nil))
+
+		var body httpResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+			t.Fatalf("GET %s: %v", test.key, err)
+		}
+		if recorder.Code != test.wantStatus || body.Value != test.wantValue {
+			t.Fatalf("GET %s = %d %+v, want %d with value %q", test.key, recorder.Code, body, test.wantStatus, test.wantValue)
+		}
+	}
+}
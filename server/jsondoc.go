@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// handleJSONSet stores a JSON value at a path. Plain command lines are split
+// on whitespace, so the value is joined back together with single spaces.
+func handleJSONSet(ctx context.Context, w io.Writer, tokens []string) error {
+	key, path := tokens[1], tokens[2]
+	document := strings.Join(tokens[3:], " ")
+	if err := kv.JSONSet(key, path, document); err != nil {
+		log.Printf("[WARN] JSON.SET %s %s -> %v\n", key, path, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] JSON.SET %s %s\n", key, path)
+	metrics.Inc("JSON.SET")
+	return reply(w, OK)
+}
+
+func handleJSONGet(ctx context.Context, w io.Writer, tokens []string) error {
+	key, path := tokens[1], "$"
+	if len(tokens) > 2 {
+		path = tokens[2]
+	}
+
+	value, exists, err := kv.JSONGet(key, path)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	metrics.Inc("JSON.GET")
+	if !exists {
+		return reply(w, NilReply)
+	}
+	return reply(w, value)
+}
+
+func handleJSONDel(ctx context.Context, w io.Writer, tokens []string) error {
+	key, path := tokens[1], tokens[2]
+	deleted, err := kv.JSONDel(key, path)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] JSON.DEL %s %s -> %d deleted\n", key, path, deleted)
+	metrics.Inc("JSON.DEL")
+	return reply(w, strconv.Itoa(deleted))
+}
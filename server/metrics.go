@@ -9,6 +9,13 @@ type Metrics struct {
 	mu            sync.RWMutex
 	ActiveClients int
 	CommandCounts map[string]int
+
+	// EvictedKeys counts keys removed to stay under -maxmemory
+	EvictedKeys int
+
+	// ExpiredKeys counts keys removed because their TTL ran out, on access
+	// or by the cleanup
+	ExpiredKeys int
 }
 
 // NewMetrics creates and initializes the Metrics struct
@@ -69,6 +76,33 @@ func (m *Metrics) DecActiveClients() {
 	m.mu.Unlock()
 }
 
+// AddEvictedKeys safely adds n to EvictedKeys
+func (m *Metrics) AddEvictedKeys(n int) {
+	m.mu.Lock()
+	m.EvictedKeys += n
+	m.mu.Unlock()
+}
+
+// AddExpiredKeys safely adds n to ExpiredKeys
+func (m *Metrics) AddExpiredKeys(n int) {
+	m.mu.Lock()
+	m.ExpiredKeys += n
+	m.mu.Unlock()
+}
+
+// Reset zeroes the command counters, EvictedKeys and ExpiredKeys, leaving ActiveClients
+// untouched, and returns the command counts from before the reset
+func (m *Metrics) Reset() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.CommandCounts
+	m.CommandCounts = make(map[string]int)
+	m.EvictedKeys = 0
+	m.ExpiredKeys = 0
+	return previous
+}
+
 // Snapshot returns a copy of the current metrics
 func (m *Metrics) Snapshot() Metrics {
 	m.mu.RLock()
@@ -83,5 +117,7 @@ func (m *Metrics) Snapshot() Metrics {
 	return Metrics{
 		ActiveClients: m.ActiveClients,
 		CommandCounts: countsCopy,
+		EvictedKeys:   m.EvictedKeys,
+		ExpiredKeys:   m.ExpiredKeys,
 	}
 }
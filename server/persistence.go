@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long auto-save waits after a failed save before trying again
+const saveRetryDelay = 5 * time.Second
+
+// dirty counts the writes applied since FileName was last saved, lastSave
+// is when that was in Unix seconds. They drive the -save rules.
+var dirty atomic.Int64
+var lastSave atomic.Int64
+
+// bgSaving is set while a background save runs, lastSaveFailure holds the
+// Unix time of the last background save that failed
+var bgSaving atomic.Bool
+var lastSaveFailure atomic.Int64
+
+// savePoint is one -save rule: save once at least changes writes have been
+// applied and seconds have passed since the last save
+type savePoint struct {
+	seconds int64
+	changes int64
+}
+
+// parseSavePoints parses -save rules, given as "<seconds> <changes>" pairs
+// separated by spaces, e.g. "900 1 300 100" saves after 900 seconds if at
+// least 1 key changed, or after 300 seconds if at least 100 did. An empty
+// spec disables auto-save.
+func parseSavePoints(spec string) ([]savePoint, error) {
+	fields := strings.Fields(spec)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save rules must be <seconds> <changes> pairs, got %q", spec)
+	}
+
+	points := make([]savePoint, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid save rule seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, fmt.Errorf("invalid save rule changes %q", fields[i+1])
+		}
+		points = append(points, savePoint{seconds: seconds, changes: changes})
+	}
+	return points, nil
+}
+
+// dueSavePoint returns the first rule that calls for a save at now
+func dueSavePoint(points []savePoint, now time.Time) (savePoint, bool) {
+	if now.Unix()-lastSaveFailure.Load() < int64(saveRetryDelay/time.Second) {
+		return savePoint{}, false
+	}
+
+	changes := dirty.Load()
+	elapsed := now.Unix() - lastSave.Load()
+	for _, point := range points {
+		if changes >= point.changes && elapsed >= point.seconds {
+			return point, true
+		}
+	}
+	return savePoint{}, false
+}
+
+// scheduleAutoSave checks the save rules every second and starts a
+// background save when one fires, until done is closed
+func scheduleAutoSave(points []savePoint, done <-chan struct{}) {
+	log.Printf("[INFO] Auto-save rules: %s\n", config.Save)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				point, due := dueSavePoint(points, now)
+				if due {
+					backgroundSave(fmt.Sprintf("%d changes in %d seconds", point.changes, point.seconds))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// saveTo writes the store to fileName. Saving FileName resets the dirty
+// counter, except for writes applied while the save was running.
+func saveTo(fileName string) error {
+	changes := dirty.Load()
+	if err := kv.SaveToDisk(fileName); err != nil {
+		return err
+	}
+	if fileName == FileName {
+		dirty.Add(-changes)
+		lastSave.Store(time.Now().Unix())
+	}
+	return nil
+}
+
+// backgroundSave saves FileName in a goroutine, unless a background save is
+// already running, and reports whether it started one
+func backgroundSave(reason string) bool {
+	if !bgSaving.CompareAndSwap(false, true) {
+		return false
+	}
+
+	log.Printf("[INFO] Background save started: %s\n", reason)
+	go func() {
+		defer bgSaving.Store(false)
+		if err := saveTo(FileName); err != nil {
+			log.Printf("[ERROR] Background save failed: %v\n", err)
+			lastSaveFailure.Store(time.Now().Unix())
+			return
+		}
+		log.Println("[INFO] Background save finished")
+	}()
+	return true
+}
+
+func handleBgSave(ctx context.Context, w io.Writer, tokens []string) error {
+	if !backgroundSave("BGSAVE") {
+		metrics.Inc("ERROR")
+		return replyError(w, BackgroundSaveRunning)
+	}
+	metrics.Inc("BGSAVE")
+	return reply(w, "Background saving started")
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// resetSaveState clears the dirty counter and save times for a test
+func resetSaveState(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		dirty.Store(0)
+		lastSave.Store(0)
+		lastSaveFailure.Store(0)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestSavePointFiring(t *testing.T) {
+	points, err := parseSavePoints("900 1 300 100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		changes   int64
+		sinceSave time.Duration
+		failedAgo time.Duration
+		want      savePoint
+		wantDue   bool
+	}{
+		{"no changes", 0, time.Hour, time.Hour, savePoint{}, false},
+		{"too soon for either rule", 500, 200 * time.Second, time.Hour, savePoint{}, false},
+		{"enough changes for the short rule", 100, 300 * time.Second, time.Hour, savePoint{300, 100}, true},
+		{"too few changes for the short rule", 99, 300 * time.Second, time.Hour, savePoint{}, false},
+		{"one change after the long wait", 1, 900 * time.Second, time.Hour, savePoint{900, 1}, true},
+		{"retrying too soon after a failure", 100, time.Hour, time.Second, savePoint{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetSaveState(t)
+			dirty.Store(test.changes)
+			lastSave.Store(now.Add(-test.sinceSave).Unix())
+			lastSaveFailure.Store(now.Add(-test.failedAgo).Unix())
+
+			point, due := dueSavePoint(points, now)
+			if due != test.wantDue || point != test.want {
+				t.Fatalf("dueSavePoint = %v, %v, want %v, %v", point, due, test.want, test.wantDue)
+			}
+		})
+	}
+}
+
+func TestSaveResetsDirtyCounter(t *testing.T) {
+	resetServer(t)
+	resetSaveState(t)
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+
+	run(t, "SET", "a", "1")
+	run(t, "SET", "b", "2")
+	run(t, "GET", "a")
+	if changes := dirty.Load(); changes != 2 {
+		t.Fatalf("dirty = %d after two writes, want 2", changes)
+	}
+
+	points, _ := parseSavePoints("1 2")
+	lastSave.Store(time.Now().Add(-time.Minute).Unix())
+	if _, due := dueSavePoint(points, time.Now()); !due {
+		t.Fatal("rule didn't fire")
+	}
+
+	if got := run(t, "SAVE"); got != OK {
+		t.Fatalf("SAVE = %q, want %q", got, OK)
+	}
+	if changes := dirty.Load(); changes != 0 {
+		t.Fatalf("dirty = %d after SAVE, want 0", changes)
+	}
+	if _, due := dueSavePoint(points, time.Now()); due {
+		t.Fatal("rule still fires right after a save")
+	}
+}
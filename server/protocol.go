@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Requests come in two framings. A plain command line is split on
+// whitespace, and a token of just "" stands for an empty argument, as in
+// SET key "". A line starting with '*' begins a framed request, an array of
+// length-prefixed arguments that may hold any bytes, including spaces,
+// newlines and NULs:
+//
+//	*<count>\r\n
+//	$<length>\r\n<bytes>\r\n   (once per argument)
+//
+// e.g. "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$11\r\nhello\nworld\r\n".
+
+// Most arguments a framed request may declare
+const maxFramedArgs = 1024 * 1024
+
+// The plain command line token for an empty argument
+const emptyArgument = `""`
+
+// protocolError is a malformed framed request. The rest of the stream can't
+// be trusted after one, so the connection is closed once it's reported.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+func newProtocolError(format string, args ...any) protocolError {
+	return protocolError("ERROR: Protocol error: " + fmt.Sprintf(format, args...))
+}
+
+// readRequest reads the next command from reader in either framing and
+// returns its arguments along with its size in bytes. limit caps the size
+// of a request, 0 means no limit. A plain command line holding control
+// characters, such as NUL, is read but reported as errInvalidCharacters
+// unless -allow-control-chars is set.
+func readRequest(reader *bufio.Reader, limit int) ([]string, int, error) {
+	line, err := readLine(reader, limit)
+	if err != nil {
+		return nil, len(line), err
+	}
+	if !strings.HasPrefix(line, "*") {
+		// Fields rather than Split so runs of spaces or tabs don't produce
+		// empty arguments, only an explicit "" does
+		tokens := strings.Fields(line)
+		for i, token := range tokens {
+			if token == emptyArgument {
+				tokens[i] = ""
+			}
+		}
+		if !config.AllowControlChars && hasControlChars(line) {
+			return tokens, len(line), errInvalidCharacters
+		}
+		return tokens, len(line), nil
+	}
+	return readFramedArgs(reader, line, limit)
+}
+
+// hasControlChars reports whether s holds an ASCII control character other
+// than the whitespace plain command lines are split on
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return (r < ' ' || r == 0x7f) && !unicode.IsSpace(r)
+	}) >= 0
+}
+
+// readFramedArgs reads the arguments of a framed request whose "*<count>"
+// header line has already been read
+func readFramedArgs(reader *bufio.Reader, header string, limit int) ([]string, int, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil || count > maxFramedArgs {
+		return nil, len(header), newProtocolError("invalid argument count %q", strings.TrimSpace(header))
+	}
+
+	size := len(header)
+	var args []string
+	for i := 0; i < count; i++ {
+		line, err := readLine(reader, limit)
+		size += len(line)
+		if err == errRequestTooLarge {
+			return nil, size, protocolError(RequestTooLarge)
+		}
+		if err != nil {
+			return nil, size, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, size, newProtocolError("expected '$', got %q", strings.TrimSpace(line))
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || length < 0 {
+			return nil, size, newProtocolError("invalid bulk length %q", strings.TrimSpace(line))
+		}
+		if limit > 0 && size+length > limit {
+			return nil, size, protocolError(RequestTooLarge)
+		}
+
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, size, err
+		}
+		size += len(buf)
+		if string(buf[length:]) != "\r\n" {
+			return nil, size, newProtocolError("argument of length %d isn't followed by CRLF", length)
+		}
+		args = append(args, string(buf[:length]))
+	}
+	return args, size, nil
+}
+
+// formatRequest encodes tokens so readRequest returns them unchanged: as a
+// plain command line when that's unambiguous, framed otherwise
+func formatRequest(tokens []string) string {
+	plain := len(tokens) > 0 && !strings.HasPrefix(tokens[0], "*")
+	for _, token := range tokens {
+		if token == "" || token == emptyArgument || strings.IndexFunc(token, unicode.IsSpace) >= 0 || hasControlChars(token) {
+			plain = false
+		}
+	}
+	if plain {
+		return strings.Join(tokens, " ") + "\n"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(tokens))
+	for _, token := range tokens {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(token), token)
+	}
+	return sb.String()
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadRequestWhitespace(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"SET key value\n", []string{"SET", "key", "value"}},
+		{"SET  key   value\n", []string{"SET", "key", "value"}},
+		{"  SET key value  \n", []string{"SET", "key", "value"}},
+		{"SET\tkey\t\tvalue\n", []string{"SET", "key", "value"}},
+		{"SET \t key \t value\r\n", []string{"SET", "key", "value"}},
+		{"SET  key  \"\"\n", []string{"SET", "key", ""}},
+		{"   \n", []string{}},
+	}
+
+	for _, test := range tests {
+		tokens, _, err := readRequest(bufio.NewReader(strings.NewReader(test.line)), 0)
+		if err != nil {
+			t.Errorf("readRequest(%q): %v", test.line, err)
+			continue
+		}
+		if !slices.Equal(tokens, test.want) {
+			t.Errorf("readRequest(%q) = %q, want %q", test.line, tokens, test.want)
+		}
+	}
+}
+
+func TestExtraSpacesDontShiftArguments(t *testing.T) {
+	resetServer(t)
+
+	tokens, _, err := readRequest(bufio.NewReader(strings.NewReader("SET  greeting \t hello\n")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := run(t, tokens...); got != OK {
+		t.Fatalf("SET = %q, want %q", got, OK)
+	}
+	if got := run(t, "GET", "greeting"); got != "hello" {
+		t.Fatalf("GET = %q, want %q", got, "hello")
+	}
+}
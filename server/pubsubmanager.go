@@ -1,31 +1,87 @@
 package server
 
 import (
-	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
 )
 
 type PubSubManager struct {
 	mu            sync.RWMutex
 	Subscribtions map[string]map[net.Conn]bool
+
+	// The last historySize messages published to each channel, for
+	// SUBSCRIBE ... REPLAY. History is off while historySize is 0.
+	historySize int
+	history     map[string]*messageHistory
 }
 
 func NewPubSubManager() *PubSubManager {
 	return &PubSubManager{
 		Subscribtions: make(map[string]map[net.Conn]bool),
+		history:       make(map[string]*messageHistory),
 	}
 }
 
-func (m *PubSubManager) Subscribe(channel string, conn net.Conn) {
+// SetHistorySize keeps the last size messages of every channel, dropping
+// the oldest once a channel has more. 0 turns history off.
+func (m *PubSubManager) SetHistorySize(size int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.historySize = size
+	m.history = make(map[string]*messageHistory)
+}
+
+// HistorySize returns the size set by SetHistorySize
+func (m *PubSubManager) HistorySize() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.historySize
+}
 
+func (m *PubSubManager) Subscribe(channel string, conn net.Conn) {
+	m.SubscribeReplay(channel, conn, 0)
+}
+
+// SubscribeReplay subscribes conn to channel and first pushes it up to
+// replay of the channel's most recent messages. Nothing published meanwhile
+// is missed or delivered twice: later messages wait for the replay to be
+// written. It returns the number of messages replayed.
+func (m *PubSubManager) SubscribeReplay(channel string, conn net.Conn, replay int) (int, error) {
+	m.mu.Lock()
 	if m.Subscribtions[channel] == nil {
 		m.Subscribtions[channel] = make(map[net.Conn]bool)
 	}
 	m.Subscribtions[channel][conn] = true
+
+	var backlog []string
+	if history := m.history[channel]; history != nil && replay > 0 {
+		backlog = history.last(replay)
+	}
+	if len(backlog) == 0 {
+		m.mu.Unlock()
+		return 0, nil
+	}
+
+	// Publish delivers under the write lock too, so taking it before
+	// letting publishers in again puts the backlog ahead of them
+	info := connections.Info(conn)
+	if info != nil {
+		info.writeMu.Lock()
+		defer info.writeMu.Unlock()
+	}
+	m.mu.Unlock()
+
+	var frames strings.Builder
+	for _, message := range backlog {
+		frames.WriteString(formatPush(channel, message))
+	}
+	if _, err := io.WriteString(conn, frames.String()); err != nil {
+		return 0, err
+	}
+	return len(backlog), nil
 }
 
 func (m *PubSubManager) Unsubscribe(channel string, conn net.Conn) {
@@ -41,25 +97,103 @@ func (m *PubSubManager) Unsubscribe(channel string, conn net.Conn) {
 	}
 }
 
-func (m *PubSubManager) Publish(channel string, message string) int {
+// UnsubscribeAll removes conn from every channel it is subscribed to
+func (m *PubSubManager) UnsubscribeAll(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for channel, connections := range m.Subscribtions {
+		delete(connections, conn)
+		if len(connections) == 0 {
+			delete(m.Subscribtions, channel)
+		}
+	}
+}
+
+// IsSubscribed reports whether conn is subscribed to at least one channel
+func (m *PubSubManager) IsSubscribed(conn net.Conn) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	connections, exists := m.Subscribtions[channel]
-	if !exists {
-		return 0
+	for _, connections := range m.Subscribtions {
+		if connections[conn] {
+			return true
+		}
 	}
+	return false
+}
+
+// Publish pushes message to every subscriber of channel and returns how many
+// it reached. Each push waits for any reply being written to that
+// subscriber, so it's never spliced into one. A subscriber that can't be
+// written to is dropped, see dropSubscriber.
+func (m *PubSubManager) Publish(channel string, message string) int {
+	m.mu.Lock()
+	subscribers := make([]net.Conn, 0, len(m.Subscribtions[channel]))
+	for conn := range m.Subscribtions[channel] {
+		subscribers = append(subscribers, conn)
+	}
+	if m.historySize > 0 {
+		history := m.history[channel]
+		if history == nil {
+			history = &messageHistory{messages: make([]string, 0, m.historySize)}
+			m.history[channel] = history
+		}
+		history.add(message)
+	}
+	m.mu.Unlock()
 
 	count := 0
-	message = fmt.Sprintf("[MESSAGE %s] %s\nEND\n", channel, message)
-	for conn := range connections {
-		_, err := fmt.Fprint(conn, message)
-		if err != nil {
-			log.Printf("[ERROR] %s\n", err)
+	push := formatPush(channel, message)
+	for _, conn := range subscribers {
+		if err := deliver(conn, push); err != nil {
+			m.dropSubscriber(conn, err)
 		} else {
 			count++
 		}
-
 	}
 	return count
 }
+
+// dropSubscriber unsubscribes conn from every channel after a push to it
+// failed and closes it, so it isn't written to again. Its connection
+// handler then sees the read fail and cleans up the rest.
+func (m *PubSubManager) dropSubscriber(conn net.Conn, err error) {
+	log.Printf("[WARN] Dropping subscriber %s after a failed push: %v\n", getAddress(conn), err)
+	m.UnsubscribeAll(conn)
+	conn.Close()
+}
+
+// deliver writes a push frame to conn under its write lock
+func deliver(conn net.Conn, push string) error {
+	if info := connections.Info(conn); info != nil {
+		info.writeMu.Lock()
+		defer info.writeMu.Unlock()
+	}
+	_, err := io.WriteString(conn, push)
+	return err
+}
+
+// messageHistory is a ring buffer of a channel's most recent messages
+type messageHistory struct {
+	messages []string
+
+	// Where the next message goes once the buffer is full, which is also
+	// where the oldest one is
+	next int
+}
+
+func (h *messageHistory) add(message string) {
+	if len(h.messages) < cap(h.messages) {
+		h.messages = append(h.messages, message)
+		return
+	}
+	h.messages[h.next] = message
+	h.next = (h.next + 1) % len(h.messages)
+}
+
+// last returns up to n of the most recent messages, oldest first
+func (h *messageHistory) last(n int) []string {
+	ordered := append(append([]string(nil), h.messages[h.next:]...), h.messages[:h.next]...)
+	return ordered[max(0, len(ordered)-n):]
+}
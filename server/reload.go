@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Settings that can change while the server runs. They start out from
+// config and are replaced when a SIGHUP reloads -config.
+var idleTimeout atomic.Int64
+var commandTimeout atomic.Int64
+
+func currentIdleTimeout() time.Duration {
+	return time.Duration(idleTimeout.Load())
+}
+
+func currentCommandTimeout() time.Duration {
+	return time.Duration(commandTimeout.Load())
+}
+
+// reloadableSetting is a setting that may appear in the -config file. Its
+// name matches the command line flag that sets it at startup. parse checks
+// a value and returns a func that applies it.
+type reloadableSetting struct {
+	name  string
+	parse func(value string) (func(), error)
+}
+
+var reloadableSettings = []reloadableSetting{
+	{"idle-timeout", durationSetting(true, func(d time.Duration) {
+		idleTimeout.Store(int64(d))
+	})},
+	{"command-timeout", durationSetting(true, func(d time.Duration) {
+		commandTimeout.Store(int64(d))
+	})},
+	{"cleanup-interval", durationSetting(false, func(d time.Duration) {
+		kv.SetCleanupInterval(d)
+	})},
+}
+
+// durationSetting parses a positive duration, or a non-negative one if
+// zero disables the setting, and passes it to set
+func durationSetting(allowZero bool, set func(time.Duration)) func(string) (func(), error) {
+	return func(value string) (func(), error) {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || (d == 0 && !allowZero) {
+			return nil, fmt.Errorf("invalid duration %q", value)
+		}
+		return func() { set(d) }, nil
+	}
+}
+
+// applySettings starts the reloadable timeouts out from config. The cleanup
+// interval is set when the cleanup is scheduled.
+func applySettings() {
+	idleTimeout.Store(int64(config.IdleTimeout))
+	commandTimeout.Store(int64(config.CommandTimeout))
+}
+
+// loadConfigFile applies the settings in fileName, one "<name> <value>" per
+// line. Blank lines and lines starting with '#' are ignored. Every line is
+// checked before any is applied, so a bad file changes nothing.
+func loadConfigFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var applies []func()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected <name> <value>", fileName, lineNo)
+		}
+		setting, ok := findReloadableSetting(fields[0])
+		if !ok {
+			return fmt.Errorf("%s:%d: %s can't be set from a config file", fileName, lineNo, fields[0])
+		}
+		apply, err := setting.parse(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", fileName, lineNo, fields[0], err)
+		}
+		applies = append(applies, apply)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i, apply := range applies {
+		apply()
+		log.Printf("[INFO] Config: %s\n", lines[i])
+	}
+	return nil
+}
+
+func findReloadableSetting(name string) (reloadableSetting, bool) {
+	for _, setting := range reloadableSettings {
+		if setting.name == name {
+			return setting, true
+		}
+	}
+	return reloadableSetting{}, false
+}
+
+// logFile is the file log output goes to when -log-file is set
+var logFile *os.File
+
+// openLogFile points log output at config.LogFile, closing the file it
+// wrote to before. Reopening the same name after it was rotated away starts
+// a fresh file.
+func openLogFile() error {
+	file, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.SetOutput(file)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
+}
+
+// setupReloadHook reopens the log file and reloads the -config file on
+// SIGHUP, leaving connections alone
+func setupReloadHook() {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	go func() {
+		for range hupCh {
+			log.Println("[INFO] SIGHUP received, reloading...")
+			if config.LogFile != "" {
+				if err := openLogFile(); err != nil {
+					log.Printf("[ERROR] Failed to reopen log file %s: %v\n", config.LogFile, err)
+				}
+			}
+			if config.ConfigFile != "" {
+				if err := loadConfigFile(config.ConfigFile); err != nil {
+					log.Printf("[ERROR] Failed to reload config, keeping current settings: %v\n", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a replica waits before reconnecting to a master it lost
+const replicaRetryInterval = 5 * time.Second
+
+// errNotApplied is returned by write handlers that replied to the client but
+// left the store unchanged, such as a conditional write whose condition
+// failed, so there's nothing to replicate
+var errNotApplied = errors.New("write not applied")
+
+// errRejected is returned by handlers that replied with an error. Like
+// errNotApplied nothing is replicated, and a script stops at the command.
+// processCommand passes it on so callers can tell an error reply from a
+// value that merely looks like one.
+var errRejected = errors.New("command rejected")
+
+// partialWrite is returned by a write handler that stopped partway, after
+// replying with an error, with the command that amounts to what it applied
+type partialWrite struct {
+	tokens []string
+}
+
+func (p *partialWrite) Error() string {
+	return fmt.Sprintf("write applied in part as %v", p.tokens)
+}
+
+// handlerError drops the errors that only tell Replication.Write and EVAL
+// what a handler did, leaving errRejected for an error response and those
+// from writing the response
+func handlerError(err error) error {
+	if _, partial := err.(*partialWrite); partial {
+		return errRejected
+	}
+	if err == errNotApplied {
+		return nil
+	}
+	return err
+}
+
+// Commands that replace the dataset wholesale. Rather than propagating them,
+// the master drops its replicas so they reconnect and resync from scratch.
+var resyncCommands = map[string]bool{
+	LoadCommand:      true,
+	ImportCSVCommand: true,
+}
+
+// replicatedCommand returns the command to send replicas for the write in
+// tokens, once it has been applied. Revisions are local to each server, so a
+// SETVER is sent as the SET it amounts to. TTLs may be jittered, so SETEX
+// and EXPIRE are sent with the expiration the master stored, or as a DEL if
+// the key is already gone. Other writes are sent as they are, in the same
+// slice, so handlers can still rewrite their tokens.
+func replicatedCommand(name string, tokens []string) []string {
+	switch name {
+	case SetVerCommand:
+		return []string{SetCommand, tokens[1], tokens[2]}
+	case SetexCommand, ExpireCommand:
+		expiration, ok := kv.Expiration(tokens[1])
+		if !ok {
+			return []string{DelCommand, tokens[1]}
+		}
+		at := strconv.FormatInt(expiration.UnixMilli(), 10)
+		if name == SetexCommand {
+			return []string{SetCommand, tokens[1], tokens[2], "PXAT", at}
+		}
+		return []string{PExpireAtCommand, tokens[1], at}
+	}
+	return tokens
+}
+
+// Replication tracks both sides of master-replica replication. As a master
+// it feeds every write command to the connected replicas, as a replica it
+// follows a master and applies the writes it sends.
+//
+// A replica connects and sends SYNC. The master replies with a one-line
+// snapshot of the store followed by END and its replication offset, then
+// sends each write command it applies as a request, framed when its
+// arguments need it. There is no partial resync yet: a replica that loses
+// its master reconnects and loads a fresh snapshot.
+//
+// The offset counts the bytes of every write applied, whether or not any
+// replica is connected, so it only ever grows. A replica starts from its
+// master's offset and adds the bytes it receives, so the two match once it
+// has caught up.
+type Replication struct {
+	mu       sync.Mutex
+	replicas map[net.Conn]bool
+	offset   atomic.Int64
+
+	masterAddr string
+	cancel     context.CancelFunc
+}
+
+func NewReplication() *Replication {
+	return &Replication{
+		replicas: make(map[net.Conn]bool),
+	}
+}
+
+// Write runs apply, which performs the write command name in tokens, counts
+// it towards the auto-save rules and then forwards replicatedCommand to every
+// replica. Writes are serialized so replicas apply them in the same order as
+// the master. Nothing is forwarded if apply returns errNotApplied or
+// errRejected, and a partialWrite is forwarded in place of tokens before
+// errRejected is returned for it.
+func (r *Replication) Write(name string, tokens []string, apply func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := apply()
+	if partial, ok := err.(*partialWrite); ok {
+		tokens, err = partial.tokens, errRejected
+		dirty.Add(1)
+	} else if err == errNotApplied {
+		return nil
+	} else if err == errRejected {
+		return err
+	} else {
+		tokens = replicatedCommand(name, tokens)
+		if err == nil {
+			dirty.Add(1)
+		}
+	}
+	line := formatRequest(tokens)
+	r.offset.Add(int64(len(line)))
+	if len(r.replicas) == 0 {
+		return err
+	}
+
+	if resyncCommands[strings.ToUpper(tokens[0])] {
+		log.Printf("[INFO] %s replaced the dataset, dropping replicas for a full resync\n", tokens[0])
+		for conn := range r.replicas {
+			conn.Close()
+			delete(r.replicas, conn)
+		}
+		return err
+	}
+
+	r.propagate(line)
+	return err
+}
+
+// Evict runs evict, which removes keys to free memory, and forwards a DEL of
+// the keys it removed. It takes the same lock as Write so replicas drop the
+// keys in the same order relative to other writes as the master did.
+func (r *Replication) Evict(evict func() ([]string, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	evicted, err := evict()
+	if len(evicted) == 0 {
+		return err
+	}
+
+	line := formatRequest(append([]string{DelCommand}, evicted...))
+	r.offset.Add(int64(len(line)))
+	r.propagate(line)
+	return err
+}
+
+// WriteScript runs a script under the same lock as Write and forwards the
+// write commands it reports having applied, in the order it applied them
+func (r *Replication) WriteScript(run func() ([][]string, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	writes, err := run()
+	dirty.Add(int64(len(writes)))
+	for _, tokens := range writes {
+		line := formatRequest(tokens)
+		r.offset.Add(int64(len(line)))
+		r.propagate(line)
+	}
+	return err
+}
+
+// propagate sends line to every replica, dropping any that can't keep up.
+// Callers must hold r.mu.
+func (r *Replication) propagate(line string) {
+	for conn := range r.replicas {
+		_, err := io.WriteString(&deadlineWriter{conn: conn}, line)
+		if err != nil {
+			log.Printf("[WARN] Dropping replica %s: %v\n", getAddress(conn), err)
+			conn.Close()
+			delete(r.replicas, conn)
+		}
+	}
+}
+
+// AddReplica sends conn a full snapshot and starts forwarding writes to it.
+// Holding the lock while the snapshot is written keeps concurrent writes
+// from being either lost or applied twice.
+func (r *Replication) AddReplica(conn net.Conn) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w := bufio.NewWriter(&deadlineWriter{conn: conn})
+	if err := kv.WriteSnapshot(w); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "END %d\n", r.Offset()); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	r.replicas[conn] = true
+	return nil
+}
+
+func (r *Replication) RemoveReplica(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.replicas, conn)
+}
+
+func (r *Replication) HasReplica(conn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replicas[conn]
+}
+
+func (r *Replication) ReplicaCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.replicas)
+}
+
+// Follow makes this server a replica of the master at addr, replacing any
+// master it was following before
+func (r *Replication) Follow(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.masterAddr = addr
+	r.cancel = cancel
+	readOnly.Store(true)
+	go followMaster(ctx, addr)
+}
+
+// Unfollow stops replicating and makes this server a master again. The data
+// received so far is kept.
+func (r *Replication) Unfollow() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.masterAddr = ""
+	r.cancel = nil
+	readOnly.Store(config.ReadOnly)
+}
+
+// MasterAddr returns the address of the master being followed, or "" if
+// this server is a master
+func (r *Replication) MasterAddr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.masterAddr
+}
+
+func (r *Replication) IsReplica() bool {
+	return r.MasterAddr() != ""
+}
+
+// Role returns "replica" while following a master and "master" otherwise
+func (r *Replication) Role() string {
+	if r.IsReplica() {
+		return "replica"
+	}
+	return "master"
+}
+
+// Offset returns the replication offset, the number of bytes of write
+// commands applied so far
+func (r *Replication) Offset() int64 {
+	return r.offset.Load()
+}
+
+// followMaster keeps a replication link to addr open until ctx is done,
+// reconnecting and resyncing whenever it drops
+func followMaster(ctx context.Context, addr string) {
+	for {
+		err := syncFromMaster(ctx, addr)
+		if ctx.Err() != nil {
+			log.Printf("[INFO] Stopped replicating from %s\n", addr)
+			return
+		}
+		log.Printf("[WARN] Replication from %s failed: %v, retrying in %v\n", addr, err, replicaRetryInterval)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[INFO] Stopped replicating from %s\n", addr)
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// syncFromMaster loads a full snapshot from the master at addr and then
+// applies the write commands it streams until the connection fails
+func syncFromMaster(ctx context.Context, addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, Timeout*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	if config.MasterAuth != "" {
+		if err := authenticateToMaster(conn, reader); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(conn, SyncCommand+"\n"); err != nil {
+		return err
+	}
+
+	snapshot, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(snapshot, "ERROR") {
+		return errors.New(strings.TrimSpace(snapshot))
+	}
+	if err := kv.ReadSnapshot(strings.NewReader(snapshot)); err != nil {
+		return err
+	}
+	end, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	// Masters from before offsets were tracked send a bare END
+	offset, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(end, "END")), 10, 64)
+	replication.offset.Store(offset)
+	log.Printf("[INFO] Synced with master %s at offset %d\n", addr, offset)
+
+	for {
+		tokens, size, err := readRequest(reader, 0)
+		if err != nil {
+			return err
+		}
+		replication.offset.Add(int64(size))
+		if len(tokens) == 0 {
+			continue
+		}
+		dispatchCommand(ctx, io.Discard, tokens, nil)
+		dirty.Add(1)
+	}
+}
+
+// handleSync turns conn into a replica connection. It runs outside of
+// processCommand because the snapshot has to be written directly to the
+// connection under the replication lock.
+func handleSync(conn net.Conn) error {
+	if replication.IsReplica() {
+		log.Printf("[WARN] Rejected SYNC from %s: this server is a replica\n", getAddress(conn))
+		metrics.Inc("ERROR")
+		_, err := io.WriteString(&deadlineWriter{conn: conn}, ChainedReplication+"\nEND\n")
+		return err
+	}
+
+	if err := replication.AddReplica(conn); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Replica %s synced\n", getAddress(conn))
+	metrics.Inc("SYNC")
+	return nil
+}
+
+// Replicas don't acknowledge what they've applied yet, so WAIT can't block
+// for them and reports how many are connected straight away
+func handleWait(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "WAIT <numreplicas> <timeout-ms>"
+	numReplicas, err := strconv.Atoi(tokens[1])
+	if err != nil || numReplicas < 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("WAIT", format))
+	}
+	timeout, err := strconv.Atoi(tokens[2])
+	if err != nil || timeout < 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("WAIT", format))
+	}
+
+	metrics.Inc("WAIT")
+	return reply(w, strconv.Itoa(replication.ReplicaCount()))
+}
+
+func handleReplicaOf(ctx context.Context, w io.Writer, tokens []string) error {
+	metrics.Inc("REPLICAOF")
+	if strings.ToUpper(tokens[1]) == "NO" && strings.ToUpper(tokens[2]) == "ONE" {
+		replication.Unfollow()
+		log.Println("[INFO] Replication stopped, now a master")
+		return reply(w, OK)
+	}
+
+	addr := net.JoinHostPort(tokens[1], tokens[2])
+	replication.Follow(addr)
+	log.Printf("[INFO] Replicating from %s\n", addr)
+	return reply(w, OK)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+// addTestReplica connects a replica over a pipe without the snapshot SYNC
+// would send and returns a reader for the commands propagated to it
+func addTestReplica(t *testing.T) *bufio.Reader {
+	t.Helper()
+	master, replica := net.Pipe()
+	t.Cleanup(func() {
+		master.Close()
+		replica.Close()
+	})
+	replication.mu.Lock()
+	replication.replicas[master] = true
+	replication.mu.Unlock()
+	return bufio.NewReader(replica)
+}
+
+// propagated runs tokens and returns the command the replica received, or
+// "" if none was sent before the command finished
+func propagated(t *testing.T, replica *bufio.Reader, tokens ...string) (string, string) {
+	t.Helper()
+	return propagatedContext(t, replica, context.Background(), tokens...)
+}
+
+// propagatedContext is propagated with the command's context set to ctx
+func propagatedContext(t *testing.T, replica *bufio.Reader, ctx context.Context, tokens ...string) (string, string) {
+	t.Helper()
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := replica.ReadString('\n')
+		lines <- line
+	}()
+	result := runContext(t, ctx, tokens...)
+
+	// Unblock the reader if nothing was sent
+	replication.mu.Lock()
+	for conn := range replication.replicas {
+		conn.Close()
+	}
+	replication.mu.Unlock()
+	return result, <-lines
+}
+
+func TestSetVerReplicatesAsSet(t *testing.T) {
+	resetServer(t)
+	replica := addTestReplica(t)
+
+	result, line := propagated(t, replica, "SETVER", "k", "v", "0")
+	if result != "1" {
+		t.Fatalf("SETVER = %q, want %q", result, "1")
+	}
+	if line != "SET k v\n" {
+		t.Fatalf("replica got %q, want %q", line, "SET k v\n")
+	}
+}
+
+func TestSetVerConflictIsNotReplicated(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "k", "v")
+	replica := addTestReplica(t)
+
+	result, line := propagated(t, replica, "SETVER", "k", "w", "0")
+	if result != NilReply {
+		t.Fatalf("SETVER = %q, want %q", result, NilReply)
+	}
+	if line != "" {
+		t.Fatalf("replica got %q, want nothing", line)
+	}
+}
+
+func TestTTLWritesReplicateAsExpirations(t *testing.T) {
+	resetServer(t)
+	kv.SetTTLJitter(50, rand.New(rand.NewSource(1)))
+
+	tests := []struct {
+		tokens []string
+		want   func(at string) string
+	}{
+		{[]string{"SETEX", "k", "v", "100"}, func(at string) string { return "SET k v PXAT " + at + "\n" }},
+		{[]string{"EXPIRE", "k", "200"}, func(at string) string { return "PEXPIREAT k " + at + "\n" }},
+	}
+	for _, test := range tests {
+		replica := addTestReplica(t)
+		_, line := propagated(t, replica, test.tokens...)
+		expiration, ok := kv.Expiration("k")
+		if !ok {
+			t.Fatalf("%v left no expiration", test.tokens)
+		}
+		want := test.want(strconv.FormatInt(expiration.UnixMilli(), 10))
+		if line != want {
+			t.Fatalf("%v: replica got %q, want %q", test.tokens, line, want)
+		}
+	}
+}
+
+func TestPExpireAtInThePastRemovesKey(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "k", "v")
+
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	if result := run(t, "PEXPIREAT", "k", past); result != OK {
+		t.Fatalf("PEXPIREAT = %q, want %q", result, OK)
+	}
+	if result := run(t, "GET", "k"); result != kvstore.KeyNotFound {
+		t.Fatalf("GET = %q, want %q", result, kvstore.KeyNotFound)
+	}
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "k", "v")
+	readOnly.Store(true)
+
+	if got := run(t, "SET", "k", "w"); got != ReadOnlyReplica {
+		t.Fatalf("SET = %q, want %q", got, ReadOnlyReplica)
+	}
+	if got := run(t, "DELETE", "k"); got != ReadOnlyReplica {
+		t.Fatalf("DELETE = %q, want %q", got, ReadOnlyReplica)
+	}
+	if got := run(t, "GET", "k"); got != "v" {
+		t.Fatalf("GET = %q, want %q", got, "v")
+	}
+}
+
+// cancelAfter is a context that reports itself cancelled once Err has been
+// checked checks times, so a handler can be stopped at a known point
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.checks == 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestAbortedDelReplicatesDeletedKeys(t *testing.T) {
+	resetServer(t)
+	run(t, "MSET", "k1", "1", "k2", "2", "k3", "3")
+	replica := addTestReplica(t)
+
+	ctx := &cancelAfter{Context: context.Background(), checks: 2}
+	result, line := propagatedContext(t, replica, ctx, "DEL", "k1", "k2", "k3")
+	if result != CommandCanceled {
+		t.Fatalf("DEL = %q, want %q", result, CommandCanceled)
+	}
+	if line != "DEL k1 k2\n" {
+		t.Fatalf("replica got %q, want %q", line, "DEL k1 k2\n")
+	}
+	if !kv.Contains("k3") {
+		t.Fatal("DEL removed a key after it was cancelled")
+	}
+}
+
+func TestRejectedWritesAreNotReplicated(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		tokens []string
+	}{
+		{"DEL cancelled before any key", &cancelAfter{Context: context.Background()}, []string{"DEL", "k"}},
+		{"SETEX with an invalid TTL", context.Background(), []string{"SETEX", "k", "v", "soon"}},
+		{"SET of a value over the limit", context.Background(), []string{"SET", "k", "toolong"}},
+		{"EXPIRE of a missing key", context.Background(), []string{"EXPIRE", "missing", "10"}},
+		{"RENAME of a missing key", context.Background(), []string{"RENAME", "missing", "k"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetServer(t)
+			kv.SetMaxSizes(0, 3)
+			run(t, "SET", "k", "v")
+			replica := addTestReplica(t)
+			offset := replication.offset.Load()
+
+			if _, line := propagatedContext(t, replica, test.ctx, test.tokens...); line != "" {
+				t.Fatalf("replica got %q, want nothing", line)
+			}
+			if replication.offset.Load() != offset {
+				t.Fatal("replication offset moved")
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"strings"
+)
+
+// Commands that create keys, mapped to the positions of the keys they create
+// in their tokens. MSET's keys are every other token, so it's handled apart.
+var keyCreatingCommands = map[string][]int{
+	SetCommand:      {1},
+	SetexCommand:    {1},
+	AppendCommand:   {1},
+	SetVerCommand:   {1},
+	IncrExpCommand:  {1},
+	RenameCommand:   {2},
+	RenameNXCommand: {2},
+	ZAddCommand:     {1},
+	ZIncrByCommand:  {1},
+	XAddCommand:     {1},
+	JSONSetCommand:  {1},
+}
+
+// reservedKey returns the first key the command in tokens would create under
+// -reserved-prefix, if any
+func reservedKey(cmd string, tokens []string) (string, bool) {
+	if config.ReservedPrefix == "" {
+		return "", false
+	}
+
+	var keys []string
+	if cmd == MSetCommand {
+		for i := 1; i < len(tokens); i += 2 {
+			keys = append(keys, tokens[i])
+		}
+	}
+	for _, i := range keyCreatingCommands[cmd] {
+		keys = append(keys, tokens[i])
+	}
+
+	for _, key := range keys {
+		if isReservedKey(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func isReservedKey(key string) bool {
+	if config.ReservedPrefix == "" {
+		return false
+	}
+	if config.CaseInsensitiveKeys {
+		return strings.HasPrefix(strings.ToLower(key), strings.ToLower(config.ReservedPrefix))
+	}
+	return strings.HasPrefix(key, config.ReservedPrefix)
+}
+
+// rejectReservedKey logs and counts a write refused by -reserved-prefix
+func rejectReservedKey(cmd string, key string) {
+	log.Printf("[WARN] Rejected %s %s: reserved key prefix %q\n", cmd, key, config.ReservedPrefix)
+	metrics.Inc("ERROR")
+}
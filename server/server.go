@@ -2,78 +2,190 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/petariliev/kvstore/kvstore"
+	"github.com/petariliev/kvstore/protocol"
 )
 
 const (
-	OK                 = "OK"
-	GetCommand         = "GET"
-	MGetCommand        = "MGET"
-	KeyExistsCommand   = "KEYEXISTS"
-	TypeCommand        = "TYPE"
-	SetCommand         = "SET"
-	MSetCommand        = "MSET"
-	SetexCommand       = "SETEX"
-	ExpireCommand      = "EXPIRE"
-	PersistCommand     = "PERSIST"
-	TTLCommand         = "TTL"
-	RenameCommand      = "RENAME"
-	RenameNXCommand    = "RENAME_NX"
-	StatsCommand       = "STATS"
-	DeleteCommand      = "DELETE"
-	DelCommand         = "DEL"
-	DeleteexCommand    = "DELETEEX"
-	FlushCommand       = "FLUSH"
-	SaveCommand        = "SAVE"
-	LoadCommand        = "LOAD"
-	KeysCommand        = "KEYS"
-	KeysWithTTLCommand = "KEYS_WITH_TTL"
-	KeysNoTTLCommand   = "KEYS_NO_TTL"
-	InfoCommand        = "INFO"
-	HelpCommand        = "HELP"
-	PingCommand        = "PING"
-	ShutDownCommand    = "SHUTDOWN"
-	SubscribeCommand   = "SUBSCRIBE"
-	UnsubscribeCommand = "UNSUBSCRIBE"
-	PublishCommand     = "PUBLISH"
-	Port               = ":8080"
-	Timeout            = 30
-	FileName           = "data.txt"
-	InvalidCommand     = "ERROR: Invalid command."
-	ServerVersion      = "1.0.0"
+	OK                    = "OK"
+	GetCommand            = "GET"
+	MGetCommand           = "MGET"
+	KeyExistsCommand      = "KEYEXISTS"
+	TypeCommand           = "TYPE"
+	SetCommand            = "SET"
+	MSetCommand           = "MSET"
+	SetexCommand          = "SETEX"
+	ExpireCommand         = "EXPIRE"
+	PExpireAtCommand      = "PEXPIREAT"
+	PersistCommand        = "PERSIST"
+	TTLCommand            = "TTL"
+	RenameCommand         = "RENAME"
+	RenameNXCommand       = "RENAME_NX"
+	StatsCommand          = "STATS"
+	DeleteCommand         = "DELETE"
+	DelCommand            = "DEL"
+	DeleteexCommand       = "DELETEEX"
+	FlushCommand          = "FLUSH"
+	FlushDBCommand        = "FLUSHDB"
+	FlushAllCommand       = "FLUSHALL"
+	SaveCommand           = "SAVE"
+	LoadCommand           = "LOAD"
+	KeysCommand           = "KEYS"
+	KeysWithTTLCommand    = "KEYS_WITH_TTL"
+	KeysNoTTLCommand      = "KEYS_NO_TTL"
+	InfoCommand           = "INFO"
+	HelpCommand           = "HELP"
+	PingCommand           = "PING"
+	ShutDownCommand       = "SHUTDOWN"
+	SubscribeCommand      = "SUBSCRIBE"
+	UnsubscribeCommand    = "UNSUBSCRIBE"
+	PublishCommand        = "PUBLISH"
+	ObjectCommand         = "OBJECT"
+	MemoryCommand         = "MEMORY"
+	QuitCommand           = "QUIT"
+	ExportCSVCommand      = "EXPORTCSV"
+	ImportCSVCommand      = "IMPORTCSV"
+	ScanCommand           = "SCAN"
+	PrefixCommand         = "PREFIX"
+	ResetStatsCommand     = "RESETSTATS"
+	ClientCommand         = "CLIENT"
+	ZAddCommand           = "ZADD"
+	ZScoreCommand         = "ZSCORE"
+	ZRangeCommand         = "ZRANGE"
+	ZRankCommand          = "ZRANK"
+	ZRangeByScoreCommand  = "ZRANGEBYSCORE"
+	ZIncrByCommand        = "ZINCRBY"
+	ZScanCommand          = "ZSCAN"
+	SyncCommand           = "SYNC"
+	ReplicaOfCommand      = "REPLICAOF"
+	WaitCommand           = "WAIT"
+	CommandCommand        = "COMMAND"
+	BGetCommand           = "BGET"
+	DebugCommand          = "DEBUG"
+	BgSaveCommand         = "BGSAVE"
+	SetVerCommand         = "SETVER"
+	GetVerCommand         = "GETVER"
+	HealthCommand         = "HEALTH"
+	IncrExpCommand        = "INCREXP"
+	AuthCommand           = "AUTH"
+	XAddCommand           = "XADD"
+	XLenCommand           = "XLEN"
+	XRangeCommand         = "XRANGE"
+	XReadCommand          = "XREAD"
+	AppendCommand         = "APPEND"
+	EvalCommand           = "EVAL"
+	JSONSetCommand        = "JSON.SET"
+	JSONGetCommand        = "JSON.GET"
+	JSONDelCommand        = "JSON.DEL"
+	Port                  = ":8080"
+	Timeout               = 30
+	FileName              = "data.txt"
+	DefaultScanCount      = 10
+	InvalidCommand        = "ERROR: Invalid command."
+	NilReply              = "(nil)"
+	RequestTooLarge       = "ERROR: request too large"
+	InvalidCharacters     = "ERROR: invalid characters in key or value, send a framed request for arbitrary bytes"
+	ShuttingDown          = "ERROR: server is shutting down"
+	ReservedKeyPrefix     = "ERROR: reserved key prefix"
+	NoAuth                = "ERROR: NOAUTH Authentication required"
+	NoPermission          = "ERROR: NOPERM this user has no permissions to run the '%s' command"
+	WrongPassword         = "ERROR: WRONGPASS invalid username-password pair"
+	AuthNotConfigured     = "ERROR: AUTH called without -aclfile"
+	HistoryDisabled       = "ERROR: REPLAY needs the server started with -pubsub-history"
+	LoadingDataset        = "ERROR: LOADING server is loading the dataset in memory"
+	CommandTimedOut       = "ERROR: command timed out"
+	CommandCanceled       = "ERROR: command canceled"
+	ReadOnlyReplica       = "ERROR: READONLY You can't write against a read only replica"
+	ChainedReplication    = "ERROR: this server is a replica and can't have replicas of its own"
+	DebugDisabled         = "ERROR: DEBUG is disabled, start the server with -enable-debug"
+	BackgroundSaveRunning = "ERROR: Background save already in progress"
+	NeedsConnection       = "ERROR: %s needs a client connection"
+	ServerVersion         = "1.0.0"
 )
 
+// Idle time buckets reported by INFO
+var idleBounds = []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}
+
 var kv = kvstore.New()
 var connections = NewConnections()
 var metrics = NewMetrics()
 var done = make(chan struct{})
 var startTime = time.Now()
 var pubsub = NewPubSubManager()
+var replication = NewReplication()
+var errRequestTooLarge = errors.New(RequestTooLarge)
+var errInvalidCharacters = errors.New(InvalidCharacters)
+
+// readOnly is set by the -readonly flag and while following a master. Client
+// write commands are rejected but replicated writes still apply.
+var readOnly atomic.Bool
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	metrics.IncActiveClients()
 
-	conn.SetReadDeadline(time.Now().Add(Timeout * time.Second))
-	conn.SetWriteDeadline(time.Now().Add(Timeout * time.Second))
+	// Cancelled when the client goes away, so in-flight commands can stop early
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	connections.Add(conn)
+	info := connections.Add(conn)
+	emitEvent(EventConnect, info, nil)
+	defer emitEvent(EventDisconnect, info, nil)
 	reader := bufio.NewReader(conn)
 
 	for {
-		message, err := reader.ReadString('\n')
-		conn.SetReadDeadline(time.Now().Add(Timeout * time.Second))
+		refreshReadDeadline(conn)
+		tokens, size, err := readRequest(reader, config.MaxRequestBytes)
+		if err == errRequestTooLarge {
+			log.Printf("[WARN] Request from %s exceeds %d bytes\n", getAddress(conn), config.MaxRequestBytes)
+			metrics.Inc("ERROR")
+			_, err = io.WriteString(&deadlineWriter{conn: conn}, RequestTooLarge+"\nEND\n")
+			if err != nil {
+				log.Printf("[ERROR] Error writing to %s: %v\n", getAddress(conn), err)
+				disconnect(conn)
+				return
+			}
+			continue
+		}
+		if err == errInvalidCharacters {
+			log.Printf("[WARN] Rejected a command line with control characters from %s\n", getAddress(conn))
+			metrics.Inc("ERROR")
+			_, err = io.WriteString(&deadlineWriter{conn: conn}, InvalidCharacters+"\nEND\n")
+			if err != nil {
+				log.Printf("[ERROR] Error writing to %s: %v\n", getAddress(conn), err)
+				disconnect(conn)
+				return
+			}
+			continue
+		}
+		if protoErr, ok := err.(protocolError); ok {
+			log.Printf("[WARN] Closing %s after a malformed request: %v\n", getAddress(conn), protoErr)
+			metrics.Inc("ERROR")
+			io.WriteString(&deadlineWriter{conn: conn}, protoErr.Error()+"\nEND\n")
+			disconnect(conn)
+			return
+		}
 		if err != nil {
 			if err == io.EOF {
 				log.Println("[INFO] Client disconnected:", getAddress(conn))
@@ -83,7 +195,7 @@ func handleConnection(conn net.Conn) {
 
 			netErr, ok := err.(net.Error)
 			if ok && netErr.Timeout() {
-				log.Println("[INFO] Client connection timed out:", getAddress(conn))
+				log.Printf("[INFO] Client %s idle for %v, closing connection\n", getAddress(conn), currentIdleTimeout())
 				disconnect(conn)
 				return
 			}
@@ -93,261 +205,461 @@ func handleConnection(conn net.Conn) {
 			return
 		}
 
-		message = strings.TrimSpace(message)
-		tokens := strings.Split(message, " ")
+		info.RecordCommand(strings.Join(tokens, " "), size)
+		if config.CommandEvents && len(tokens) > 0 {
+			emitEvent(EventCommand, info, func(event *Event) {
+				event.Command = strings.ToUpper(tokens[0])
+				if spec, exists := registry[event.Command]; exists {
+					event.Command = spec.name
+				}
+			})
+		}
 
-		response := processCommand(tokens, conn)
-		response += "\nEND\n"
+		if len(tokens) == 1 && strings.ToUpper(tokens[0]) == SyncCommand {
+			if problem := checkPermission(SyncCommand, conn); problem != "" {
+				metrics.Inc("ERROR")
+				io.WriteString(&deadlineWriter{conn: conn}, problem+"\nEND\n")
+				continue
+			}
+			if err := handleSync(conn); err != nil {
+				log.Printf("[ERROR] Error syncing replica %s: %v\n", getAddress(conn), err)
+				disconnect(conn)
+				return
+			}
+			continue
+		}
 
-		_, err = conn.Write([]byte(response))
-		conn.SetWriteDeadline(time.Now().Add(Timeout * time.Second))
+		lock := &replyLock{w: &countingWriter{w: &deadlineWriter{conn: conn}, info: info}, mu: &info.writeMu}
+		w := bufio.NewWriter(lock)
+		escaper := &terminatorEscaper{w: w}
+		if isBlockingCommand(tokens) {
+			err = runBlockingCommand(ctx, escaper, tokens, conn, reader)
+		} else {
+			err = runCommand(ctx, escaper, tokens, conn)
+		}
+		if err == errRejected {
+			err = nil
+		}
+		if err == nil {
+			err = escaper.finish()
+		}
+		if err == nil {
+			_, err = io.WriteString(w, "\n"+protocol.ResponseTerminator+"\n")
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		lock.release()
 		if err != nil {
 			log.Printf("[ERROR] Error writing to %s: %v\n", getAddress(conn), err)
 			disconnect(conn)
 			return
 		}
+
+		if len(tokens) == 1 && strings.ToUpper(tokens[0]) == QuitCommand {
+			log.Println("[INFO] Client quit:", getAddress(conn))
+			disconnect(conn)
+			return
+		}
+	}
+}
+
+// runCommand runs processCommand under a watchdog, with a context derived
+// from the connection's. When a command takes longer than the command
+// timeout its context is cancelled and the goroutine stacks are logged.
+// The connection still waits for the handler to return, so its next command
+// can't run alongside it, and the client gets whatever the handler replied:
+// CommandTimedOut if it stopped, or its result if the write went ahead.
+// Streaming commands write straight to w and are expected to stop once
+// their context is done.
+func runCommand(connCtx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	timeout := currentCommandTimeout()
+	if timeout <= 0 {
+		return processCommand(connCtx, w, tokens, conn)
+	}
+
+	ctx, cancel := context.WithTimeout(connCtx, timeout)
+	defer cancel()
+
+	if isStreamingCommand(tokens) {
+		return processCommand(ctx, w, tokens, conn)
+	}
+
+	var response bytes.Buffer
+	result := make(chan error, 1)
+	go func() {
+		result <- processCommand(ctx, &response, tokens, conn)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		stack := make([]byte, 64<<10)
+		stack = stack[:runtime.Stack(stack, true)]
+		log.Printf("[WARN] Command %v from %s exceeded %v\n%s", tokens, getAddress(conn), timeout, stack)
+		err = <-result
+	}
+	if err != nil && err != errRejected {
+		return err
 	}
+	if _, writeErr := w.Write(response.Bytes()); writeErr != nil {
+		return writeErr
+	}
+	return err
 }
 
-func processCommand(tokens []string, conn net.Conn) string {
+// processCommand dispatches tokens to their handler, which writes the
+// response to w. It returns errRejected if the response is an error, and
+// any other error only if writing failed.
+func processCommand(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
 	if len(tokens) == 0 {
 		log.Println("[WARN] Received empty command")
 		metrics.Inc("ERROR")
-		return InvalidCommand
+		return replyError(w, InvalidCommand)
 	}
 
-	cmd := strings.ToUpper(tokens[0])
-	switch cmd {
-	case GetCommand:
-		return handleGet(tokens)
-	case MGetCommand:
-		return handleMGet(tokens)
-	case KeyExistsCommand:
-		return handleKeyExists(tokens)
-	case TypeCommand:
-		return handleType(tokens)
-	case SetCommand:
-		return handleSet(tokens)
-	case MSetCommand:
-		return handleMSet(tokens)
-	case SetexCommand:
-		return handleSetEx(tokens)
-	case ExpireCommand:
-		return handleExpire(tokens)
-	case PersistCommand:
-		return handlePersist(tokens)
-	case TTLCommand:
-		return handleTTL(tokens)
-	case RenameCommand:
-		return handleRename(tokens)
-	case RenameNXCommand:
-		return handleRenameNX(tokens)
-	case StatsCommand:
-		return handleStats(tokens)
-	case DeleteCommand:
-		return handleDelete(tokens)
-	case DelCommand:
-		return handleDel(tokens)
-	case DeleteexCommand:
-		return handleDeleteEx(tokens)
-	case FlushCommand:
-		return handleFlush(tokens)
-	case SaveCommand:
-		return handleSave(tokens)
-	case LoadCommand:
-		return handleLoad(tokens)
-	case KeysCommand:
-		return handleKeys(tokens)
-	case KeysWithTTLCommand:
-		return handleKeysWithTTL(tokens)
-	case KeysNoTTLCommand:
-		return handleKeysNoTTL(tokens)
-	case InfoCommand:
-		return handleInfo(tokens)
-	case HelpCommand:
-		return handleHelp(tokens)
-	case PingCommand:
-		return handlePing(tokens)
-	case ShutDownCommand:
-		return handleShutDown(tokens)
-	case SubscribeCommand:
-		return handleSubscribe(tokens, conn)
-	case UnsubscribeCommand:
-		return handleUnsubscribe(tokens, conn)
-	case PublishCommand:
-		return handlePublish(tokens)
-	default:
-		log.Printf("[WARN] Invalid command: %s\n", cmd)
+	spec, problem := lookupCommand(tokens)
+	if spec == nil {
+		metrics.Inc("ERROR")
+		return replyError(w, problem)
+	}
+
+	if problem := checkPermission(spec.name, conn); problem != "" {
+		metrics.Inc("ERROR")
+		return replyError(w, problem)
+	}
+
+	if currentState() == stateLoading && !loadingCommands[spec.name] {
 		metrics.Inc("ERROR")
-		return InvalidCommand
+		return replyError(w, LoadingDataset)
 	}
+
+	// Once shutdown starts writes are rejected so the final snapshot matches
+	// what clients were told
+	if spec.write {
+		if currentState() == stateDraining {
+			log.Printf("[WARN] Rejected %s during shutdown\n", spec.name)
+			metrics.Inc("ERROR")
+			return replyError(w, ShuttingDown)
+		}
+		if readOnly.Load() {
+			log.Printf("[WARN] Rejected %s in read-only mode\n", spec.name)
+			metrics.Inc("ERROR")
+			return replyError(w, ReadOnlyReplica)
+		}
+		if key, reserved := reservedKey(spec.name, tokens); reserved {
+			rejectReservedKey(spec.name, key)
+			return replyError(w, ReservedKeyPrefix)
+		}
+		if err := enforceMemoryLimit(spec.name); err != nil {
+			log.Printf("[WARN] Rejected %s: %v\n", spec.name, err)
+			metrics.Inc("ERROR")
+			return replyError(w, err.Error())
+		}
+		// EVAL forwards the writes its script makes itself
+		if spec.name == EvalCommand {
+			return handlerError(callHandler(ctx, spec, w, tokens, conn))
+		}
+		// Replicas may not define the same aliases, so they get the name of
+		// the command itself. Handlers may also rewrite their tokens to make
+		// the replicated command deterministic, as XADD does with generated
+		// IDs, so the same slice is both run and replicated.
+		if !strings.EqualFold(tokens[0], spec.name) {
+			tokens = append([]string{spec.name}, tokens[1:]...)
+		}
+		return replication.Write(spec.name, tokens, func() error {
+			return callHandler(ctx, spec, w, tokens, conn)
+		})
+	}
+	return handlerError(callHandler(ctx, spec, w, tokens, conn))
 }
 
-// Command handlers
-func handleGet(tokens []string) string {
-	if len(tokens) != 2 {
-		log.Println("[WARN] Invalid GET command format")
+// dispatchCommand runs the handler for tokens without the read-only and
+// shutdown checks in processCommand. Replicas use it directly to apply their
+// master's writes.
+func dispatchCommand(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	spec, problem := lookupCommand(tokens)
+	if spec == nil {
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("GET", "GET <key>")
+		return reply(w, problem)
 	}
+	return handlerError(callHandler(ctx, spec, w, tokens, conn))
+}
+
+// Command handlers
+func handleGet(ctx context.Context, w io.Writer, tokens []string) error {
 	key := tokens[1]
 	value, err := kv.Get(key)
 	if err != nil {
-		log.Printf("[WARN] GET %s -> key not found\n", key)
+		log.Printf("[WARN] GET %s -> %v\n", key, err)
 		metrics.Inc("ERROR")
-		return kvstore.KeyNotFound
+		return replyError(w, err.Error())
 	}
 	log.Printf("[INFO] GET %s -> %s\n", key, value)
 	metrics.Inc("GET")
-	return value
+	return reply(w, value)
 }
 
-func handleMGet(tokens []string) string {
-	if len(tokens) < 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("MGET", "MGET <key1> <key2> ...")
-	}
-
+func handleMGet(ctx context.Context, w io.Writer, tokens []string) error {
+	// Values are quoted so a missing key can't be confused with a value
+	// that happens to read "(nil)"
+	values, found := kv.MGet(tokens[1:]...)
 	var sb strings.Builder
-	for _, key := range tokens[1:] {
-		value, err := kv.Get(key)
-		if err != nil {
-			sb.WriteString("nil\n")
+	for i, value := range values {
+		if !found[i] {
+			sb.WriteString(NilReply + "\n")
 		} else {
-			sb.WriteString(value + "\n")
+			sb.WriteString(strconv.Quote(value) + "\n")
 		}
 	}
 
 	log.Printf("[INFO] MGET %v\n", tokens[1:])
 	metrics.Inc("MGET")
-	return strings.TrimRight(sb.String(), "\n")
+	return reply(w, strings.TrimRight(sb.String(), "\n"))
 }
 
-func handleKeyExists(tokens []string) string {
-	if len(tokens) != 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("KEYEXISTS", "KEYEXISTS <key>")
-	}
-
+func handleKeyExists(ctx context.Context, w io.Writer, tokens []string) error {
 	key := tokens[1]
 	keyExists := kv.Contains(key)
 	metrics.Inc("KEYEXISTS")
 
 	if keyExists {
 		log.Printf("[INFO] KEYEXISTS %s -> 1\n", key)
-		return "1"
+		return reply(w, "1")
 	}
 	log.Printf("[INFO] KEYEXISTS %s -> 0\n", key)
-	return "0"
+	return reply(w, "0")
 }
 
-func handleType(tokens []string) string {
-	if len(tokens) != 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("TYPE", "TYPE <key>")
-	}
-
+func handleType(ctx context.Context, w io.Writer, tokens []string) error {
 	key := tokens[1]
-	if kv.Contains(key) {
-		return "string"
-	}
+	valueType := kv.Type(key)
+	log.Printf("[INFO] TYPE %s -> %s\n", key, valueType)
 	metrics.Inc("TYPE")
-	return "none"
+	return reply(w, valueType.String())
 }
 
-func handleSet(tokens []string) string {
-	if len(tokens) != 3 {
-		log.Println("[WARN] Invalid SET command format")
+// handleSet stores a string. KEEPTTL keeps the key's TTL, PXAT sets it to
+// expire at a Unix time in milliseconds, which is how replicas are sent
+// SETEX.
+func handleSet(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "SET <key> <value> [KEEPTTL|PXAT <unix-time-ms>]"
+	key, value := tokens[1], tokens[2]
+	set := kv.Set
+	switch {
+	case len(tokens) == 4 && strings.ToUpper(tokens[3]) == "KEEPTTL":
+		set = kv.SetKeepTTL
+	case len(tokens) == 5 && strings.ToUpper(tokens[3]) == "PXAT":
+		at, err := strconv.ParseInt(tokens[4], 10, 64)
+		if err != nil || at <= 0 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("SET", format))
+		}
+		set = func(key, value string) error {
+			return kv.SetExAt(key, value, time.UnixMilli(at))
+		}
+	case len(tokens) > 3:
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("SET", "SET <key> <value>")
+		return replyError(w, formatInvalidCommand("SET", format))
+	}
+
+	if err := set(key, value); err != nil {
+		log.Printf("[WARN] SET %s -> %v\n", key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
 	}
-	key, value := tokens[1], tokens[2]
-	kv.Set(key, value)
 	log.Printf("[INFO] SET %s %s -> OK\n", key, value)
 	metrics.Inc("SET")
-	return OK
+	return reply(w, OK)
 }
 
-func handleMSet(tokens []string) string {
-	if len(tokens) < 3 || len(tokens)%2 != 1 {
+func handleAppend(ctx context.Context, w io.Writer, tokens []string) error {
+	key, value := tokens[1], tokens[2]
+	length, err := kv.Append(key, value)
+	if err != nil {
+		log.Printf("[WARN] APPEND %s -> %v\n", key, err)
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("MSET", "MSET <key1> <val1> <key2> <val2> ...")
+		return replyError(w, err.Error())
 	}
 
+	log.Printf("[INFO] APPEND %s %s -> %d\n", key, value, length)
+	metrics.Inc("APPEND")
+	return reply(w, strconv.Itoa(length))
+}
+
+func handleMSet(ctx context.Context, w io.Writer, tokens []string) error {
+	if len(tokens)%2 != 1 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("MSET", "MSET <key1> <val1> <key2> <val2> ..."))
+	}
+
+	// Keys are folded first so that, with case-insensitive keys, MSET A 1 a 2
+	// stores the last value once like setting them in turn would
+	pairs := make(map[string]string, len(tokens)/2)
 	for i := 1; i < len(tokens); i += 2 {
-		key, value := tokens[i], tokens[i+1]
-		kv.Set(key, value)
+		pairs[kv.FoldKey(tokens[i])] = tokens[i+1]
+	}
+	set, err := kv.MSet(pairs)
+	if err != nil {
+		log.Printf("[WARN] MSET -> %v\n", err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
 	}
 
-	log.Printf("[INFO] MSET -> %d keys set\n", len(tokens)/2)
+	log.Printf("[INFO] MSET -> %d keys set\n", set)
 	metrics.Inc("MSET")
-	return OK
+	return reply(w, strconv.Itoa(set))
 }
 
-func handleSetEx(tokens []string) string {
-	if len(tokens) != 4 {
-		log.Println("[WARN] Invalid SETEX command format")
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("SETEX", "SETEX <key> <value> <ttl_seconds>")
-	}
+func handleSetEx(ctx context.Context, w io.Writer, tokens []string) error {
 	key, value, ttlStr := tokens[1], tokens[2], tokens[3]
 
 	ttl, err := strconv.Atoi(ttlStr)
 	if err != nil || ttl <= 0 {
 		log.Println("[WARN] TTL in SETEX is not a positive integer")
 		metrics.Inc("ERROR")
-		return formatInvalidTTL(ttlStr)
+		return replyError(w, formatInvalidTTL(ttlStr))
 	}
 
-	kv.SetEx(key, value, ttl)
+	if err := kv.SetEx(key, value, ttl); err != nil {
+		log.Printf("[WARN] SETEX %s -> %v\n", key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
 	log.Printf("[INFO] SETEX %s %s (TTL: %d) -> OK\n", key, value, ttl)
 	metrics.Inc("SETEX")
-	return OK
+	return reply(w, OK)
+}
+
+// handleIncrExp counts hits in a fixed window: the first INCREXP creates the
+// key with a TTL of window seconds, later ones only increment it
+func handleIncrExp(ctx context.Context, w io.Writer, tokens []string) error {
+	key, windowStr := tokens[1], tokens[2]
+
+	window, err := strconv.Atoi(windowStr)
+	if err != nil || window <= 0 {
+		log.Println("[WARN] Window in INCREXP is not a positive integer")
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidTTL(windowStr))
+	}
+
+	count, err := kv.IncrExpire(key, window)
+	if err != nil {
+		log.Printf("[WARN] INCREXP %s -> %v\n", key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] INCREXP %s (window: %d) -> %d\n", key, window, count)
+	metrics.Inc("INCREXP")
+	return reply(w, strconv.FormatInt(count, 10))
 }
 
-func handleExpire(tokens []string) string {
-	if len(tokens) != 3 {
+// handleSetVer is a compare-and-set on the key's revision. Revisions are
+// local to each server, so replicas are sent the SET it amounts to, see
+// replicatedCommand.
+func handleSetVer(ctx context.Context, w io.Writer, tokens []string) error {
+	key, value := tokens[1], tokens[2]
+	expected, err := strconv.ParseInt(tokens[3], 10, 64)
+	if err != nil || expected < 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("SETVER", "SETVER <key> <value> <expected-rev>"))
+	}
+
+	revision, ok, err := kv.SetIfRevision(key, value, expected)
+	if err != nil {
+		log.Printf("[WARN] SETVER %s -> %v\n", key, err)
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("EXPIRE", "EXPIRE <key> <ttl_seconds>")
+		return replyError(w, err.Error())
 	}
+	metrics.Inc("SETVER")
+	if !ok {
+		log.Printf("[INFO] SETVER %s -> revision conflict, expected %d\n", key, expected)
+		if err := reply(w, NilReply); err != nil {
+			return err
+		}
+		return errNotApplied
+	}
+
+	log.Printf("[INFO] SETVER %s %s -> revision %d\n", key, value, revision)
+	return reply(w, strconv.FormatInt(revision, 10))
+}
 
+// handleGetVer replies with the value on one line and its revision on the next
+func handleGetVer(ctx context.Context, w io.Writer, tokens []string) error {
+	key := tokens[1]
+	value, revision, err := kv.GetVersioned(key)
+	if err != nil {
+		if err.Error() == kvstore.KeyNotFound {
+			metrics.Inc("GETVER")
+			return reply(w, NilReply)
+		}
+		log.Printf("[WARN] GETVER %s -> %v\n", key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] GETVER %s -> %s (revision %d)\n", key, value, revision)
+	metrics.Inc("GETVER")
+	return reply(w, value+"\n"+strconv.FormatInt(revision, 10))
+}
+
+func handleExpire(ctx context.Context, w io.Writer, tokens []string) error {
 	key, ttlStr := tokens[1], tokens[2]
 
 	ttl, err := strconv.Atoi(ttlStr)
 	if err != nil || ttl <= 0 {
 		log.Println("[WARN] TTL in SETEX is not a positive integer")
 		metrics.Inc("ERROR")
-		return formatInvalidTTL(ttlStr)
+		return replyError(w, formatInvalidTTL(ttlStr))
 	}
 
-	value, err := kv.Get(key)
-	if err != nil {
-		return "0"
+	if kv.Expire(key, ttl) == 0 {
+		if err := reply(w, "0"); err != nil {
+			return err
+		}
+		return errNotApplied
 	}
 
-	kv.SetEx(key, value, ttl)
 	log.Printf("[INFO] EXPIRE %s -> TTL set to %ds\n", key, ttl)
 	metrics.Inc("EXPIRE")
-	return OK
+	return reply(w, OK)
 }
 
-func handlePersist(tokens []string) string {
-	if len(tokens) != 2 {
+// handlePExpireAt is EXPIRE with a Unix time in milliseconds, which is how
+// replicas are sent EXPIRE
+func handlePExpireAt(ctx context.Context, w io.Writer, tokens []string) error {
+	key, atStr := tokens[1], tokens[2]
+
+	at, err := strconv.ParseInt(atStr, 10, 64)
+	if err != nil || at <= 0 {
+		log.Println("[WARN] Time in PEXPIREAT is not a positive integer")
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("PERSIST", "PERSIST <key>")
+		return replyError(w, formatInvalidCommand("PEXPIREAT", "PEXPIREAT <key> <unix-time-ms>"))
+	}
+
+	if kv.ExpireAt(key, time.UnixMilli(at)) == 0 {
+		if err := reply(w, "0"); err != nil {
+			return err
+		}
+		return errNotApplied
 	}
+
+	log.Printf("[INFO] PEXPIREAT %s -> expires at %d\n", key, at)
+	metrics.Inc("PEXPIREAT")
+	return reply(w, OK)
+}
+
+func handlePersist(ctx context.Context, w io.Writer, tokens []string) error {
 	key := tokens[1]
 	result := kv.Persist(key)
 	log.Printf("[INFO] PERSIST %s -> no TTL to remove\n", key)
 	metrics.Inc("PERSIST")
-	return strconv.Itoa(result)
+	return reply(w, strconv.Itoa(result))
 }
 
-func handleTTL(tokens []string) string {
-	if len(tokens) != 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("TTL", "TTL <key>")
-	}
+func handleTTL(ctx context.Context, w io.Writer, tokens []string) error {
 	key := tokens[1]
 	ttl := kv.TTL(key)
 
@@ -361,99 +673,86 @@ func handleTTL(tokens []string) string {
 	}
 
 	metrics.Inc("TTL")
-	return strconv.Itoa(ttl)
+	return reply(w, strconv.Itoa(ttl))
 }
 
-func handleRename(tokens []string) string {
-	if len(tokens) != 3 {
+func handleRename(ctx context.Context, w io.Writer, tokens []string) error {
+	oldKey, newKey := tokens[1], tokens[2]
+	result, err := kv.Rename(oldKey, newKey)
+	if err != nil {
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("RENAME", "RENAME <oldKey> <newKey>")
+		return replyError(w, err.Error())
 	}
 
-	oldKey, newKey := tokens[1], tokens[2]
-	result := kv.Rename(oldKey, newKey)
-
 	if result == 0 {
 		metrics.Inc("ERROR")
-		return strconv.Itoa(result)
+		if err := reply(w, strconv.Itoa(result)); err != nil {
+			return err
+		}
+		return errNotApplied
 	}
 
 	log.Printf("[INFO] RENAME %s -> %s\n", oldKey, newKey)
 	metrics.Inc("RENAME")
-	return strconv.Itoa(result)
+	return reply(w, strconv.Itoa(result))
 }
 
-func handleRenameNX(tokens []string) string {
-	if len(tokens) != 3 {
+func handleRenameNX(ctx context.Context, w io.Writer, tokens []string) error {
+	oldKey, newKey := tokens[1], tokens[2]
+	result, err := kv.RenameNX(oldKey, newKey)
+	if err != nil {
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("RENAME_NX", "RENAME_NX <oldKey> <newKey>")
+		return replyError(w, err.Error())
 	}
 
-	oldKey, newKey := tokens[1], tokens[2]
-	result := kv.RenameNX(oldKey, newKey)
-
 	if result == 0 {
 		metrics.Inc("ERROR")
-		return strconv.Itoa(result)
+		if err := reply(w, strconv.Itoa(result)); err != nil {
+			return err
+		}
+		return errNotApplied
 	}
 
 	log.Printf("[INFO] RENAME_NX %s -> %s success\n", oldKey, newKey)
 	metrics.Inc("RENAME_NX")
-	return strconv.Itoa(result)
+	return reply(w, strconv.Itoa(result))
 }
 
-func handleStats(tokens []string) string {
-	if len(tokens) != 1 {
-		log.Println("[WARN] Invalid STATS command format")
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("STATS", "STATS")
-	}
-	return statsString()
+func handleStats(ctx context.Context, w io.Writer, tokens []string) error {
+	return reply(w, statsString())
 }
 
-func handleDelete(tokens []string) string {
-	if len(tokens) != 2 {
-		log.Println("[WARN] Invalid DELETE command format")
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("DELETE", "DELETE <key>")
-	}
-	key := tokens[1]
-	err := kv.Delete(key)
-	if err != nil {
-		log.Printf("[WARN] GET %s -> key not found\n", key)
-		metrics.Inc("ERROR")
-		return kvstore.KeyNotFound
-	}
-	metrics.Inc("DELETE")
-	log.Printf("[INFO] DELETE %s -> OK\n", tokens[1])
-	return OK
+// RESETSTATS isn't counted itself, so STATS right after it reports zeros
+func handleResetStats(ctx context.Context, w io.Writer, tokens []string) error {
+	previous := metrics.Reset()
+	log.Printf("[INFO] RESETSTATS: counters reset, previous values %v\n", previous)
+	return reply(w, OK)
 }
 
-func handleDel(tokens []string) string {
-	if len(tokens) < 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("DEL", "DEL <key1> <key2> ...")
-	}
-
-	count := 0
+// handleDel serves both DEL and DELETE, replying with the number of keys
+// that existed. Missing keys aren't an error. If it's aborted partway,
+// replicas are only sent a DEL of the keys it had already removed.
+func handleDel(ctx context.Context, w io.Writer, tokens []string) error {
+	cmd := strings.ToUpper(tokens[0])
+	var deleted []string
 	for _, key := range tokens[1:] {
-		err := kv.Delete(key)
-		if err == nil {
-			count++
+		if ctx.Err() != nil {
+			err := abortCommand(ctx, w, cmd)
+			if err != errRejected || len(deleted) == 0 {
+				return err
+			}
+			return &partialWrite{tokens: append([]string{tokens[0]}, deleted...)}
+		}
+		if err := kv.Delete(key); err == nil {
+			deleted = append(deleted, key)
 		}
 	}
-	log.Printf("[INFO] DEL %v -> %d keys deleted\n", tokens[1:], count)
-	metrics.Inc("DEL")
-	return strconv.Itoa(count)
+	log.Printf("[INFO] %s %v -> %d keys deleted\n", cmd, tokens[1:], len(deleted))
+	metrics.Inc(cmd)
+	return reply(w, strconv.Itoa(len(deleted)))
 }
 
-func handleDeleteEx(tokens []string) string {
-	if len(tokens) != 3 {
-		log.Println("[WARN] Invalid DELETEX command format")
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("DELETEEX", "DELETEEX <key> <ttl_seconds>")
-	}
-
+func handleDeleteEx(ctx context.Context, w io.Writer, tokens []string) error {
 	key, delayStr := tokens[1], tokens[2]
 
 	// Validate key
@@ -461,7 +760,7 @@ func handleDeleteEx(tokens []string) string {
 	if err != nil {
 		log.Printf("[WARN] DELETEX %s %s -> key not found\n", key, delayStr)
 		metrics.Inc("ERROR")
-		return kvstore.KeyNotFound
+		return replyError(w, kvstore.KeyNotFound)
 	}
 
 	// Validate time
@@ -469,7 +768,7 @@ func handleDeleteEx(tokens []string) string {
 	if err != nil || delay <= 0 {
 		log.Printf("[WARN] Time in DELETEX is not a positive integer: %s\n", delayStr)
 		metrics.Inc("ERROR")
-		return formatInvalidTTL(delayStr)
+		return replyError(w, formatInvalidTTL(delayStr))
 	}
 
 	// Schedule deletion
@@ -478,219 +777,512 @@ func handleDeleteEx(tokens []string) string {
 		log.Printf("[INFO] DELETEEX %s %s -> OK\n", key, delayStr)
 		kv.Delete(key)
 	})
-	return OK
+	return reply(w, OK)
 }
 
-func handleFlush(tokens []string) string {
-	if len(tokens) != 1 {
+func handleFlushDB(ctx context.Context, w io.Writer, tokens []string) error {
+	cmd := strings.ToUpper(tokens[0])
+	async, ok := parseFlushMode(tokens)
+	if !ok {
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("FLUSH", "FLUSH")
+		return replyError(w, formatInvalidCommand(cmd, cmd+" [ASYNC]"))
 	}
 
-	kv.Flush()
-	log.Println("[INFO] FLUSH: store cleared")
-	metrics.Inc("FLUSH")
+	flush(async)
+	log.Printf("[INFO] %s: store cleared\n", cmd)
+	metrics.Inc(cmd)
 
-	return OK
+	return reply(w, OK)
 }
 
-func handleSave(tokens []string) string {
-	if len(tokens) != 1 {
+// There is a single database, so FLUSHALL clears the same store as FLUSHDB
+func handleFlushAll(ctx context.Context, w io.Writer, tokens []string) error {
+	async, ok := parseFlushMode(tokens)
+	if !ok {
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("SAVE", "SAVE")
+		return replyError(w, formatInvalidCommand("FLUSHALL", "FLUSHALL [ASYNC]"))
 	}
 
-	err := kv.SaveToDisk(FileName)
+	flush(async)
+	log.Println("[INFO] FLUSHALL: all databases cleared")
+	metrics.Inc("FLUSHALL")
+
+	return reply(w, OK)
+}
+
+func handleSave(ctx context.Context, w io.Writer, tokens []string) error {
+	if ctx.Err() != nil {
+		return abortCommand(ctx, w, "SAVE")
+	}
+
+	fileName := FileName
+	if len(tokens) == 2 {
+		var err error
+		fileName, err = resolveDataPath(tokens[1])
+		if err != nil {
+			metrics.Inc("ERROR")
+			return replyError(w, err.Error())
+		}
+	}
+
+	err := saveTo(fileName)
 	if err != nil {
 		log.Printf("[ERROR] Failed to save data: %v\n", err)
 		metrics.Inc("ERROR")
-		return fmt.Sprintf("ERROR: Failed to save to disk: %v", err)
+		return replyError(w, fmt.Sprintf("ERROR: Failed to save to disk: %v", err))
 	}
 
-	log.Println("[INFO] SAVE: store saved to disk")
+	log.Printf("[INFO] SAVE: store saved to %s\n", fileName)
 	metrics.Inc("SAVE")
-	return OK
+	return reply(w, OK)
 }
 
-func handleLoad(tokens []string) string {
-	if len(tokens) != 1 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("LOAD", "LOAD")
+func handleLoad(ctx context.Context, w io.Writer, tokens []string) error {
+	if ctx.Err() != nil {
+		return abortCommand(ctx, w, "LOAD")
 	}
 
-	err := kv.LoadFromDisk(FileName)
+	// The file name is optional, so a leading MERGE is the mode, not a name
+	fileName, mode := FileName, tokens[1:]
+	if len(mode) > 0 && strings.ToUpper(mode[0]) != "MERGE" {
+		var err error
+		fileName, err = resolveDataPath(mode[0])
+		if err != nil {
+			metrics.Inc("ERROR")
+			return replyError(w, err.Error())
+		}
+		mode = mode[1:]
+	}
+	if len(mode) > 0 {
+		return handleLoadMerge(ctx, w, fileName, mode)
+	}
+
+	err := kv.LoadFromDisk(fileName)
 	if err != nil {
 		log.Printf("[ERROR] Failed to load data: %v\n", err)
 		metrics.Inc("ERROR")
-		return fmt.Sprintf("ERROR: Failed to load data from disk: %v", err)
+		return replyError(w, fmt.Sprintf("ERROR: Failed to load data from disk: %v", err))
 	}
 
-	log.Println("[INFO] LOAD: loaded stroe from disk")
+	log.Printf("[INFO] LOAD: loaded stroe from %s\n", fileName)
 	metrics.Inc("LOAD")
-	return OK
+	return reply(w, OK)
 }
 
-func handleKeys(tokens []string) string {
-	if len(tokens) != 1 {
-		log.Println("[WARN] Invalid KEYS command format")
+// LOAD MERGE keeps in-memory values on conflict, LOAD MERGE REPLACE lets the
+// file win
+func handleLoadMerge(ctx context.Context, w io.Writer, fileName string, options []string) error {
+	mode := strings.ToUpper(strings.Join(options, " "))
+	if mode != "MERGE" && mode != "MERGE REPLACE" {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("LOAD", "LOAD [path] [MERGE [REPLACE]]"))
+	}
+
+	merged, err := kv.MergeFromDisk(fileName, mode == "MERGE REPLACE")
+	if err != nil {
+		log.Printf("[ERROR] Failed to merge data: %v\n", err)
+		metrics.Inc("ERROR")
+		return replyError(w, fmt.Sprintf("ERROR: Failed to load data from disk: %v", err))
+	}
+
+	log.Printf("[INFO] LOAD %s: merged %d keys from %s\n", mode, merged, fileName)
+	metrics.Inc("LOAD")
+	return reply(w, strconv.Itoa(merged))
+}
+
+func handleExportCSV(ctx context.Context, w io.Writer, tokens []string) error {
+	fileName, err := resolveDataPath(tokens[1])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		log.Printf("[ERROR] Failed to export CSV: %v\n", err)
+		metrics.Inc("ERROR")
+		return replyError(w, fmt.Sprintf("ERROR: Failed to export CSV: %v", err))
+	}
+	defer file.Close()
+
+	err = kv.ExportCSV(file)
+	if err != nil {
+		log.Printf("[ERROR] Failed to export CSV: %v\n", err)
+		metrics.Inc("ERROR")
+		return replyError(w, fmt.Sprintf("ERROR: Failed to export CSV: %v", err))
+	}
+
+	log.Printf("[INFO] EXPORTCSV: store exported to %s\n", fileName)
+	metrics.Inc("EXPORTCSV")
+	return reply(w, OK)
+}
+
+func handleImportCSV(ctx context.Context, w io.Writer, tokens []string) error {
+	fileName, err := resolveDataPath(tokens[1])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		log.Printf("[ERROR] Failed to import CSV: %v\n", err)
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("KEYS", "KEYS")
+		return replyError(w, fmt.Sprintf("ERROR: Failed to import CSV: %v", err))
+	}
+	defer file.Close()
+
+	count, err := kv.ImportCSV(file)
+	if err != nil {
+		log.Printf("[ERROR] Failed to import CSV: %v\n", err)
+		metrics.Inc("ERROR")
+		return replyError(w, fmt.Sprintf("ERROR: Failed to import CSV: %v", err))
+	}
+
+	log.Printf("[INFO] IMPORTCSV: %d keys imported from %s\n", count, fileName)
+	metrics.Inc("IMPORTCSV")
+	return reply(w, strconv.Itoa(count))
+}
+
+// handleKeys streams keys in batches so a huge keyspace is never joined into
+// a single response in memory
+func handleKeys(ctx context.Context, w io.Writer, tokens []string) error {
+	count := 0
+	err := kv.ForEachKeyBatch(streamBatchSize, func(keys []string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for _, key := range keys {
+			if count > 0 {
+				if err := reply(w, "\n"); err != nil {
+					return err
+				}
+			}
+			if err := reply(w, key); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	keys := kv.Keys()
 	metrics.Inc("KEYS")
-	log.Printf("[INFO] KEYS -> %v\n", keys)
+	log.Printf("[INFO] KEYS -> %d keys\n", count)
 
-	if len(keys) == 0 {
-		return "EMPTY"
+	if count == 0 {
+		return reply(w, "EMPTY")
 	}
-	return strings.Join(keys, "\n")
+	return nil
 }
 
-func handleKeysWithTTL(tokens []string) string {
-	if len(tokens) != 1 {
+func handleScan(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "SCAN <cursor> [COUNT <count>] [TYPE <type>]"
+	if len(tokens)%2 != 0 {
 		metrics.Inc("ERROR")
-		return formatInvalidCommand("KEYS_WITH_TTL", "KEYS_WITH_TTL")
+		return replyError(w, formatInvalidCommand("SCAN", format))
 	}
 
+	cursor := tokens[1]
+	after, ok := decodeScanCursor(cursor)
+	if !ok {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("SCAN", format))
+	}
+
+	count := DefaultScanCount
+	valueType := kvstore.TypeNone
+	for i := 2; i < len(tokens); i += 2 {
+		option, arg := strings.ToUpper(tokens[i]), tokens[i+1]
+		switch option {
+		case "COUNT":
+			var err error
+			count, err = strconv.Atoi(arg)
+			if err != nil || count <= 0 {
+				metrics.Inc("ERROR")
+				return replyError(w, formatInvalidCommand("SCAN", format))
+			}
+		case "TYPE":
+			var ok bool
+			valueType, ok = kvstore.ParseValueType(arg)
+			if !ok {
+				metrics.Inc("ERROR")
+				return replyError(w, fmt.Sprintf("ERROR: Unknown type '%s'", arg))
+			}
+		default:
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("SCAN", format))
+		}
+	}
+
+	keys, last := kv.Scan(after, count, valueType)
+	next := encodeScanCursor(last)
+	metrics.Inc("SCAN")
+	log.Printf("[INFO] SCAN %s -> %d keys, next cursor %s\n", cursor, len(keys), next)
+
+	return reply(w, strings.Join(append([]string{next}, keys...), "\n"))
+}
+
+// A SCAN cursor is the hex-encoded last key walked, or 0 at the start and
+// end of an iteration. Hex never has an odd length, so it can't be 0.
+func encodeScanCursor(last string) string {
+	if last == "" {
+		return "0"
+	}
+	return hex.EncodeToString([]byte(last))
+}
+
+func decodeScanCursor(cursor string) (string, bool) {
+	if cursor == "0" {
+		return "", true
+	}
+	after, err := hex.DecodeString(cursor)
+	return string(after), err == nil && len(after) > 0
+}
+
+func handlePrefix(ctx context.Context, w io.Writer, tokens []string) error {
+	prefix := tokens[1]
+	keys := kv.KeysWithPrefix(prefix)
+	metrics.Inc("PREFIX")
+	log.Printf("[INFO] PREFIX %s -> %v\n", prefix, keys)
+
+	if len(keys) == 0 {
+		return reply(w, "EMPTY")
+	}
+	return reply(w, strings.Join(keys, "\n"))
+}
+
+func handleKeysWithTTL(ctx context.Context, w io.Writer, tokens []string) error {
 	keys := kv.KeysWithTTL()
 	metrics.Inc("KEYS_WITH_TTL")
 	log.Printf("[INFO] KEYS_WITH_TTL -> %v\n", keys)
 
 	if len(keys) == 0 {
-		return "EMPTY"
+		return reply(w, "EMPTY")
 	}
-	return strings.Join(keys, "\n")
+	return reply(w, strings.Join(keys, "\n"))
 }
 
-func handleKeysNoTTL(tokens []string) string {
-	if len(tokens) != 1 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("KEYS_NO_TTL", "KEYS_NO_TTL")
-	}
-
+func handleKeysNoTTL(ctx context.Context, w io.Writer, tokens []string) error {
 	keys := kv.KeysNoTTL()
 	metrics.Inc("KEYS_NO_TTL")
 	log.Printf("[INFO] KEYSKEYS_NO_TTL_WITH_TTL -> %v\n", keys)
 
 	if len(keys) == 0 {
-		return "EMPTY"
+		return reply(w, "EMPTY")
 	}
-	return strings.Join(keys, "\n")
+	return reply(w, strings.Join(keys, "\n"))
 }
 
-func handleInfo(tokens []string) string {
-	if len(tokens) != 1 {
-		log.Println("[WARN] Invalid INFO command format")
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("INFO", "INFO")
-	}
+func handleInfo(ctx context.Context, w io.Writer, tokens []string) error {
 	uptime := time.Since(startTime)
 
 	metrics.mu.RLock()
 	activeClients := metrics.ActiveClients
+	evictedKeys := metrics.EvictedKeys
+	expiredKeys := metrics.ExpiredKeys
 	metrics.mu.RUnlock()
 
 	commandsProcessed := metrics.TotalCommands()
 	keysInStore := len(kv.Keys())
+	memoryUsage := kv.TotalMemoryUsage()
+	idle := connections.IdleBuckets(idleBounds)
+
+	nextExpiry := "none"
+	if untilExpiry, ok := kv.NextExpiry(); ok {
+		nextExpiry = untilExpiry.Round(time.Millisecond).String()
+	}
+
+	loadProgress := "none"
+	if read, total, loading := kv.LoadProgress(); loading {
+		loadProgress = fmt.Sprintf("%d%% (%d of %d bytes)", read*100/total, read, total)
+	}
 
 	info := fmt.Sprintf(
 		"Server Version: %s\n"+
 			"Uptime: %s\n"+
 			"Active Clients: %d\n"+
 			"Total Commands Processed: %d\n"+
-			"Keys in Store: %d",
+			"Keys in Store: %d\n"+
+			"Keys with TTL: %d\n"+
+			"Next Expiry In: %s\n"+
+			"Loading Progress: %s\n"+
+			"Used Memory (estimated): %d bytes\n"+
+			"Max Memory: %d bytes\n"+
+			"Max Memory Policy: %s\n"+
+			"Max Key Size: %d bytes\n"+
+			"Max Value Size: %d bytes\n"+
+			"Evicted Keys: %d\n"+
+			"Expired Keys: %d\n"+
+			"Changes Since Last Save: %d\n"+
+			"Last Save: %s\n"+
+			"Clients Idle <10s: %d\n"+
+			"Clients Idle 10s-1m: %d\n"+
+			"Clients Idle 1m-10m: %d\n"+
+			"Clients Idle >10m: %d\n"+
+			"Role: %s\n"+
+			"Connected Replicas: %d\n"+
+			"Replication Offset: %d",
 		ServerVersion,
 		uptime.Truncate(time.Second),
 		activeClients,
 		commandsProcessed,
 		keysInStore,
+		kv.ExpiringCount(),
+		nextExpiry,
+		loadProgress,
+		memoryUsage,
+		config.MaxMemory,
+		config.MaxMemoryPolicy,
+		config.MaxKeyBytes,
+		config.MaxValueBytes,
+		evictedKeys,
+		expiredKeys,
+		dirty.Load(),
+		time.Unix(lastSave.Load(), 0).Format(time.RFC3339),
+		idle[0], idle[1], idle[2], idle[3],
+		replication.Role(),
+		replication.ReplicaCount(),
+		replication.Offset(),
 	)
 
 	metrics.Inc("INFO")
 	log.Println("[INFO] INFO command requested")
-	return info
+	return reply(w, info)
 }
 
-func handleHelp(tokens []string) string {
-	if len(tokens) != 1 {
-		log.Println("[WARN] Invalid HELP command format")
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("INFO", "INFO")
-	}
-
+func handleHelp(ctx context.Context, w io.Writer, tokens []string) error {
 	metrics.Inc("HELP")
 	log.Println("[INFO] HELP command requested")
-	return `Available commands:
-	SET <key> <value>          - Store a key-value pair
+	help := `Available commands:
+	SET <key> <value> [KEEPTTL] - Store a key-value pair, KEEPTTL keeps the key's expiration
+	APPEND <key> <value>       - Add to the end of a string, creating it if needed
+	INCREXP <key> <window>     - Increment a counter, expiring it window seconds after it's created
+	SETVER <key> <value> <rev> - Store a value only if the key is at revision rev (0: must not exist)
+	GETVER <key>               - Retrieve a value and its revision
 	GET <key>                  - Retrieve a value
+	BGET <key> <timeout-ms>    - Wait for a key to be set, (nil) on timeout, 0 waits forever
 	SETEX <key> <value> <ttl>  - Store a key-value pair with expiration
-	DELETE <key>               - Remove a key
+	DEL <key> ...              - Remove keys, replying with how many existed
+	DELETE <key> ...           - Same as DEL
 	DELETEEX <key> <ttl>       - Remove a key after a delay
 	KEYEXISTS <key>            - Check if a key exists
-	FLUSH                      - Clear all keys
+	ZADD <key> <score> <member> ... - Add members to a sorted set
+	ZSCORE <key> <member>      - Get the score of a sorted set member
+	ZRANGE <key> <start> <stop> [WITHSCORES] - List sorted set members by rank
+	ZRANK <key> <member>       - Get the rank of a sorted set member
+	ZRANGEBYSCORE <key> <min> <max> [WITHSCORES] [LIMIT offset count] - List members by score, "(" marks an exclusive bound
+	ZINCRBY <key> <delta> <member> - Add to a member's score, returning the new score
+	ZSCAN <key> <cursor> [MATCH pattern] [COUNT n] - Iterate sorted set members and scores in batches
+	XADD <key> <id|*> <field> <value> ... - Append an entry to a stream, * generates the ID
+	XLEN <key>                 - Count the entries of a stream
+	XRANGE <key> <start> <end> [COUNT n] - List stream entries by ID, - and + for the ends
+	XREAD [COUNT n] STREAMS <key> ... <id> ... - List stream entries after the given IDs
+	JSON.SET <key> <path> <json> - Store a JSON value at a path, e.g. $ or $.a.b[0]
+	JSON.GET <key> [path]      - Get the JSON value at a path, the whole document by default
+	JSON.DEL <key> <path>      - Delete the JSON value at a path, $ deletes the key
+	EVAL <script> <numkeys> [<key> ...] [<arg> ...] - Run commands separated by ; atomically, e.g. SET,KEYS[1],ARGV[1];GET,KEYS[1]
+	FLUSHDB [ASYNC]            - Clear the current database (alias: FLUSH)
+	FLUSHALL [ASYNC]           - Clear every database
 	KEYS                       - List all keys
+	SCAN <cursor> [COUNT n] [TYPE t] - Iterate keys in batches, optionally by type
+	PREFIX <prefix>            - List keys starting with prefix
 	STATS                      - Show usage metrics
+	RESETSTATS                 - Zero the command counters
+	CLIENT INFO                - Show details about this connection
 	INFO                       - Show server config
-	PING                       - Check if server is alive
-	SAVE                       - Save store to disk
-	LOAD                       - Load store from disk
+	HEALTH                     - Report OK, LOADING or DRAINING
+	AUTH <user> <password>     - Authenticate as a user from -aclfile
+	PING [message]             - Check if server is alive, echoing message if given
+	OBJECT <subcommand> <key>  - Inspect ENCODING, IDLETIME, REFCOUNT or FREQ (lfu policy only) of a key
+	MEMORY USAGE <key>         - Estimate the bytes used by a key
+	MEMORY STATS|DOCTOR        - Summarize estimated memory usage
+	SAVE [path]                - Save store to disk
+	BGSAVE                     - Save store to disk in the background
+	LOAD [path] [MERGE [REPLACE]] - Load store from disk, MERGE keeps existing keys unless REPLACE is given
+	EXPORTCSV <file>           - Export keys as key,value,ttl_seconds rows
+	IMPORTCSV <file>           - Import keys from a CSV file
+	REPLICAOF <host> <port>    - Replicate another server, rejecting writes (NO ONE to stop)
+	WAIT <numreplicas> <timeout-ms> - Report the number of connected replicas
+	COMMAND COUNT|DOCS [name]  - Describe the supported commands
+	DEBUG SLEEP <seconds>      - Block this connection, needs -enable-debug
+	DEBUG SET-ACTIVE-EXPIRE 0|1 - Pause or resume the background expiry, needs -enable-debug
+	DEBUG EXPIRE-SCAN          - Remove expired keys now and count them, needs -enable-debug
+	QUIT                       - Close the connection
 	SHUTDOWN                   - Gracefully stop the server
 	HELP                       - Show this help message`
+	if len(aliases) > 0 {
+		help += "\nAliases:"
+		for _, name := range sortedAliases() {
+			help += fmt.Sprintf("\n\t%s -> %s", name, aliases[name])
+		}
+	}
+	return reply(w, help)
 }
 
-func handlePing(tokens []string) string {
-	if len(tokens) != 1 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("PING", "PING")
-	}
+func handlePing(ctx context.Context, w io.Writer, tokens []string) error {
 	metrics.Inc("PING")
-	return "PONG"
+	if len(tokens) == 2 {
+		return reply(w, tokens[1])
+	}
+	return reply(w, "PONG")
 }
 
-func handleShutDown(tokens []string) string {
-	if len(tokens) != 1 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("SHUTDOWN", "SHUTDOWN")
-	}
+// The connection itself is closed by handleConnection once the reply is sent
+func handleQuit(ctx context.Context, w io.Writer, tokens []string) error {
+	metrics.Inc("QUIT")
+	return reply(w, OK)
+}
+
+func handleShutDown(ctx context.Context, w io.Writer, tokens []string) error {
 	go triggerSIGINT()
-	return "Server shutting down..."
+	return reply(w, "Server shutting down...")
 }
 
-func handleSubscribe(tokens []string, conn net.Conn) string {
-	if len(tokens) != 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("SUBSCRIBE", "SUBSCRIBE <channel>")
+// handleSubscribe subscribes the client to a channel. With REPLAY n the
+// channel's last n messages are pushed first, ahead of the reply.
+func handleSubscribe(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	const format = "SUBSCRIBE <channel> [REPLAY <count>]"
+	channel := tokens[1]
+
+	replay := 0
+	if len(tokens) > 2 {
+		if len(tokens) != 4 || strings.ToUpper(tokens[2]) != "REPLAY" {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("SUBSCRIBE", format))
+		}
+		var err error
+		replay, err = strconv.Atoi(tokens[3])
+		if err != nil || replay < 0 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("SUBSCRIBE", format))
+		}
+		if pubsub.HistorySize() == 0 {
+			metrics.Inc("ERROR")
+			return replyError(w, HistoryDisabled)
+		}
 	}
 
-	channel := tokens[1]
-	pubsub.Subscribe(channel, conn)
+	replayed, err := pubsub.SubscribeReplay(channel, conn, replay)
+	if err != nil {
+		return err
+	}
 
 	metrics.Inc("SUBSCRIBE")
-	log.Printf("[INFO] %s subscribed to %s\n", getAddress(conn), tokens[1])
-	return fmt.Sprintf("Subscribed to %s", channel)
+	log.Printf("[INFO] %s subscribed to %s (%d replayed)\n", getAddress(conn), channel, replayed)
+	return reply(w, fmt.Sprintf("Subscribed to %s", channel))
 }
 
-func handleUnsubscribe(tokens []string, conn net.Conn) string {
-	if len(tokens) != 2 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("UNSUBSCRIBE", "UNSUBSCRIBE <channel>")
-	}
-
+func handleUnsubscribe(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
 	channel := tokens[1]
 	pubsub.Unsubscribe(channel, conn)
 
 	metrics.Inc("UNSUBSCRIBE")
 	log.Printf("[INFO] %s unsubscribed from %s\n", getAddress(conn), tokens[1])
-	return fmt.Sprintf("Unsubscribed from %s", channel)
+	return reply(w, fmt.Sprintf("Unsubscribed from %s", channel))
 }
 
-func handlePublish(tokens []string) string {
-	if len(tokens) < 3 {
-		metrics.Inc("ERROR")
-		return formatInvalidCommand("PUBLISH", "PUBLISH <channel> <message>")
-	}
-
+func handlePublish(ctx context.Context, w io.Writer, tokens []string) error {
 	channel := tokens[1]
 
 	messageTokens := tokens[2:]
@@ -699,37 +1291,198 @@ func handlePublish(tokens []string) string {
 
 	metrics.Inc("PUBLISH")
 	log.Printf("[INFO] Published to %s (%d subscribers)\n", channel, count)
-	return fmt.Sprintf("%d", count)
+	return reply(w, fmt.Sprintf("%d", count))
+}
+
+func handleObject(ctx context.Context, w io.Writer, tokens []string) error {
+	subcommand, key := strings.ToUpper(tokens[1]), tokens[2]
+	var result string
+	var err error
+
+	switch subcommand {
+	case "ENCODING":
+		result, err = kv.Encoding(key)
+	case "IDLETIME":
+		var idle int
+		idle, err = kv.IdleTime(key)
+		result = strconv.Itoa(idle)
+	case "REFCOUNT":
+		// Values are never shared between keys
+		if !kv.Contains(key) {
+			err = errors.New(kvstore.KeyNotFound)
+		}
+		result = "1"
+	case "FREQ":
+		var freq int
+		freq, err = kv.Frequency(key)
+		result = strconv.Itoa(freq)
+	default:
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("OBJECT", "OBJECT <ENCODING|IDLETIME|REFCOUNT|FREQ> <key>"))
+	}
+
+	if err != nil {
+		log.Printf("[WARN] OBJECT %s %s -> %v\n", subcommand, key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] OBJECT %s %s -> %s\n", subcommand, key, result)
+	metrics.Inc("OBJECT")
+	return reply(w, result)
+}
+
+func handleClient(ctx context.Context, w io.Writer, tokens []string, conn net.Conn) error {
+	if strings.ToUpper(tokens[1]) != "INFO" {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("CLIENT", "CLIENT INFO"))
+	}
+
+	info := connections.Info(conn)
+	if info == nil {
+		metrics.Inc("ERROR")
+		return replyError(w, "ERROR: Unknown connection")
+	}
+	snapshot := info.Snapshot()
+
+	metrics.Inc("CLIENT")
+	return reply(w, fmt.Sprintf(
+		"ID: %d\n"+
+			"Address: %s\n"+
+			"Age: %s\n"+
+			"Idle: %s\n"+
+			"Last Command: %s\n"+
+			"Bytes Read: %d\n"+
+			"Bytes Written: %d",
+		snapshot.ID,
+		snapshot.Addr,
+		time.Since(snapshot.ConnectedAt).Truncate(time.Second),
+		time.Since(snapshot.LastActive).Truncate(time.Second),
+		snapshot.LastCommand,
+		snapshot.BytesRead,
+		snapshot.BytesWritten,
+	))
+}
+
+func handleMemory(ctx context.Context, w io.Writer, tokens []string) error {
+	subcommand := strings.ToUpper(tokens[1])
+	switch {
+	case subcommand == "USAGE" && len(tokens) == 3:
+		key := tokens[2]
+		usage, err := kv.MemoryUsage(key)
+		if err != nil {
+			log.Printf("[WARN] MEMORY USAGE %s -> key not found\n", key)
+			metrics.Inc("ERROR")
+			return replyError(w, kvstore.KeyNotFound)
+		}
+		log.Printf("[INFO] MEMORY USAGE %s -> %d bytes\n", key, usage)
+		metrics.Inc("MEMORY")
+		return reply(w, strconv.Itoa(usage))
+	case subcommand == "STATS" && len(tokens) == 2:
+		keys := len(kv.Keys())
+		total := kv.TotalMemoryUsage()
+		average := 0
+		if keys > 0 {
+			average = total / keys
+		}
+		metrics.Inc("MEMORY")
+		return reply(w, fmt.Sprintf("Total memory (estimated): %d bytes\nKeys: %d\nBytes per key: %d", total, keys, average))
+	case subcommand == "DOCTOR" && len(tokens) == 2:
+		metrics.Inc("MEMORY")
+		return reply(w, fmt.Sprintf("Estimated memory usage is %d bytes across %d keys. Use MEMORY USAGE <key> to find large keys.",
+			kv.TotalMemoryUsage(), len(kv.Keys())))
+	default:
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("MEMORY", "MEMORY <USAGE <key>|STATS|DOCTOR>"))
+	}
 }
 
 // Helper methods
+// getAddress names the client at the other end of conn. Clients of the Unix
+// socket have no address of their own, so they're named after the socket,
+// and a nil conn is a command that didn't come from a client connection,
+// such as an HTTP request.
 func getAddress(conn net.Conn) string {
-	return conn.RemoteAddr().String()
+	if conn == nil {
+		return "internal"
+	}
+	if addr := conn.RemoteAddr(); addr.Network() != "unix" {
+		return addr.String()
+	}
+	return "unix:" + conn.LocalAddr().String()
 }
 
-func setupShutdownHook(ln net.Listener) {
+// readLine reads a single command line of at most limit bytes. An oversized
+// line is discarded up to its newline and reported as errRequestTooLarge so
+// the connection can carry on with the next command.
+func readLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if limit > 0 && len(line)+len(chunk) > limit {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", errRequestTooLarge
+		}
+
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+func setupShutdownHook(listeners []net.Listener) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigCh
 		log.Println("[INFO] Shutting down server...")
+		previous := startDraining()
 		connections.CloseAll()
+		stopHTTPGateway()
 
-		log.Println("[INFO] Saving data to disk...")
-		err := kv.SaveToDisk(FileName)
-		if err != nil {
-			log.Printf("[ERROR] Error while saving data to disk: %s\n", err)
+		if previous == stateLoading {
+			// Saving a partially loaded store would lose the rest of the snapshot
+			log.Println("[WARN] Shutting down before the snapshot finished loading, not saving")
+		} else {
+			log.Println("[INFO] Saving data to disk...")
+			err := saveTo(FileName)
+			if err != nil {
+				log.Printf("[ERROR] Error while saving data to disk: %s\n", err)
+			}
 		}
 
 		close(done)
-		ln.Close()
+		for _, ln := range listeners {
+			ln.Close()
+		}
 	}()
 }
 
+// refreshReadDeadline gives the client another idle timeout to send
+// its next command. Subscribers legitimately sit idle waiting for messages,
+// so they get no read deadline at all.
+func refreshReadDeadline(conn net.Conn) {
+	timeout := currentIdleTimeout()
+	if timeout <= 0 || pubsub.IsSubscribed(conn) || replication.HasReplica(conn) {
+		conn.SetReadDeadline(time.Time{})
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
 func disconnect(conn net.Conn) {
 	conn.Close()
 	connections.Remove(conn)
+	pubsub.UnsubscribeAll(conn)
+	replication.RemoveReplica(conn)
 	metrics.DecActiveClients()
 }
 
@@ -739,17 +1492,69 @@ func statsString() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("Active clients: %d\n", snapshot.ActiveClients))
 
-	tracked := []string{
-		"SET", "GET", "SETEX", "DELETE", "DELETEEX", "KEYEXISTS", "FLUSH", "SAVE", "LOAD",
-		"KEYS", "PING", "INFO", "HELP", "ERROR",
+	// Report every command that has been counted, sorted for stable output
+	commands := make([]string, 0, len(snapshot.CommandCounts))
+	for cmd := range snapshot.CommandCounts {
+		if cmd != "ERROR" {
+			commands = append(commands, cmd)
+		}
 	}
+	sort.Strings(commands)
 
-	for _, cmd := range tracked {
-		count := snapshot.Get(cmd)
-		sb.WriteString(fmt.Sprintf("%s: %d\n", cmd, count))
+	for _, cmd := range commands {
+		sb.WriteString(fmt.Sprintf("%s: %d\n", cmd, snapshot.Get(cmd)))
 	}
+	sb.WriteString(fmt.Sprintf("Evicted keys: %d\n", snapshot.EvictedKeys))
+	sb.WriteString(fmt.Sprintf("Expired keys: %d\n", snapshot.ExpiredKeys))
+	sb.WriteString(fmt.Sprintf("Errors: %d", snapshot.Get("ERROR")))
+
+	return sb.String()
+}
 
-	return sb.String()[:len(sb.String())-1]
+func parseFlushMode(tokens []string) (async bool, ok bool) {
+	switch len(tokens) {
+	case 1:
+		return false, true
+	case 2:
+		async := strings.ToUpper(tokens[1]) == "ASYNC"
+		return async, async
+	default:
+		return false, false
+	}
+}
+
+func flush(async bool) {
+	if async {
+		kv.FlushAsync()
+	} else {
+		kv.Flush()
+	}
+}
+
+// abortCommand reports a command that stopped early because its context
+// was cancelled or ran out of time
+func abortCommand(ctx context.Context, w io.Writer, cmd string) error {
+	log.Printf("[WARN] %s aborted: %v\n", cmd, ctx.Err())
+	metrics.Inc("ERROR")
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return replyError(w, CommandTimedOut)
+	}
+	return replyError(w, CommandCanceled)
+}
+
+// reply writes a complete response to w
+func reply(w io.Writer, response string) error {
+	_, err := io.WriteString(w, response)
+	return err
+}
+
+// replyError writes an error response to w and returns errRejected, so the
+// command isn't replicated and a script running it stops
+func replyError(w io.Writer, response string) error {
+	if err := reply(w, response); err != nil {
+		return err
+	}
+	return errRejected
 }
 
 func formatInvalidCommand(cmd, expected string) string {
@@ -760,17 +1565,40 @@ func formatInvalidTTL(ttlStr string) string {
 	return fmt.Sprintf("ERROR: Invalid TTL value '%s'. TTL must be a positive integer.", ttlStr)
 }
 
+// resolveDataPath checks a file name given by a client against
+// config.DataDir. Without a data directory any path is allowed, otherwise
+// relative names are taken from inside it and nothing may escape it.
+func resolveDataPath(name string) (string, error) {
+	if config.DataDir == "" {
+		return name, nil
+	}
+
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.DataDir, path)
+	}
+	rel, err := filepath.Rel(config.DataDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		log.Printf("[WARN] Rejected path outside data directory: %s\n", name)
+		return "", fmt.Errorf("ERROR: Path '%s' is outside the data directory", name)
+	}
+	return path, nil
+}
+
 func triggerSIGINT() {
 	p, _ := os.FindProcess(os.Getpid())
 	p.Signal(syscall.SIGINT)
 }
 
-// Main method
-func StartServer() {
-	log.Println("[INFO] Starting server...")
+// loadSnapshot loads FileName into the store, starts the background jobs
+// that work on it and marks the server ready
+func loadSnapshot(savePoints []savePoint) {
 	log.Println("[INFO] Loading data from disk...")
 
+	loaded := make(chan struct{})
+	go logLoadProgress(loaded)
 	err := kv.LoadFromDisk(FileName)
+	close(loaded)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Printf("[INFO] File %s does not exist, likely first startup\n", FileName)
@@ -781,23 +1609,189 @@ func StartServer() {
 		log.Println("[INFO] Loaded data from disk")
 	}
 
-	kv.ScheduleCleanup(10*time.Second, done)
+	lastSave.Store(time.Now().Unix())
+	if len(savePoints) > 0 {
+		scheduleAutoSave(savePoints, done)
+	}
+
+	markReady()
+	log.Println("[INFO] Server is ready")
+}
 
-	ln, err := net.Listen("tcp", Port)
+// logLoadProgress logs how far the snapshot has loaded every few seconds
+// until loaded is closed
+func logLoadProgress(loaded <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if read, total, loading := kv.LoadProgress(); loading {
+				log.Printf("[INFO] Loading data from disk: %d%%\n", read*100/total)
+			}
+		case <-loaded:
+			return
+		}
+	}
+}
+
+// Main method
+func StartServer(cfg Config) {
+	config = cfg
+	if config.LogFile != "" {
+		if err := openLogFile(); err != nil {
+			log.Fatalf("[FATAL] Failed to open log file %s: %v\n", config.LogFile, err)
+		}
+	}
+	log.Println("[INFO] Starting server...")
+
+	savePoints, err := configureStore()
+	if err != nil {
+		log.Fatalf("[FATAL] %v\n", err)
+	}
+
+	if config.ACLFile != "" {
+		acl, err = loadACL(config.ACLFile)
+		if err != nil {
+			log.Fatalf("[FATAL] Invalid -aclfile: %v\n", err)
+		}
+		log.Printf("[INFO] Loaded %d ACL users, clients must AUTH\n", len(acl.users))
+	}
+
+	if config.ConfigFile != "" {
+		if err := loadConfigFile(config.ConfigFile); err != nil {
+			log.Fatalf("[FATAL] Invalid -config: %v\n", err)
+		}
+	}
+	setupReloadHook()
+
+	listeners, err := listen()
 	if err != nil {
 		log.Fatalf("[FATAL] Failed to start server: %v\n", err)
 		return
 	}
-	setupShutdownHook(ln)
-	defer ln.Close()
-	log.Println("[INFO] Server is listening on port 8080...")
+	setupShutdownHook(listeners)
+
+	if config.HTTPAddr != "" {
+		startHTTPGateway(config.HTTPAddr)
+	}
+
+	// Clients can connect while the snapshot loads, but only HEALTH and PING
+	// run until it's done
+	go loadSnapshot(savePoints)
+
+	// Accept clients on every listener until shutdown closes them
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			defer ln.Close()
+			acceptLoop(ln)
+		}(ln)
+	}
+	wg.Wait()
+}
+
+// configureStore applies the settings in config that shape the store and
+// command handling, the part of startup StartServer and Embed share. It
+// returns the parsed auto-save rules for loadSnapshot.
+func configureStore() ([]savePoint, error) {
+	if config.TTLJitter > 0 {
+		kv.SetTTLJitter(config.TTLJitter, rand.New(rand.NewSource(time.Now().UnixNano())))
+		log.Printf("[INFO] TTL jitter set to ±%d%%\n", config.TTLJitter)
+	}
+
+	readOnly.Store(config.ReadOnly)
+	if config.ReadOnly {
+		log.Println("[INFO] Read-only mode enabled")
+	}
+
+	if config.CaseInsensitiveKeys {
+		kv.EnableCaseInsensitiveKeys()
+		log.Println("[INFO] Case-insensitive keys enabled")
+	}
+
+	if config.PrefixIndex {
+		kv.EnablePrefixIndex()
+		log.Println("[INFO] Prefix index enabled")
+	}
+
+	policy, ok := kvstore.ParseEvictionPolicy(config.MaxMemoryPolicy)
+	if !ok {
+		return nil, fmt.Errorf("unknown -maxmemory-policy %q, expected noeviction, lru or lfu", config.MaxMemoryPolicy)
+	}
+	kv.SetMaxMemory(config.MaxMemory, policy)
+	if config.MaxMemory > 0 {
+		log.Printf("[INFO] Memory limit set to %d bytes, policy %s\n", config.MaxMemory, policy)
+	}
+
+	if config.PubSubHistory > 0 {
+		pubsub.SetHistorySize(config.PubSubHistory)
+		log.Printf("[INFO] Keeping the last %d messages of each channel\n", config.PubSubHistory)
+	}
+
+	kv.SetMaxSizes(config.MaxKeyBytes, config.MaxValueBytes)
+	if config.MaxKeyBytes > 0 || config.MaxValueBytes > 0 {
+		log.Printf("[INFO] Size limits set to %d bytes per key, %d bytes per value\n", config.MaxKeyBytes, config.MaxValueBytes)
+	}
+
+	savePoints, err := parseSavePoints(config.Save)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -save: %v", err)
+	}
+
+	if err := registerAliases(config.Aliases); err != nil {
+		return nil, fmt.Errorf("invalid -alias: %v", err)
+	}
+
+	applySettings()
+	kv.SetExpireHook(func() { metrics.AddExpiredKeys(1) })
+	kv.ScheduleCleanup(config.CleanupInterval, done)
+	return savePoints, nil
+}
+
+// listen opens the TCP listener on config.Addr and the Unix socket at
+// config.UnixSocket, whichever are set
+func listen() ([]net.Listener, error) {
+	if config.Addr == "" && config.UnixSocket == "" {
+		return nil, errors.New("neither -addr nor -unixsocket is set")
+	}
 
-	// Main loop
+	var listeners []net.Listener
+	if config.Addr != "" {
+		ln, err := net.Listen("tcp", config.Addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+		log.Printf("[INFO] Server is listening on %s...\n", config.Addr)
+	}
+	if config.UnixSocket != "" {
+		// A socket left behind by a server that didn't shut down cleanly
+		// would make the listen fail
+		if info, err := os.Stat(config.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(config.UnixSocket)
+		}
+		ln, err := net.Listen("unix", config.UnixSocket)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+		log.Printf("[INFO] Server is listening on unix socket %s...\n", config.UnixSocket)
+	}
+	return listeners, nil
+}
+
+func acceptLoop(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Printf("[INFO] Listener closed: %v\n", err)
-			break
+			return
 		}
 		log.Println("[INFO] Client connected:", getAddress(conn))
 		go handleConnection(conn)
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+// resetServer gives a test a fresh, ready server with the default config
+// and an empty store
+func resetServer(t *testing.T) {
+	t.Helper()
+	kv = kvstore.New()
+	config = DefaultConfig()
+	acl = nil
+	readOnly.Store(false)
+	state.Store(int32(stateReady))
+	metrics = NewMetrics()
+	replication = NewReplication()
+	pubsub = NewPubSubManager()
+	applySettings()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// run dispatches tokens the way a client's command is and returns the reply
+func run(t *testing.T, tokens ...string) string {
+	t.Helper()
+	return runContext(t, context.Background(), tokens...)
+}
+
+// runContext is run with the command's context set to ctx
+func runContext(t *testing.T, ctx context.Context, tokens ...string) string {
+	t.Helper()
+	var w bytes.Buffer
+	if err := processCommand(ctx, &w, tokens, nil); err != nil && err != errRejected {
+		t.Fatalf("%v: %v", tokens, err)
+	}
+	return w.String()
+}
+
+func TestMGetReply(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "present", "value")
+	run(t, "SET", "nil", NilReply)
+
+	got := run(t, "MGET", "present", "absent", "nil")
+	want := `"value"` + "\n" + NilReply + "\n" + `"(nil)"`
+	if got != want {
+		t.Fatalf("MGET = %q, want %q", got, want)
+	}
+}
+
+// timeoutLog signals each time the watchdog logs a command that exceeded
+// the command timeout
+type timeoutLog chan struct{}
+
+func (l timeoutLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("exceeded")) {
+		l <- struct{}{}
+	}
+	return len(p), nil
+}
+
+func TestTimedOutWriteWaitsAndRepliesWithResult(t *testing.T) {
+	resetServer(t)
+	commandTimeout.Store(int64(time.Millisecond))
+	exceeded := make(timeoutLog, 1)
+	log.SetOutput(exceeded)
+
+	// Holding the replication lock keeps SET from finishing in time
+	replication.mu.Lock()
+	type outcome struct {
+		response string
+		err      error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		var w bytes.Buffer
+		err := runCommand(context.Background(), &w, []string{"SET", "k", "v"}, nil)
+		done <- outcome{w.String(), err}
+	}()
+
+	<-exceeded
+	select {
+	case <-done:
+		t.Fatal("runCommand returned while SET was still running")
+	default:
+	}
+	replication.mu.Unlock()
+
+	got := <-done
+	if got.err != nil || got.response != OK {
+		t.Fatalf("runCommand = %q, %v, want %q", got.response, got.err, OK)
+	}
+	if value, _ := kv.Get("k"); value != "v" {
+		t.Fatalf("Get = %q, want %q", value, "v")
+	}
+}
+
+func TestMSetCaseInsensitiveKeepsLastValue(t *testing.T) {
+	resetServer(t)
+	kv.EnableCaseInsensitiveKeys()
+
+	if got := run(t, "MSET", "A", "1", "b", "x", "a", "2"); got != "2" {
+		t.Fatalf("MSET = %q, want %q", got, "2")
+	}
+	if got := run(t, "GET", "A"); got != "2" {
+		t.Fatalf("GET = %q, want %q", got, "2")
+	}
+}
+
+func TestScanCursorResumesAfterLastKey(t *testing.T) {
+	resetServer(t)
+	for _, key := range []string{"0", "1", "2"} {
+		run(t, "SET", key, "v")
+	}
+
+	first := strings.Split(run(t, "SCAN", "0", "COUNT", "2"), "\n")
+	if len(first) != 3 || first[1] != "0" || first[2] != "1" {
+		t.Fatalf("first page = %q", first)
+	}
+	run(t, "DEL", "0")
+
+	if got, want := run(t, "SCAN", first[0], "COUNT", "2"), "0\n2"; got != want {
+		t.Fatalf("second page = %q, want %q", got, want)
+	}
+	if got := run(t, "SCAN", "1"); !strings.HasPrefix(got, "ERROR") {
+		t.Fatalf("SCAN with an odd-length cursor = %q, want an error", got)
+	}
+}
+
+func TestTTLRemovesExpiredKey(t *testing.T) {
+	resetServer(t)
+	run(t, "SETEX", "k", "v", "60")
+	kv.ExpireAt("k", time.Now().Add(-time.Second))
+
+	if got := run(t, "TTL", "k"); got != "-2" {
+		t.Fatalf("TTL = %q, want %q", got, "-2")
+	}
+	if got := run(t, "KEYEXISTS", "k"); got != "0" {
+		t.Fatalf("KEYEXISTS = %q, want %q", got, "0")
+	}
+}
+
+func TestType(t *testing.T) {
+	resetServer(t)
+	run(t, "SET", "live", "v")
+	run(t, "SETEX", "expired", "v", "60")
+	kv.ExpireAt("expired", time.Now().Add(-time.Second))
+	run(t, "ZADD", "zset", "1", "m")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"missing", "none"},
+		{"live", "string"},
+		{"expired", "none"},
+		{"zset", "zset"},
+	}
+	for i, test := range tests {
+		if got := run(t, "TYPE", test.key); got != test.want {
+			t.Errorf("TYPE %s = %q, want %q", test.key, got, test.want)
+		}
+		if count := metrics.Get("TYPE"); count != i+1 {
+			t.Errorf("TYPE metric = %d after %d calls", count, i+1)
+		}
+	}
+}
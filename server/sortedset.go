@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+func handleZAdd(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "ZADD <key> <score> <member> [<score> <member> ...]"
+	if len(tokens)%2 != 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("ZADD", format))
+	}
+
+	key := tokens[1]
+	members := make([]kvstore.ScoredMember, 0, (len(tokens)-2)/2)
+	for i := 2; i < len(tokens); i += 2 {
+		score, err := parseScore(tokens[i])
+		if err != nil {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidScore(tokens[i]))
+		}
+		members = append(members, kvstore.ScoredMember{Member: tokens[i+1], Score: score})
+	}
+
+	added, err := kv.ZAdd(key, members)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] ZADD %s -> %d added\n", key, added)
+	metrics.Inc("ZADD")
+	return reply(w, strconv.Itoa(added))
+}
+
+func handleZScore(ctx context.Context, w io.Writer, tokens []string) error {
+	key, member := tokens[1], tokens[2]
+	score, exists, err := kv.ZScore(key, member)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	metrics.Inc("ZSCORE")
+	if !exists {
+		return reply(w, NilReply)
+	}
+	return reply(w, formatScore(score))
+}
+
+func handleZRange(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "ZRANGE <key> <start> <stop> [WITHSCORES]"
+	withScores := false
+	if len(tokens) == 5 {
+		if strings.ToUpper(tokens[4]) != "WITHSCORES" {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("ZRANGE", format))
+		}
+		withScores = true
+	}
+
+	key := tokens[1]
+	start, err := strconv.Atoi(tokens[2])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("ZRANGE", format))
+	}
+	stop, err := strconv.Atoi(tokens[3])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("ZRANGE", format))
+	}
+
+	members, err := kv.ZRange(key, start, stop)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] ZRANGE %s %d %d -> %d members\n", key, start, stop, len(members))
+	metrics.Inc("ZRANGE")
+	if len(members) == 0 {
+		return reply(w, "EMPTY")
+	}
+	return reply(w, formatScoredMembers(members, withScores))
+}
+
+func handleZRank(ctx context.Context, w io.Writer, tokens []string) error {
+	key, member := tokens[1], tokens[2]
+	rank, exists, err := kv.ZRank(key, member)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	metrics.Inc("ZRANK")
+	if !exists {
+		return reply(w, NilReply)
+	}
+	return reply(w, strconv.Itoa(rank))
+}
+
+func handleZRangeByScore(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "ZRANGEBYSCORE <key> <min> <max> [WITHSCORES] [LIMIT <offset> <count>]"
+	key := tokens[1]
+	lo, err := parseScoreBound(tokens[2])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidScore(tokens[2]))
+	}
+	hi, err := parseScoreBound(tokens[3])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidScore(tokens[3]))
+	}
+
+	withScores := false
+	offset, count := 0, -1
+	for i := 4; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(tokens) {
+				metrics.Inc("ERROR")
+				return replyError(w, formatInvalidCommand("ZRANGEBYSCORE", format))
+			}
+			offset, err = strconv.Atoi(tokens[i+1])
+			if err != nil || offset < 0 {
+				metrics.Inc("ERROR")
+				return replyError(w, formatInvalidCommand("ZRANGEBYSCORE", format))
+			}
+			count, err = strconv.Atoi(tokens[i+2])
+			if err != nil {
+				metrics.Inc("ERROR")
+				return replyError(w, formatInvalidCommand("ZRANGEBYSCORE", format))
+			}
+			i += 2
+		default:
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("ZRANGEBYSCORE", format))
+		}
+	}
+
+	members, err := kv.ZRangeByScore(key, lo, hi, offset, count)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] ZRANGEBYSCORE %s %s %s -> %d members\n", key, tokens[2], tokens[3], len(members))
+	metrics.Inc("ZRANGEBYSCORE")
+	if len(members) == 0 {
+		return reply(w, "EMPTY")
+	}
+	return reply(w, formatScoredMembers(members, withScores))
+}
+
+func handleZIncrBy(ctx context.Context, w io.Writer, tokens []string) error {
+	key, member := tokens[1], tokens[3]
+	delta, err := parseScore(tokens[2])
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidScore(tokens[2]))
+	}
+
+	score, err := kv.ZIncrBy(key, member, delta)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] ZINCRBY %s %s -> %s\n", key, member, formatScore(score))
+	metrics.Inc("ZINCRBY")
+	return reply(w, formatScore(score))
+}
+
+func handleZScan(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "ZSCAN <key> <cursor> [MATCH <pattern>] [COUNT <count>]"
+	if len(tokens)%2 != 1 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("ZSCAN", format))
+	}
+
+	key := tokens[1]
+	cursor, err := strconv.Atoi(tokens[2])
+	if err != nil || cursor < 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("ZSCAN", format))
+	}
+
+	count := DefaultScanCount
+	pattern := ""
+	for i := 3; i < len(tokens); i += 2 {
+		option, arg := strings.ToUpper(tokens[i]), tokens[i+1]
+		switch option {
+		case "COUNT":
+			count, err = strconv.Atoi(arg)
+			if err != nil || count <= 0 {
+				metrics.Inc("ERROR")
+				return replyError(w, formatInvalidCommand("ZSCAN", format))
+			}
+		case "MATCH":
+			if _, err := path.Match(arg, ""); err != nil {
+				metrics.Inc("ERROR")
+				return replyError(w, fmt.Sprintf("ERROR: Invalid pattern '%s'", arg))
+			}
+			pattern = arg
+		default:
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("ZSCAN", format))
+		}
+	}
+
+	members, next, err := kv.ZScan(key, cursor, count, pattern)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] ZSCAN %s %d -> %d members, next cursor %d\n", key, cursor, len(members), next)
+	metrics.Inc("ZSCAN")
+
+	response := strconv.Itoa(next)
+	if len(members) > 0 {
+		response += "\n" + formatScoredMembers(members, true)
+	}
+	return reply(w, response)
+}
+
+// parseScore accepts any finite float, plus inf/+inf/-inf
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || score != score {
+		return 0, fmt.Errorf("invalid score %q", s)
+	}
+	return score, nil
+}
+
+// parseScoreBound parses a score range bound, where a leading "(" makes the
+// bound exclusive, e.g. "(5" or "-inf"
+func parseScoreBound(s string) (kvstore.ScoreBound, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	score, err := parseScore(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return kvstore.ScoreBound{}, err
+	}
+	return kvstore.ScoreBound{Value: score, Exclusive: exclusive}, nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func formatInvalidScore(scoreStr string) string {
+	return fmt.Sprintf("ERROR: Invalid score '%s'. Score must be a number.", scoreStr)
+}
+
+// formatScoredMembers puts one member per line, followed by its score on the
+// next line when withScores is set
+func formatScoredMembers(members []kvstore.ScoredMember, withScores bool) string {
+	var sb strings.Builder
+	for i, m := range members {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(m.Member)
+		if withScores {
+			sb.WriteString("\n" + formatScore(m.Score))
+		}
+	}
+	return sb.String()
+}
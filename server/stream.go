@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Keys written per batch by streaming handlers
+const streamBatchSize = 1000
+
+// Commands whose responses can be too large to build in memory. Their
+// handlers write to the connection as they go instead of into a buffer.
+var streamingCommands = map[string]bool{
+	KeysCommand: true,
+}
+
+func isStreamingCommand(tokens []string) bool {
+	return len(tokens) > 0 && streamingCommands[commandName(tokens[0])]
+}
+
+// countingWriter records the bytes written to a connection in its ConnInfo
+type countingWriter struct {
+	w    io.Writer
+	info *ConnInfo
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.info.RecordWrite(n)
+	return n, err
+}
+
+// deadlineWriter gives each write to conn its own write deadline, so a large
+// response to a slow client only fails if the client stops reading, not
+// just because the whole response took longer than Timeout to drain
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.conn.SetWriteDeadline(time.Now().Add(Timeout * time.Second))
+	return d.conn.Write(p)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deadlineConn records the write deadlines set on a connection
+type deadlineConn struct {
+	net.Conn
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (d *deadlineConn) SetWriteDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.deadlines = append(d.deadlines, t)
+	d.mu.Unlock()
+	return d.Conn.SetWriteDeadline(t)
+}
+
+func TestLargeKeysToSlowReader(t *testing.T) {
+	resetServer(t)
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		kv.Set("key:"+strconv.Itoa(i), "v")
+	}
+
+	serverConn, clientConn := net.Pipe()
+	conn := &deadlineConn{Conn: serverConn}
+	done := make(chan struct{})
+	go func() {
+		handleConnection(conn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		<-done
+	})
+
+	if _, err := io.WriteString(clientConn, "KEYS\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read in small chunks with a pause between them, like a slow client
+	var response strings.Builder
+	buf := make([]byte, 512)
+	for !strings.HasSuffix(response.String(), "\nEND\n") {
+		n, err := clientConn.Read(buf)
+		if err != nil {
+			t.Fatalf("read after %d bytes: %v", response.Len(), err)
+		}
+		response.Write(buf[:n])
+		time.Sleep(time.Millisecond)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(response.String(), "\nEND\n"), "\n")
+	if len(lines) != keys {
+		t.Fatalf("got %d keys, want %d", len(lines), keys)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.deadlines) < 2 {
+		t.Fatalf("write deadline set %d times, want once per write", len(conn.deadlines))
+	}
+	if first, last := conn.deadlines[0], conn.deadlines[len(conn.deadlines)-1]; !last.After(first) {
+		t.Fatal("write deadline wasn't pushed back while the response drained")
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/petariliev/kvstore/kvstore"
+)
+
+// handleXAdd appends an entry to a stream. When the ID is generated, the
+// tokens are rewritten to carry it so replicas store the entry under the
+// same ID.
+func handleXAdd(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "XADD <key> <id|*> <field> <value> [<field> <value> ...]"
+	if len(tokens)%2 != 1 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("XADD", format))
+	}
+
+	key := tokens[1]
+	var id *kvstore.StreamID
+	if tokens[2] != "*" {
+		parsed, err := kvstore.ParseStreamID(tokens[2], 0)
+		if err != nil {
+			metrics.Inc("ERROR")
+			return replyError(w, err.Error())
+		}
+		id = &parsed
+	}
+
+	fields := make([]kvstore.StreamField, 0, (len(tokens)-3)/2)
+	for i := 3; i < len(tokens); i += 2 {
+		fields = append(fields, kvstore.StreamField{Name: tokens[i], Value: tokens[i+1]})
+	}
+
+	added, err := kv.XAdd(key, id, fields)
+	if err != nil {
+		log.Printf("[WARN] XADD %s -> %v\n", key, err)
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+	tokens[2] = added.String()
+
+	log.Printf("[INFO] XADD %s -> %s\n", key, added)
+	metrics.Inc("XADD")
+	return reply(w, added.String())
+}
+
+func handleXLen(ctx context.Context, w io.Writer, tokens []string) error {
+	key := tokens[1]
+	length, err := kv.XLen(key)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	metrics.Inc("XLEN")
+	return reply(w, strconv.Itoa(length))
+}
+
+func handleXRange(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "XRANGE <key> <start> <end> [COUNT <count>]"
+	key := tokens[1]
+	start, err := kvstore.ParseStreamRangeBound(tokens[2], false)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+	end, err := kvstore.ParseStreamRangeBound(tokens[3], true)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	count := -1
+	if len(tokens) > 4 {
+		if len(tokens) != 6 || strings.ToUpper(tokens[4]) != "COUNT" {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("XRANGE", format))
+		}
+		count, err = strconv.Atoi(tokens[5])
+		if err != nil || count < 0 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("XRANGE", format))
+		}
+	}
+
+	entries, err := kv.XRange(key, start, end, count)
+	if err != nil {
+		metrics.Inc("ERROR")
+		return replyError(w, err.Error())
+	}
+
+	log.Printf("[INFO] XRANGE %s %s %s -> %d entries\n", key, tokens[2], tokens[3], len(entries))
+	metrics.Inc("XRANGE")
+	if len(entries) == 0 {
+		return reply(w, "EMPTY")
+	}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = formatStreamEntry(entry)
+	}
+	return reply(w, strings.Join(lines, "\n"))
+}
+
+// handleXRead replies with the entries after the given ID of each stream,
+// one per line prefixed with the quoted stream key, or (nil) if there are
+// none
+func handleXRead(ctx context.Context, w io.Writer, tokens []string) error {
+	const format = "XREAD [COUNT <count>] STREAMS <key> [<key> ...] <id> [<id> ...]"
+	args := tokens[1:]
+
+	count := -1
+	if strings.ToUpper(args[0]) == "COUNT" {
+		if len(args) < 2 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("XREAD", format))
+		}
+		var err error
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			metrics.Inc("ERROR")
+			return replyError(w, formatInvalidCommand("XREAD", format))
+		}
+		args = args[2:]
+	}
+
+	if len(args) < 3 || strings.ToUpper(args[0]) != "STREAMS" || (len(args)-1)%2 != 0 {
+		metrics.Inc("ERROR")
+		return replyError(w, formatInvalidCommand("XREAD", format))
+	}
+	streams := (len(args) - 1) / 2
+	keys, ids := args[1:1+streams], args[1+streams:]
+
+	var lines []string
+	for i, key := range keys {
+		after, err := kvstore.ParseStreamID(ids[i], 0)
+		if err != nil {
+			metrics.Inc("ERROR")
+			return replyError(w, err.Error())
+		}
+		entries, err := kv.XRead(key, after, count)
+		if err != nil {
+			metrics.Inc("ERROR")
+			return replyError(w, err.Error())
+		}
+		for _, entry := range entries {
+			lines = append(lines, strconv.Quote(key)+" "+formatStreamEntry(entry))
+		}
+	}
+
+	log.Printf("[INFO] XREAD %v -> %d entries\n", keys, len(lines))
+	metrics.Inc("XREAD")
+	if len(lines) == 0 {
+		return reply(w, NilReply)
+	}
+	return reply(w, strings.Join(lines, "\n"))
+}
+
+// formatStreamEntry puts an entry on one line: its ID followed by each
+// field and value, quoted so they can hold spaces
+func formatStreamEntry(entry kvstore.StreamEntry) string {
+	var sb strings.Builder
+	sb.WriteString(entry.ID.String())
+	for _, field := range entry.Fields {
+		sb.WriteString(" " + strconv.Quote(field.Name) + " " + strconv.Quote(field.Value))
+	}
+	return sb.String()
+}
@@ -1,3 +1,5 @@
+//go:build ignore
+
 package main
 
 import (
@@ -89,7 +91,7 @@ func getResponse(reader *bufio.Reader) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		if strings.TrimSpace(line) == "END" {
+		if strings.TrimSuffix(line, "\n") == "END" {
 			break
 		}
 		responseBuilder.WriteString(line)